@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// A line of assembly normalised for comparison, with the line of the file it
+// came from
+type asmLine struct {
+	num  int
+	text string
+}
+
+// Normalise Hack assembly so that only its meaning is compared: comments,
+// blank lines and whitespace are dropped, and labels are renamed L0, L1, ...
+// in the order they are defined.
+func normaliseAsm(asm string) []asmLine {
+	var lines []asmLine
+	labels := map[string]string{}
+	for i, line := range strings.Split(asm, "\n") {
+		code, _, _ := strings.Cut(line, "//")
+		code = strings.Join(strings.Fields(code), "")
+		if code == "" {
+			continue
+		}
+		if strings.HasPrefix(code, "(") && strings.HasSuffix(code, ")") {
+			name := code[1 : len(code)-1]
+			if _, ok := labels[name]; !ok {
+				labels[name] = "L" + strconv.Itoa(len(labels))
+			}
+		}
+		lines = append(lines, asmLine{i + 1, code})
+	}
+
+	for i, line := range lines {
+		switch {
+		case strings.HasPrefix(line.text, "("):
+			lines[i].text = "(" + labels[line.text[1:len(line.text)-1]] + ")"
+		case strings.HasPrefix(line.text, "@"):
+			if label, ok := labels[line.text[1:]]; ok {
+				lines[i].text = "@" + label
+			}
+		}
+	}
+	return lines
+}
+
+// One line of a diff: kept in both, removed from a or added in b. Line
+// numbers are 0 for the file the line isn't in.
+type diffOp struct {
+	kind       byte // ' ', '-' or '+'
+	text       string
+	numA, numB int
+}
+
+// Most edits diffLines searches for before giving up
+const maxDiffEdits = 1000
+
+// Compute the shortest edit script turning a into b with Myers' algorithm.
+// Returns false if more than maxDiffEdits edits are needed.
+func diffLines(a, b []asmLine) ([]diffOp, bool) {
+	n, m := len(a), len(b)
+	max := n + m
+	if max > maxDiffEdits {
+		max = maxDiffEdits
+	}
+	offset := max + 1
+	v := make([]int, 2*max+3)
+	var trace [][]int
+	for d := 0; d <= max; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1] // down, an insertion
+			} else {
+				x = v[offset+k-1] + 1 // right, a deletion
+			}
+			y := x - k
+			for x < n && y < m && a[x].text == b[y].text {
+				x, y = x+1, y+1
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrackDiff(a, b, trace, offset, d), true
+			}
+		}
+	}
+	return nil, false
+}
+
+// Recover the edit script from the saved frontiers of diffLines
+func backtrackDiff(a, b []asmLine, trace [][]int, offset, d int) []diffOp {
+	var ops []diffOp
+	x, y := len(a), len(b)
+	for ; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[offset+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x, y = x-1, y-1
+			ops = append(ops, diffOp{' ', a[x].text, a[x].num, b[y].num})
+		}
+		if d > 0 {
+			if x == prevX {
+				y--
+				ops = append(ops, diffOp{'+', b[y].text, 0, b[y].num})
+			} else {
+				x--
+				ops = append(ops, diffOp{'-', a[x].text, a[x].num, 0})
+			}
+		}
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
+
+// Lines of unchanged code shown around each change
+const diffContext = 2
+
+// Compare two assembly programs after normalising them, writing the
+// differences to w. Each run of changes is headed by the lines of the
+// original files it starts at. Returns whether the programs are the same.
+func writeAsmDiff(w io.Writer, nameA, asmA, nameB, asmB string) (bool, error) {
+	ops, ok := diffLines(normaliseAsm(asmA), normaliseAsm(asmB))
+	if !ok {
+		return false, fmt.Errorf("%v and %v differ in more than %d lines", nameA, nameB, maxDiffEdits)
+	}
+
+	// Show every change with the lines around it
+	show := make([]bool, len(ops))
+	same := true
+	for i, op := range ops {
+		if op.kind == ' ' {
+			continue
+		}
+		same = false
+		for j := i - diffContext; j <= i+diffContext; j++ {
+			if j >= 0 && j < len(ops) {
+				show[j] = true
+			}
+		}
+	}
+	if same {
+		return true, nil
+	}
+
+	fmt.Fprintf(w, "--- %v\n+++ %v\n", nameA, nameB)
+	for i, op := range ops {
+		if !show[i] {
+			continue
+		}
+		if i == 0 || !show[i-1] {
+			var at []string
+			if op.numA > 0 {
+				at = append(at, fmt.Sprintf("%v:%d", nameA, op.numA))
+			}
+			if op.numB > 0 {
+				at = append(at, fmt.Sprintf("%v:%d", nameB, op.numB))
+			}
+			fmt.Fprintf(w, "@@ %v @@\n", strings.Join(at, " "))
+		}
+		fmt.Fprintf(w, "%c%v\n", op.kind, op.text)
+	}
+	return false, nil
+}
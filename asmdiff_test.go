@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormaliseAsm(t *testing.T) {
+	// setup
+	a := "// loop\n(LOOP_1)\n  @LOOP_1  // jump back\n0;JMP\n\n@SP\n"
+	b := "(START)\n@START\n0 ; JMP\n@SP"
+	// test
+	var out strings.Builder
+	same, err := writeAsmDiff(&out, "a.asm", a, "b.asm", b)
+	// assert
+	if err != nil || !same {
+		t.Fatalf("Expected programs differing only in labels and comments to match, got %v:\n%v", err, out.String())
+	}
+}
+
+func TestWriteAsmDiff(t *testing.T) {
+	// setup
+	a := "@1\nD=A\n@SP\nA=M\nM=D\n@SP\nM=M+1"
+	b := "@1\nD=A\n@SP\nM=M+1\nA=M-1\nM=D"
+	// test
+	var out strings.Builder
+	same, err := writeAsmDiff(&out, "a.asm", a, "b.asm", b)
+	// assert
+	if err != nil || same {
+		t.Fatalf("Expected a difference, got %v %v", same, err)
+	}
+	want := `--- a.asm
++++ b.asm
+@@ a.asm:2 b.asm:2 @@
+ D=A
+ @SP
+-A=M
+-M=D
+-@SP
+ M=M+1
++A=M-1
++M=D
+`
+	if out.String() != want {
+		t.Fatalf("Wanted diff:\n%v\ngot:\n%v", want, out.String())
+	}
+}
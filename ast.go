@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// A command of a VM program as a typed node, so an analysis handles each kind
+// of command in a method of its own rather than switching on its name. Only
+// the commands the translator supports have nodes so far.
+type Node interface {
+	// Call the visitor's method for this kind of node
+	Accept(v Visitor) error
+
+	// Where the command is in its source
+	Position() NodePos
+}
+
+// Where a node's command is: its file's unit name, its 1-based line and the
+// text of the line
+type NodePos struct {
+	Unit   string
+	Line   int
+	Source string
+}
+
+func (p NodePos) Position() NodePos {
+	return p
+}
+
+// `push segment index` or `pop segment index`
+type PushPop struct {
+	NodePos
+	Pop     bool
+	Segment string
+	Index   int
+}
+
+// A command taking its operands off the stack and pushing the result, e.g. add
+type Arithmetic struct {
+	NodePos
+	Op string
+}
+
+// A block of Hack assembly between //#asm and //#endasm
+type InlineAsm struct {
+	NodePos
+	Lines []string
+}
+
+// Has a method for each kind of node. Embed NopVisitor to only handle some.
+type Visitor interface {
+	VisitPushPop(n *PushPop) error
+	VisitArithmetic(n *Arithmetic) error
+	VisitInlineAsm(n *InlineAsm) error
+}
+
+func (n *PushPop) Accept(v Visitor) error    { return v.VisitPushPop(n) }
+func (n *Arithmetic) Accept(v Visitor) error { return v.VisitArithmetic(n) }
+func (n *InlineAsm) Accept(v Visitor) error  { return v.VisitInlineAsm(n) }
+
+func (n *PushPop) String() string {
+	op := "push"
+	if n.Pop {
+		op = "pop"
+	}
+	return fmt.Sprintf("%v %v %d", op, n.Segment, n.Index)
+}
+
+func (n *Arithmetic) String() string {
+	return n.Op
+}
+
+func (n *InlineAsm) String() string {
+	return fmt.Sprintf("inline assembly, %d lines", len(n.Lines))
+}
+
+// A Visitor ignoring every node
+type NopVisitor struct{}
+
+func (NopVisitor) VisitPushPop(*PushPop) error       { return nil }
+func (NopVisitor) VisitArithmetic(*Arithmetic) error { return nil }
+func (NopVisitor) VisitInlineAsm(*InlineAsm) error   { return nil }
+
+// The node for a parsed instruction, or nil if it isn't a command
+func NewNode(instr *Instruction) Node {
+	pos := NodePos{Unit: instr.unit, Line: instr.lineNum, Source: instr.raw}
+	switch instr.operation {
+	case "push", "pop":
+		return &PushPop{NodePos: pos, Pop: instr.operation == "pop", Segment: instr.segment, Index: instr.value}
+	case "add", "sub", "mul", "div", "mod", "shiftleft", "shiftright":
+		return &Arithmetic{NodePos: pos, Op: instr.operation}
+	case "asm":
+		return &InlineAsm{NodePos: pos, Lines: append([]string(nil), instr.translatedLines...)}
+	}
+	return nil
+}
+
+// Parse the VM code of the file named unit into nodes, checking it as
+// translating it with the extensions to the language opts accepts would
+func ParseNodes(r io.Reader, unit string, opts Options) ([]Node, error) {
+	var nodes []Node
+	lang := Options{Unit: unit, Backend: nullBackend{}, NegativeConstants: opts.NegativeConstants, Extended: opts.Extended}
+	err := translateStream(r, lang, func(instr *Instruction) error {
+		if node := NewNode(instr); node != nil {
+			nodes = append(nodes, node)
+		}
+		return nil
+	})
+	return nodes, err
+}
+
+// Visit each node in turn, stopping at the first error, which is located at
+// the node's line
+func Walk(nodes []Node, v Visitor) error {
+	for _, node := range nodes {
+		if err := node.Accept(v); err != nil {
+			pos := node.Position()
+			return &SourceError{Line: pos.Line, Source: pos.Source, Err: err}
+		}
+	}
+	return nil
+}
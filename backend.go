@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A Backend generates code for one target machine from parsed VM instructions
+type Backend interface {
+	// Extension of the output file, e.g. ".asm"
+	Extension() string
+
+	// Lines output before the first instruction, e.g. to set up the machine
+	Prologue() []string
+
+	// Append the code for instr to its translatedLines
+	Translate(instr *Instruction) error
+
+	// Lines output after the last instruction
+	Epilogue() []string
+
+	// Start of a comment running to the end of the line, e.g. "// "
+	CommentPrefix() string
+}
+
+// Constructors for each backend by the name given to --target. Backends may
+// keep state while translating a program, so each program gets a new one.
+var backends = map[string]func() Backend{
+	"hack":    func() Backend { return hackBackend{} },
+	"c":       func() Backend { return cBackend{} },
+	"x86-64":  func() Backend { return x86Backend{} },
+	"llvm":    func() Backend { return &llvmBackend{} },
+	"riscv32": func() Backend { return riscvBackend{} },
+	"none":    func() Backend { return nullBackend{} },
+}
+
+// A backend keeping state while translating a file, which gives a fresh one
+// for each file so files can be translated concurrently
+type statefulBackend interface {
+	Backend
+	fresh() Backend
+}
+
+// The error for a segment a native target doesn't support. Statics are
+// variables the Hack assembler allocates for each file, which these targets
+// have nothing like, so they're only supported by the hack target.
+func unsupportedSegment(instr *Instruction, target string) error {
+	if instr.segment == "static" {
+		return fmt.Errorf("static is only supported by the hack target, as the %v target has no variables for each file", target)
+	}
+	return fmt.Errorf("segment %v is not supported by the %v target", instr.segment, target)
+}
+
+// Create the backend for a target name
+func lookupBackend(target string) (Backend, error) {
+	newBackend, ok := backends[target]
+	if !ok {
+		var names []string
+		for name := range backends {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown target %v, expected one of %v", target, strings.Join(names, ", "))
+	}
+	return newBackend(), nil
+}
+
+// The backend the options select, which is the Hack platform by default
+func (opts Options) backend() Backend {
+	if opts.Backend != nil {
+		return opts.Backend
+	}
+	return hackBackend{trace: opts.Trace}
+}
+
+// Generates Hack assembly, the course's target platform
+type hackBackend struct {
+	trace bool // Record each executed VM line in the trace buffer
+}
+
+func (hackBackend) Extension() string {
+	return ".asm"
+}
+
+func (b hackBackend) Prologue() []string {
+	if b.trace {
+		return tracePreamble()
+	}
+	return nil
+}
+
+func (b hackBackend) Translate(instr *Instruction) error {
+	if b.trace {
+		instr.traceLine()
+	}
+	return instr.Translate()
+}
+
+func (hackBackend) Epilogue() []string {
+	return nil
+}
+
+func (hackBackend) CommentPrefix() string {
+	return "// "
+}
+
+// Generates nothing, only checking each instruction as the Hack backend
+// would, for validating programs without producing output
+type nullBackend struct{}
+
+func (nullBackend) Extension() string {
+	return ""
+}
+
+func (nullBackend) Prologue() []string {
+	return nil
+}
+
+func (nullBackend) Translate(instr *Instruction) error {
+	err := instr.Translate()
+	instr.translatedLines = instr.translatedLines[:0]
+	return err
+}
+
+func (nullBackend) Epilogue() []string {
+	return nil
+}
+
+func (nullBackend) CommentPrefix() string {
+	return "// "
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// VM program exercising every segment the native backends support. It leaves
+// 5+7-2 = 10 on the stack.
+const nativeTestProgram = `push constant 3000
+pop pointer 0
+push constant 300
+pop local 100
+push constant 5
+pop this 2
+push constant 7
+pop temp 3
+push this 2
+push temp 3
+add
+push constant 2
+sub
+`
+
+// Compile and run a native program with the given compiler, returning its
+// exit status. Skips the test if the compiler isn't installed.
+func runNative(t *testing.T, compiler, source, ext string, flags ...string) int {
+	if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+		t.Skip("native backends are tested on linux/amd64 only")
+	}
+	if _, err := exec.LookPath(compiler); err != nil {
+		t.Skipf("%v not installed", compiler)
+	}
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "prog"+ext)
+	bin := filepath.Join(dir, "prog")
+	os.WriteFile(src, []byte(source), 0o644)
+	args := append(flags, "-o", bin, src)
+	if out, err := exec.Command(compiler, args...).CombinedOutput(); err != nil {
+		t.Fatalf("%v failed: %v\n%s\n%s", compiler, err, out, source)
+	}
+
+	err := exec.Command(bin).Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return 0
+}
+
+func TestX86Backend(t *testing.T) {
+	// setup
+	opts := Options{Backend: x86Backend{}}
+	// test
+	asm, err := translateString(nativeTestProgram, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := runNative(t, "gcc", asm, ".s")
+	// assert
+	if status != 10 {
+		t.Fatalf("Wanted exit status 10, got %v", status)
+	}
+}
+
+func TestLookupBackend(t *testing.T) {
+	if _, err := lookupBackend("x86-64"); err != nil {
+		t.Fatalf("Wanted x86-64 backend, got %v", err)
+	}
+	if _, err := lookupBackend("z80"); err == nil {
+		t.Fatalf("Expected unknown target produce err")
+	}
+}
+
+func TestLLVMBackend(t *testing.T) {
+	// setup
+	if _, err := exec.LookPath("llc"); err != nil {
+		t.Skip("llc not installed")
+	}
+	ir, err := translateString(nativeTestProgram, Options{Backend: &llvmBackend{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// test
+	// LLVM 14 needs opaque pointers enabled explicitly, later versions have
+	// dropped the flag
+	var asm []byte
+	for _, args := range [][]string{{"-opaque-pointers"}, nil} {
+		cmd := exec.Command("llc", append(args, "-relocation-model=pic", "-o", "-")...)
+		cmd.Stdin = strings.NewReader(ir)
+		if asm, err = cmd.Output(); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("llc failed: %v\n%s", err, ir)
+	}
+	status := runNative(t, "gcc", string(asm), ".s")
+	// assert
+	if status != 10 {
+		t.Fatalf("Wanted exit status 10, got %v", status)
+	}
+}
+
+func TestRISCVLargeIndex(t *testing.T) {
+	// setup
+	opts := Options{Backend: riscvBackend{}}
+	// test
+	asm, err := translateString("push local 3000\n", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// assert
+	// t0 holds the address of LCL in vm_ram and must still be the base
+	// when 2*3000 is added to it
+	want := "\tadd t0, s1, t0\n\tli t2, 6000\n\tadd t0, t0, t2\n"
+	if !strings.Contains(asm, want) {
+		t.Fatalf("Wanted the index added to the segment base, got %q", asm)
+	}
+}
+
+func TestRISCVBackend(t *testing.T) {
+	// setup
+	if _, err := exec.LookPath("llvm-mc"); err != nil {
+		t.Skip("llvm-mc not installed")
+	}
+	asm, err := translateString(nativeTestProgram+"push that 1500\n", Options{Backend: riscvBackend{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// test
+	cmd := exec.Command("llvm-mc", "-triple=riscv32", "-mattr=-c", "-filetype=obj", "-o", os.DevNull)
+	cmd.Stdin = strings.NewReader(asm)
+	out, err := cmd.CombinedOutput()
+	// assert
+	if err != nil {
+		t.Fatalf("llvm-mc failed: %v\n%s\n%s", err, out, asm)
+	}
+}
+
+func TestCBackend(t *testing.T) {
+	// setup
+	opts := Options{Backend: cBackend{}}
+	// test
+	src, err := translateString(nativeTestProgram, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := runNative(t, "gcc", src, ".c")
+	// assert
+	if status != 10 {
+		t.Fatalf("Wanted exit status 10, got %v", status)
+	}
+}
+
+func TestCBackendOverflow(t *testing.T) {
+	// setup
+	// 0xFFFF * 0xFFFF and 0xFFFF >> 1 with words read back as signed, under
+	// the sanitizer so that any undefined behaviour aborts the program
+	source := "push constant -1\npush constant -1\nmul\npush constant -1\nshiftright\nsub\n" +
+		"push constant -3\nmul\npush constant -2\ndiv\n"
+	opts := Options{Backend: cBackend{}, NegativeConstants: true, Extended: true}
+	// test
+	src, err := translateString(source, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := runNative(t, "gcc", src, ".c", "-fsanitize=undefined", "-fno-sanitize-recover=all")
+	// assert
+	// (1 - -1) * -3 / -2 = 3
+	if status != 3 {
+		t.Fatalf("Wanted exit status 3, got %v\n%s", status, src)
+	}
+}
+
+func TestNativeExtendedDialect(t *testing.T) {
+	// setup
+	// ((-100/7 - -100%7) * 5 + 100 + -7>>1) << 1 = ((-14 - -2) * 5 + 100 - 4) * 2 = 72
+	source := "push constant -100\npush constant 7\ndiv\npush constant -100\npush constant 7\nmod\nsub\npush constant 5\nmul\npush constant 100\nadd\n" +
+		"push constant -7\nshiftright\nadd\nshiftleft\n"
+	opts := Options{NegativeConstants: true, Extended: true}
+	for backend, ext := range map[Backend]string{cBackend{}: ".c", x86Backend{}: ".s"} {
+		opts.Backend = backend
+		// test
+		src, err := translateString(source, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status := runNative(t, "gcc", src, ext)
+		// assert
+		if status != 72 {
+			t.Fatalf("Wanted exit status 72 from %T, got %v", backend, status)
+		}
+	}
+}
+
+func TestNativeStatic(t *testing.T) {
+	for _, target := range []string{"c", "x86-64", "llvm", "riscv32"} {
+		// setup
+		backend, _ := lookupBackend(target)
+		// test
+		_, err := translateString("push constant 1\npop static 0\n", Options{Backend: backend})
+		// assert
+		if err == nil || !strings.Contains(err.Error(), "only supported by the hack target") {
+			t.Fatalf("Wanted static refused by the %v target as hack only, got %v", target, err)
+		}
+	}
+}
+
+func TestNullBackend(t *testing.T) {
+	// setup
+	opts := Options{Backend: nullBackend{}, Minify: true}
+	// test
+	out, err := translateString(nativeTestProgram, opts)
+	// assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "" {
+		t.Fatalf("Wanted no code generated, got %q", out)
+	}
+	for _, source := range []string{"pop constant 1", "push nowhere 1", "//#asm\nM=Q\n//#endasm"} {
+		if _, err := translateString(source, opts); err == nil {
+			t.Fatalf("Expected %q produce err", source)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+/*
+A compact binary form of a parsed VM program, so programs can be cached or
+shipped to other tools without being parsed again. `vm-translator encode`
+writes it to a .vmbc file, and translate and run accept .vmbc files in place
+of .vm files. All integers are varints as written by encoding/binary.
+
+	magic     "VMBC"
+	version   1 byte
+	names     uvarint count, then each name as a uvarint length and bytes.
+	          Holds every operation and segment name the program uses.
+	count     uvarint number of instructions
+	per instruction:
+	  line    uvarint line number of the source
+	  op      uvarint index of the operation in names
+	  for push and pop only:
+	  segment uvarint index of the segment in names
+	  value   varint
+	  for asm and comment only:
+	  lines   uvarint count, then each line as a uvarint length and bytes.
+	          The inline assembly, or the comments as "// text".
+*/
+const (
+	bytecodeMagic   = "VMBC"
+	bytecodeVersion = 2
+	bytecodeExt     = ".vmbc"
+)
+
+// Write the parsed instructions to w in the bytecode format
+func encodeProgram(w io.Writer, instrs []*Instruction) error {
+	var names []string
+	index := map[string]int{}
+	name := func(s string) int {
+		i, ok := index[s]
+		if !ok {
+			i = len(names)
+			index[s] = i
+			names = append(names, s)
+		}
+		return i
+	}
+
+	// Encode the instructions first to collect the names they use
+	var body []byte
+	for _, instr := range instrs {
+		body = binary.AppendUvarint(body, uint64(instr.lineNum))
+		body = binary.AppendUvarint(body, uint64(name(instr.operation)))
+		if hasSegment(instr.operation) {
+			body = binary.AppendUvarint(body, uint64(name(instr.segment)))
+			body = binary.AppendVarint(body, int64(instr.value))
+		}
+		if hasLines(instr.operation) {
+			body = binary.AppendUvarint(body, uint64(len(instr.translatedLines)))
+			for _, line := range instr.translatedLines {
+				body = binary.AppendUvarint(body, uint64(len(line)))
+				body = append(body, line...)
+			}
+		}
+	}
+
+	out := append([]byte(bytecodeMagic), bytecodeVersion)
+	out = binary.AppendUvarint(out, uint64(len(names)))
+	for _, n := range names {
+		out = binary.AppendUvarint(out, uint64(len(n)))
+		out = append(out, n...)
+	}
+	out = binary.AppendUvarint(out, uint64(len(instrs)))
+	out = append(out, body...)
+	_, err := w.Write(out)
+	return err
+}
+
+// Whether instructions of an operation have a segment and value
+func hasSegment(operation string) bool {
+	return operation == "push" || operation == "pop"
+}
+
+// Whether instructions of an operation are kept as their lines, which aren't
+// VM commands
+func hasLines(operation string) bool {
+	return operation == "asm" || operation == "comment"
+}
+
+// Read a string written as a uvarint length and bytes, of at most max bytes
+func readBytecodeString(br *bufio.Reader, max uint64) (string, error) {
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return "", err
+	}
+	if n > max {
+		return "", fmt.Errorf("string of %d bytes is too long", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(br, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// Read a program in the bytecode format. Each instruction is validated as if
+// it had been parsed from source.
+func decodeProgram(r io.Reader) ([]*Instruction, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(bytecodeMagic)+1)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("reading bytecode header: %w", err)
+	}
+	if string(header[:len(bytecodeMagic)]) != bytecodeMagic {
+		return nil, errors.New("not a VM bytecode file")
+	}
+	if header[len(bytecodeMagic)] != bytecodeVersion {
+		return nil, fmt.Errorf("unsupported bytecode version %d", header[len(bytecodeMagic)])
+	}
+
+	numNames, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for i := uint64(0); i < numNames; i++ {
+		name, err := readBytecodeString(br, 64)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	lookup := func() (string, error) {
+		i, err := binary.ReadUvarint(br)
+		if err != nil {
+			return "", err
+		}
+		if i >= uint64(len(names)) {
+			return "", fmt.Errorf("name %d out of range", i)
+		}
+		return names[i], nil
+	}
+
+	count, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	var instrs []*Instruction
+	for i := uint64(0); i < count; i++ {
+		lineNum, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+		text, err := lookup()
+		if err != nil {
+			return nil, err
+		}
+		if hasLines(text) {
+			instr := Instruction{lineNum: int(lineNum), operation: text}
+			if text == "asm" {
+				instr.stripped = "inline assembly"
+			}
+			numLines, err := binary.ReadUvarint(br)
+			if err != nil {
+				return nil, err
+			}
+			for j := uint64(0); j < numLines; j++ {
+				// No longer than translateStream can scan
+				line, err := readBytecodeString(br, bufio.MaxScanTokenSize)
+				if err != nil {
+					return nil, err
+				}
+				instr.outputLines(line)
+			}
+			instrs = append(instrs, &instr)
+			continue
+		}
+		if hasSegment(text) {
+			segment, err := lookup()
+			if err != nil {
+				return nil, err
+			}
+			value, err := binary.ReadVarint(br)
+			if err != nil {
+				return nil, err
+			}
+			text += " " + segment + " " + strconv.FormatInt(value, 10)
+		}
+
+		instr := NewInstruction(text)
+		instr.lineNum = int(lineNum)
+		if err := instr.parse(); err != nil {
+			return nil, &SourceError{Line: instr.lineNum, Err: err}
+		}
+		instrs = append(instrs, &instr)
+	}
+	return instrs, nil
+}
+
+// VM source for a decoded program, with each command on the line it was
+// parsed from, so errors and debug information from translating it give the
+// lines of the original .vm file
+func programSource(instrs []*Instruction) string {
+	var b strings.Builder
+	line := 1
+	// Start a new line of source, with blank lines up to the one num says
+	newLine := func(num int) {
+		for ; line < num; line++ {
+			b.WriteString("\n")
+		}
+		line++
+	}
+	for _, instr := range instrs {
+		newLine(instr.lineNum)
+		switch {
+		case instr.operation == "asm":
+			b.WriteString(asmBlockStart + "\n")
+			for _, l := range instr.translatedLines {
+				newLine(line)
+				b.WriteString(l + "\n")
+			}
+			newLine(line)
+			b.WriteString(asmBlockEnd + "\n")
+		case instr.operation == "comment":
+			for i, l := range instr.translatedLines {
+				if i > 0 {
+					newLine(line)
+				}
+				b.WriteString(l + "\n")
+			}
+		case hasSegment(instr.operation):
+			fmt.Fprintf(&b, "%v %v %d\n", instr.operation, instr.segment, instr.value)
+		default:
+			b.WriteString(instr.operation + "\n")
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+Generates a self-contained C program, so VM programs can be compiled with any
+C compiler and run natively for fast testing:
+
+	cc -o Foo Foo.c
+
+Memory is an array of 16-bit words laid out like Hack RAM, with SP in ram[0]
+and the stack starting at ram[256]. Unsigned arithmetic on the words wraps
+just as it does on Hack. C promotes the words to int before operating on
+them, so anything that could overflow an int (only mul) is done in uint32_t,
+and words are read as signed with word() rather than a cast to int16_t,
+which is implementation-defined for values above 32767. The program returns
+the value on top of the stack as its exit status, or 0 if the stack is empty.
+*/
+type cBackend struct{}
+
+// The top two words of the stack. Indexes wrap within ram like Hack
+// addresses, even if the stack has underflowed.
+const (
+	cTop  = "ram[(uint16_t)(ram[0] - 1)]"
+	cNext = "ram[ram[0]]" // After ram[0]--, the word that was on top
+)
+
+// C expression for the RAM word segment[index] refers to
+func cSegment(instr *Instruction) (string, error) {
+	i := instr.value
+	switch instr.segment {
+	case "local", "argument", "this", "that":
+		return fmt.Sprintf("ram[(uint16_t)(ram[%d] + %d)]", x86SegmentPointers[instr.segment], i), nil
+	case "temp":
+		return fmt.Sprintf("ram[%d]", 5+i), nil
+	case "pointer":
+		return fmt.Sprintf("ram[%d]", 3+i), nil
+	}
+	return "", unsupportedSegment(instr, "c")
+}
+
+func (cBackend) Extension() string {
+	return ".c"
+}
+
+func (cBackend) Prologue() []string {
+	return []string{
+		"#include <stdint.h>",
+		"",
+		"static uint16_t ram[65536];",
+		"",
+		"// The signed value of a word",
+		"static int32_t word(uint16_t w) {",
+		"\treturn w < 0x8000 ? w : (int32_t)w - 0x10000;",
+		"}",
+		"",
+		"int main(void) {",
+		"\tram[0] = 256;",
+	}
+}
+
+func (cBackend) Epilogue() []string {
+	return []string{
+		"\t// return the top of the VM stack, or 0 if it is empty",
+		"\treturn ram[0] > 256 ? word(ram[ram[0] - 1]) : 0;",
+		"}",
+		"",
+	}
+}
+
+func (cBackend) CommentPrefix() string {
+	return "\t// "
+}
+
+func (cBackend) Translate(instr *Instruction) error {
+	switch instr.operation {
+	case "push":
+		value := fmt.Sprint(instr.value)
+		if instr.segment != "constant" {
+			var err error
+			if value, err = cSegment(instr); err != nil {
+				return err
+			}
+		}
+		instr.outputLines(fmt.Sprintf("\tram[ram[0]++] = %v;", value))
+	case "pop":
+		if instr.segment == "constant" {
+			return errors.New("`pop constant` not implemented, doesn't make sense")
+		}
+		target, err := cSegment(instr)
+		if err != nil {
+			return err
+		}
+		instr.outputLines("\tram[0]--;", fmt.Sprintf("\t%v = %v;", target, cNext))
+	case "add":
+		instr.outputLines("\tram[0]--;", fmt.Sprintf("\t%v += %v;", cTop, cNext))
+	case "sub":
+		instr.outputLines("\tram[0]--;", fmt.Sprintf("\t%v -= %v;", cTop, cNext))
+	case "mul":
+		// 0xFFFF * 0xFFFF overflows an int
+		instr.outputLines("\tram[0]--;", fmt.Sprintf("\t%v = (uint16_t)((uint32_t)%v * %v);", cTop, cTop, cNext))
+	case "shiftleft":
+		instr.outputLines(fmt.Sprintf("\t%v <<= 1;", cTop))
+	case "shiftright":
+		// Arithmetic, keeping the sign bit
+		instr.outputLines(fmt.Sprintf("\t%v = (%v >> 1) | (%v & 0x8000);", cTop, cTop, cTop))
+	case "div", "mod":
+		// Signed, rounding towards zero as the words are values on Hack
+		op := map[string]string{"div": "/", "mod": "%"}[instr.operation]
+		instr.outputLines("\tram[0]--;", fmt.Sprintf("\t%v = word(%v) %v word(%v);", cTop, cTop, op, cNext))
+	}
+	return nil
+}
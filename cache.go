@@ -0,0 +1,174 @@
+//go:build !js
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+)
+
+// Changed whenever what the cache stores changes shape
+const cacheFormat = 1
+
+// Translations of .vm files kept on disk, so translating the same file the
+// same way again, as grading many submissions built on the same OS does,
+// reads the result back instead. Entries are keyed by a SHA-256 of the
+// source, the translator and every option affecting the output.
+type translationCache struct {
+	dir      string
+	identity string // The translator's, from translatorIdentity
+}
+
+// The cache in dir, or in the user's cache directory if dir is ""
+func openTranslationCache(dir string) (*translationCache, error) {
+	if dir == "" {
+		base, err := os.UserCacheDir()
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(base, "vm-translator")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &translationCache{dir, translatorIdentity()}, nil
+}
+
+// An instruction as stored in the cache
+type cachedInstruction struct {
+	Raw      string   `json:"raw,omitempty"`
+	Line     int      `json:"line"`
+	Stripped string   `json:"stripped,omitempty"`
+	Op       string   `json:"op,omitempty"`
+	Segment  string   `json:"segment,omitempty"`
+	Value    int      `json:"value,omitempty"`
+	Snippet  string   `json:"snippet,omitempty"`
+	Lines    []string `json:"lines"`
+}
+
+// Identifies the running translator, changing when it's rebuilt
+func translatorIdentity() string {
+	info, _ := debug.ReadBuildInfo()
+	id := versionText(info)
+	if exe, err := os.Executable(); err == nil {
+		if stat, err := os.Stat(exe); err == nil {
+			id += fmt.Sprintf("%v %d %v", exe, stat.Size(), stat.ModTime().UnixNano())
+		}
+	}
+	return id
+}
+
+// The key of source, the VM code of the file named unit, translated with cfg
+func (c *translationCache) key(source, unit string, cfg cliConfig) string {
+	h := sha256.New()
+	opts := cfg.opts
+	fmt.Fprintf(h, "format %d\n%v\n", cacheFormat, c.identity)
+	fmt.Fprintf(h, "unit %q backend %T scratch %v\n", unit, opts.backend(), scratchRegister)
+	fmt.Fprintf(h, "trace %v minify %v explain %v teach %v check-stack %v keep-comments %v keep-going %v negative-constants %v extended %v\n",
+		opts.Trace, opts.Minify, opts.Explain, opts.Teach, opts.CheckStack, opts.KeepComments, opts.KeepGoing, opts.NegativeConstants, opts.Extended)
+	fmt.Fprintf(h, "passes %q\ntemplates %q\nsource %q\n", opts.Passes.String(), templateSource(), source)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *translationCache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key+".json")
+}
+
+// The instructions stored under key, if there are any
+func (c *translationCache) load(key string) ([]cachedInstruction, bool) {
+	data, err := os.ReadFile(c.path(key))
+	if err != nil {
+		return nil, false
+	}
+	var instrs []cachedInstruction
+	if err := json.Unmarshal(data, &instrs); err != nil {
+		return nil, false
+	}
+	return instrs, true
+}
+
+// Store instrs under key, replacing the entry whole so a reader never sees
+// part of one
+func (c *translationCache) store(key string, instrs []cachedInstruction) error {
+	data, err := json.Marshal(instrs)
+	if err != nil {
+		return err
+	}
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "entry-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Translate a .vm file as translateFile does, passing each instruction to
+// emit from the cache if it's been translated this way before, and storing
+// the translation otherwise
+func (c *translationCache) translateFile(filename string, cfg cliConfig, emit func(*Instruction) error) error {
+	source, err := c.readSource(filename, cfg)
+	if err != nil {
+		return err
+	}
+	key := c.key(source, unitName(filename), cfg)
+	if instrs, ok := c.load(key); ok {
+		for _, cached := range instrs {
+			instr := Instruction{
+				raw: cached.Raw, lineNum: cached.Line, unit: unitName(filename),
+				stripped: cached.Stripped, operation: cached.Op, segment: cached.Segment,
+				value: cached.Value, snippet: cached.Snippet, translatedLines: cached.Lines,
+			}
+			if err := emit(&instr); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var instrs []cachedInstruction
+	err = translateFile(filename, cfg, func(instr *Instruction) error {
+		instrs = append(instrs, cachedInstruction{
+			Raw: instr.raw, Line: instr.lineNum, Stripped: instr.stripped,
+			Op: instr.operation, Segment: instr.segment, Value: instr.value,
+			Snippet: instr.snippet, Lines: append([]string(nil), instr.translatedLines...),
+		})
+		return emit(instr)
+	})
+	if err != nil {
+		return err
+	}
+	// A cache that can't be written only makes the next run slower
+	if err := c.store(key, instrs); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: can't write to the translation cache: %v\n", err)
+	}
+	return nil
+}
+
+// The text a .vm file is translated from: the file itself, or with its
+// directives expanded when preprocessing
+func (c *translationCache) readSource(filename string, cfg cliConfig) (string, error) {
+	if cfg.preprocess && filepath.Ext(filename) != bytecodeExt {
+		source, _, err := preprocessFile(filename, cfg.defines)
+		return source, err
+	}
+	text, err := os.ReadFile(filename)
+	return string(text), err
+}
@@ -0,0 +1,877 @@
+//go:build !js
+
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"slices"
+	"strings"
+)
+
+// Run the command named by the first argument, or translate the files given
+// if it isn't one
+func main() {
+	log.SetPrefix("debug: ")
+	log.SetFlags(0)
+
+	if len(os.Args) < 2 {
+		writeHelp(os.Stderr)
+		os.Exit(2)
+	}
+	if os.Args[1] == "-version" || os.Args[1] == "--version" {
+		versionMain(nil)
+		return
+	}
+	if lookupCommand(os.Args[1]) != nil {
+		runCommand(os.Args[1], os.Args[2:])
+		return
+	}
+	translateMain(os.Args[1:])
+}
+
+// Translate .vm files, in the order given, into a single assembly file
+func translateMain(args []string) {
+	fs := newFlagSet("translate")
+	logFile := fs.String("log-file", "", "write progress messages to `file` instead of stderr")
+	quiet := fs.Bool("quiet", false, "don't write progress messages, only errors")
+	output := fs.String("o", "", "write the assembly to `file`, by default named after the first input file, or a new archive if it ends in .zip")
+	trace := fs.Bool("trace", false, "emit trace writes of each VM line number into the trace buffer")
+	stats := fs.Bool("stats", false, "print estimated instruction and cycle counts after translating")
+	format := fs.String("format", "table", "write the -stats report in `format` table, json or csv")
+	listing := fs.String("listing", "", "also write an HTML `file` listing the VM source beside the generated assembly")
+	force := fs.Bool("force", false, "replace the output file if it already exists")
+	backup := fs.Bool("backup", false, "keep the output being replaced as a .bak file")
+	checkStack := fs.Bool("check-stack", false, "fail on code that pops more values than the stack holds or overflows it")
+	keepComments := fs.Bool("keep-comments", false, "carry comments in the VM code into the output")
+	minify := fs.Bool("minify", false, "write only code and labels, without comments or blank lines")
+	explain := fs.Bool("explain", false, "describe in a comment under each command what its assembly does, as a teaching aid")
+	resolve := fs.Bool("resolve-symbols", false, "write numeric addresses in place of symbols, and no labels, for assemblers without a symbol table")
+	useCache := fs.Bool("cache", false, "keep translations of each file in the -cache-dir, and reuse them when the file and options are the same")
+	noCache := fs.Bool("no-cache", false, "don't use the translation cache, even if -cache is set")
+	cacheDir := fs.String("cache-dir", "", "keep cached translations in `dir`, by default vm-translator in the user's cache directory")
+	cpuProfile := fs.String("cpuprofile", "", "write a CPU profile of the translator to `file`, for go tool pprof")
+	memProfile := fs.String("memprofile", "", "write a heap profile of the translator to `file` after translating, for go tool pprof")
+	jobs := fs.Int("jobs", runtime.NumCPU(), "translate up to `n` files at once, writing them in the order given")
+	comments := fs.String("comments", "", "comment the assembly in `style`: teach gives each command's goal, the registers it uses and its stack effect")
+	lst := fs.Bool("lst", false, "also write a .lst file giving the ROM address and VM line of each instruction")
+	sym := fs.Bool("sym", false, "also write a .sym file giving the ROM address of each label")
+	dbg := fs.Bool("dbg", false, "also write a .dbg file of JSON debug information: the ROM words of each VM line, the labels and the variables")
+	emit := fs.String("emit", "asm", "write the `files`, comma separated, from the one translation: asm, hack, lst, map, sym or dbg, each named after the output")
+	profileFile := fs.String("profile", "", "annotate the -listing with run counts from the profile `file` written by the profile subcommand")
+	hot := fs.Int("hot", 10, "highlight the `n` commands taking the most cycles in a profiled listing")
+	preprocess := fs.Bool("preprocess", false, "expand % directives such as %include before parsing")
+	defines := defineFlags{}
+	fs.Var(defines, "D", "define `NAME` for %ifdef in the preprocessor, may be repeated")
+	target := fs.String("target", "hack", "`platform` to generate code for: hack, c, x86-64, llvm or riscv32, or none to only check the code; only hack supports static")
+	level := 0
+	fs.Var(optLevelFlag{&level, 0}, "O0", "don't optimise the generated assembly (the default)")
+	fs.Var(optLevelFlag{&level, 1}, "O1", "run the basic optimisation passes")
+	fs.Var(optLevelFlag{&level, 2}, "O2", "run every optimisation pass")
+	overrides := map[string]bool{}
+	fs.Var(passFlags{overrides, true}, "enable-pass", "run the `passes` named, comma separated, whatever the level")
+	fs.Var(passFlags{overrides, false}, "disable-pass", "don't run the `passes` named, comma separated")
+	scratch := fs.String("scratch", "R13", "`register` generated code keeps temporary values in, one of R13-R15")
+	templates := fs.String("templates", "", "replace the built-in assembly snippets with the .tmpl files in `dir`, each named after the snippet")
+	printPasses := fs.Bool("print-passes", false, "list the optimisation passes that will run")
+	dryRun := fs.Bool("dry-run", false, "translate without writing any file, printing the assembly, or with -stats only the stats, to stdout")
+	keepGoing := fs.Bool("keep-going", false, "replace lines that fail to translate with a comment and carry on, reporting every error and still writing the output")
+	var lang Options
+	addLanguageFlags(fs, &lang)
+	parseFlags(fs, args)
+
+	check(SetScratchRegister(*scratch))
+	if *templates != "" {
+		if err := LoadTemplates(*templates); err != nil {
+			log.Fatal(err)
+		}
+	}
+	pm, err := newPassManager(level, overrides)
+	check(err)
+	if *printPasses {
+		os.Stderr.WriteString(pm.String())
+	}
+	if *comments != "" && *comments != "teach" {
+		log.Fatalf("unknown comment style %v, want teach", *comments)
+	}
+	if !slices.Contains(reportFormats, *format) {
+		log.Fatalf("unknown -format %v, want table, json or csv", *format)
+	}
+	emitted, err := parseEmit(*emit)
+	if err != nil {
+		log.Fatal(err)
+	}
+	*lst, *sym, *dbg = *lst || emitted["lst"], *sym || emitted["sym"], *dbg || emitted["dbg"]
+	opts := Options{Trace: *trace, Passes: pm, Minify: *minify, Explain: *explain, Teach: *comments == "teach", CheckStack: *checkStack, KeepComments: *keepComments, KeepGoing: *keepGoing, NegativeConstants: lang.NegativeConstants, Extended: lang.Extended}
+	if *target != "hack" {
+		backend, err := lookupBackend(*target)
+		check(err)
+		if *trace || *stats || *lst || *sym || *dbg || *explain || *comments != "" || *resolve {
+			log.Fatal("-trace, -stats, -lst, -sym, -dbg, -explain, -comments and -resolve-symbols are only supported for the hack target")
+		}
+		if emitted["hack"] || emitted["map"] {
+			log.Fatal("-emit=hack and -emit=map are only supported for the hack target")
+		}
+		if len(pm.passes) > 0 {
+			log.Fatal("optimisation passes are only supported for the hack target")
+		}
+		opts.Backend = backend
+	}
+
+	if *explain && len(pm.passes) > 0 {
+		log.Fatal("-explain describes unoptimised code, so can't be used with optimisation passes")
+	}
+
+	if *resolve && (*sym || *dbg || emitted["map"]) {
+		log.Fatal("-resolve-symbols leaves no symbols, so can't be used with -sym, -dbg or -emit=map")
+	}
+
+	if *dryRun && (*listing != "" || *lst || *sym || *dbg || len(emitted) > 1 || !emitted["asm"]) {
+		log.Fatal("-dry-run writes no files, so can't be used with -listing, -lst, -sym, -dbg or -emit")
+	}
+
+	var prof []profileEntry
+	if *profileFile != "" {
+		if *listing == "" {
+			log.Fatal("-profile annotates the -listing, so needs one")
+		}
+		if *hot < 0 {
+			log.Fatal("-hot can't be negative")
+		}
+		f, err := os.Open(*profileFile)
+		check(err)
+		prof, err = readProfile(f)
+		f.Close()
+		check(err)
+	}
+
+	// Errors above go to stderr whatever the log settings
+	check(redirectLog(*logFile, *quiet))
+
+	// Read the args for the filenames, translated in the order given
+	filenames := fs.Args()
+	if len(filenames) < 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	// Output beside the first file unless told otherwise, or in the current
+	// directory if it was downloaded
+	if *output == "" {
+		if isRemote(filenames[0]) {
+			*output = remoteUnitName(filenames[0]) + opts.backend().Extension()
+		} else {
+			dir := filepath.Dir(filenames[0]) // Directory we're reading/writing in
+			*output = filepath.Join(dir, unitName(filenames[0])+opts.backend().Extension())
+		}
+	}
+
+	cfg := cliConfig{
+		opts:       opts,
+		preprocess: *preprocess,
+		defines:    defines,
+		stats:      *stats,
+		format:     *format,
+		listing:    *listing,
+		lst:        *lst,
+		sym:        *sym,
+		dbg:        *dbg,
+		memoryMap:  emitted["map"],
+		hack:       emitted["hack"],
+		noAsm:      !emitted["asm"],
+		profile:    prof,
+		hot:        *hot,
+		force:      *force,
+		backup:     *backup,
+		dryRun:     *dryRun,
+
+		resolveSymbols: *resolve,
+		jobs:           *jobs,
+	}
+	if *useCache && !*noCache {
+		cfg.cache, err = openTranslationCache(*cacheDir)
+		check(err)
+	}
+	stopProfiling, err := startProfiling(*cpuProfile, *memProfile)
+	check(err)
+	fetched, err := os.MkdirTemp("", "vm-translator-")
+	check(err)
+	filenames, err = prepareInputs(filenames, fetched)
+	if err == nil && filepath.Ext(*output) == ".zip" && !*dryRun {
+		err = translateToZip(filenames, *output, cfg)
+	} else if err == nil {
+		err = translateFiles(filenames, *output, cfg)
+	}
+	os.RemoveAll(fetched)
+	if perr := stopProfiling(); perr != nil {
+		log.Println(perr)
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+// Profile the translator itself for go tool pprof: record a CPU profile in
+// cpuFile from now until stop is called, and write a heap profile to memFile
+// when it is. Either name may be "" to skip that profile.
+func startProfiling(cpuFile, memFile string) (stop func() error, err error) {
+	var cpu *os.File
+	if cpuFile != "" {
+		if cpu, err = os.Create(cpuFile); err != nil {
+			return nil, err
+		}
+		if err := pprof.StartCPUProfile(cpu); err != nil {
+			cpu.Close()
+			return nil, err
+		}
+	}
+	return func() error {
+		if cpu != nil {
+			pprof.StopCPUProfile()
+			if err := cpu.Close(); err != nil {
+				return err
+			}
+		}
+		if memFile == "" {
+			return nil
+		}
+		f, err := os.Create(memFile)
+		if err != nil {
+			return err
+		}
+		runtime.GC() // Count only what's still live
+		err = pprof.WriteHeapProfile(f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	}, nil
+}
+
+// Send progress messages to the file at path, appending to it, or discard
+// them if quiet, leaving stderr for errors
+func redirectLog(path string, quiet bool) error {
+	switch {
+	case quiet:
+		log.SetOutput(io.Discard)
+	case path != "":
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+		log.SetOutput(f)
+	}
+	return nil
+}
+
+// Report an error translating to the user and exit
+func fatal(err error) {
+	writeDiagnostic(os.Stderr, err, useColor(os.Stderr))
+	os.Exit(1)
+}
+
+// Whether to colour output to f, which is only done for terminals and can
+// be turned off by setting NO_COLOR
+func useColor(f *os.File) bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Settings for translating files from the command line
+type cliConfig struct {
+	opts       Options
+	preprocess bool // Expand % directives before parsing
+	defines    map[string]string
+	stats      bool           // Print the cycle estimates for each file
+	format     string         // Of the stats, one of reportFormats
+	listing    string         // HTML listing file to write, if any
+	lst        bool           // Write a listing of ROM addresses beside the output
+	sym        bool           // Write the ROM address of each label beside the output
+	dbg        bool           // Write debug information beside the output
+	memoryMap  bool           // Write the addresses of labels and variables beside the output
+	hack       bool           // Write the assembled machine code beside the output
+	noAsm      bool           // Leave out the output, keeping only the files written beside it
+	profile    []profileEntry // Run counts to annotate the listing with
+	hot        int            // Number of commands to highlight as hot
+	force      bool           // Replace the output if it exists
+	backup     bool           // Keep the replaced output as <output>.bak
+	dryRun     bool           // Print the output, or only the stats, instead of writing it
+
+	// Replace symbols with their addresses and drop labels in the output
+	resolveSymbols bool
+
+	cache *translationCache // Where translations are kept between runs, if anywhere
+	jobs  int               // Number of files to translate at once
+}
+
+// Translate the .vm files in order into a single assembly file named output
+func translateFiles(filenames []string, output string, cfg cliConfig) error {
+	// Open output file for writing
+	var out io.Writer
+	var ofile *outputFile
+	var kept strings.Builder
+	_, discard := cfg.opts.Backend.(nullBackend)
+	switch {
+	case discard || cfg.dryRun && cfg.stats:
+		out = io.Discard
+	case cfg.dryRun:
+		out = os.Stdout
+	case cfg.noAsm:
+		// Kept only to make the files written beside the output from
+		out = &kept
+	default:
+		var err error
+		ofile, err = createOutput(output, cfg.force, cfg.backup)
+		if err != nil {
+			return err
+		}
+		defer ofile.abort()
+		out = ofile
+	}
+
+	// Translate and write each instruction as soon as it is parsed
+	log.Println("Starting translation")
+	w := bufio.NewWriter(out)
+	aw := newAsmWriter(w, cfg.opts)
+	var unresolved strings.Builder
+	if cfg.resolveSymbols {
+		// Symbols are resolved once the whole program is known
+		aw = newAsmWriter(&unresolved, cfg.opts)
+	}
+	var lw *lstWriter
+	var lbuf *bufio.Writer
+	var lfile *outputFile
+	if cfg.lst {
+		lstName := strings.TrimSuffix(output, filepath.Ext(output)) + ".lst"
+		var err error
+		if lfile, err = createOutput(lstName, cfg.force, cfg.backup); err != nil {
+			return err
+		}
+		defer lfile.abort()
+		lbuf = bufio.NewWriter(lfile)
+		lw = newLstWriter(lbuf)
+		lw.writeLines("", cfg.opts.backend().Prologue())
+	}
+	var units []unitStats
+	var entries []listingEntry
+	var skipped ErrorList // Lines left out with -keep-going
+	var source []debugSource
+	var err error
+	var ahead []*translatedFile
+	if cfg.jobs > 1 && len(filenames) > 1 {
+		ahead = translateConcurrently(filenames, cfg, cfg.jobs)
+	}
+	for i, filename := range filenames {
+		if filepath.Ext(filename) == ".asm" {
+			if err = copyAsmFile(filename, aw, lw); err != nil {
+				break
+			}
+			continue
+		}
+		unit := unitStats{name: unitName(filename)}
+		translate := translateFile
+		switch {
+		case ahead != nil:
+			translate = ahead[i].replay
+		case cfg.cache != nil:
+			translate = cfg.cache.translateFile
+		}
+		err = translate(filename, cfg, func(instr *Instruction) error {
+			unit.add(instr)
+			if cfg.listing != "" {
+				entry := newListingEntry(instr)
+				entry.Unit = unitName(filename)
+				if len(filenames) > 1 {
+					entry.Anchor = unitName(filename) + "-" + entry.Anchor
+				}
+				entries = append(entries, entry)
+			}
+			if lw != nil {
+				lw.writeInstruction(filename, instr)
+			}
+			aw.start()
+			rom := aw.words
+			aw.writeInstruction(instr)
+			if cfg.dbg && aw.words > rom {
+				source = append(source, debugSource{rom, aw.words - rom, filename, instr.lineNum, strings.TrimSpace(instr.stripped)})
+			}
+			return aw.err
+		})
+		var list ErrorList
+		if errors.As(err, &list) {
+			skipped = append(skipped, list...)
+			err = nil
+		}
+		if err != nil {
+			break
+		}
+		units = append(units, unit)
+	}
+	if err == nil {
+		aw.finish()
+		err = aw.err
+	}
+	if _, hack := cfg.opts.backend().(hackBackend); err == nil && hack && aw.words > hackROMSize {
+		err = fmt.Errorf("program is %d instructions, more than the %d the Hack ROM holds", aw.words, hackROMSize)
+	}
+	if err == nil && cfg.resolveSymbols {
+		var resolved string
+		if resolved, err = resolveSymbols(unresolved.String()); err == nil {
+			_, err = w.WriteString(resolved)
+		}
+	}
+	if err == nil && lw != nil {
+		lw.writeLines("", cfg.opts.backend().Epilogue())
+		if err = lw.err; err == nil {
+			err = lbuf.Flush()
+		}
+		if err == nil {
+			err = lfile.commit()
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil && ofile != nil {
+		if err = ofile.commit(); err == nil {
+			log.Println("Output to", output)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if cfg.listing != "" {
+		if cfg.profile != nil {
+			annotateListing(entries, cfg.profile, cfg.hot)
+		}
+		err := writeOutput(cfg.listing, cfg, func(w io.Writer) error {
+			return writeListing(w, filepath.Base(output), entries)
+		})
+		if err != nil {
+			return err
+		}
+		log.Println("Listing written to", cfg.listing)
+	}
+
+	if cfg.sym || cfg.memoryMap || cfg.dbg || cfg.hack {
+		asm := kept.String()
+		if !cfg.noAsm {
+			text, err := os.ReadFile(output)
+			if err != nil {
+				return err
+			}
+			asm = string(text)
+		}
+		if err := writeAssembledFiles(asm, output, source, cfg); err != nil {
+			return err
+		}
+	}
+
+	if cfg.stats {
+		if err := writeStats(os.Stdout, cfg.format, units...); err != nil {
+			return err
+		}
+	}
+	if len(skipped) > 0 {
+		return skipped
+	}
+	return nil
+}
+
+// Assemble asm, the output, to find where its labels and variables end up,
+// writing the files made from that beside it: the .sym, .map, .dbg and .hack
+// asked for. The commands of the output are at source.
+func writeAssembledFiles(asm, output string, source []debugSource, cfg cliConfig) error {
+	rom, labels, vars, err := assembleSymbols(asm)
+	if err != nil {
+		return err
+	}
+	files := []struct {
+		wanted bool
+		ext    string
+		what   string
+		write  func(io.Writer) error
+	}{
+		{cfg.sym, ".sym", "Symbols", func(w io.Writer) error { return writeSymbols(w, labels) }},
+		{cfg.memoryMap, ".map", "Memory map", func(w io.Writer) error { return writeMemoryMap(w, labels, vars) }},
+		{cfg.dbg, ".dbg", "Debug information", newDebugInfo(len(rom), source, labels, vars).write},
+		{cfg.hack, ".hack", "Machine code", func(w io.Writer) error { return writeHack(w, rom) }},
+	}
+	for _, f := range files {
+		if !f.wanted {
+			continue
+		}
+		name := strings.TrimSuffix(output, filepath.Ext(output)) + f.ext
+		if err := writeOutput(name, cfg, f.write); err != nil {
+			return err
+		}
+		log.Println(f.what, "written to", name)
+	}
+	return nil
+}
+
+// The kinds of file to write named in an -emit list, e.g. asm,hack,lst
+func parseEmit(list string) (map[string]bool, error) {
+	kinds := map[string]bool{}
+	for _, kind := range strings.Split(list, ",") {
+		switch kind {
+		case "asm", "hack", "lst", "map", "sym", "dbg":
+			kinds[kind] = true
+		default:
+			return nil, fmt.Errorf("unknown -emit %q, want asm, hack, lst, map, sym or dbg", kind)
+		}
+	}
+	return kinds, nil
+}
+
+// Translate the .vm files as translateFiles does, writing the output, and
+// the files asked for beside it, such as its .lst and .hack, into a new zip
+// archive named output. The .asm is named after the archive.
+func translateToZip(filenames []string, output string, cfg cliConfig) error {
+	dir, err := os.MkdirTemp("", "vm-translator-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	name := strings.TrimSuffix(filepath.Base(output), ".zip") + cfg.opts.backend().Extension()
+	inner := cfg
+	inner.force, inner.backup = false, false
+	// Lines left out with -keep-going are reported once the archive is written
+	skipped := translateFiles(filenames, filepath.Join(dir, name), inner)
+	var list ErrorList
+	if skipped != nil && !errors.As(skipped, &list) {
+		return skipped
+	}
+
+	ofile, err := createOutput(output, cfg.force, cfg.backup)
+	if err != nil {
+		return err
+	}
+	defer ofile.abort()
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	zw := zip.NewWriter(ofile)
+	for _, file := range files {
+		data, err := os.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return err
+		}
+		f, err := zw.Create(file.Name())
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := ofile.commit(); err != nil {
+		return err
+	}
+	log.Println("Archived to", output)
+	return skipped
+}
+
+// Copy a hand-written Hack assembly file into the output after the code
+// translated so far, once it is checked to assemble
+func copyAsmFile(filename string, aw *asmWriter, lw *lstWriter) error {
+	if _, ok := aw.backend.(hackBackend); !ok {
+		return fmt.Errorf("%v: .asm files can only be used with the hack target", filename)
+	}
+	text, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	source := strings.TrimRight(strings.ReplaceAll(string(text), "\r\n", "\n"), "\n")
+	if _, err := assemble(source); err != nil {
+		var srcErr *SourceError
+		if errors.As(err, &srcErr) {
+			srcErr.File = filename
+		}
+		return err
+	}
+
+	lines := strings.Split(source, "\n")
+	if lw != nil {
+		lw.writeLines("// "+filename, lines)
+	}
+	aw.writeInstruction(&Instruction{stripped: filepath.Base(filename), translatedLines: lines})
+	return aw.err
+}
+
+// Translate a single .vm or .vmbc file, passing each instruction to emit
+func translateFile(filename string, cfg cliConfig, emit func(*Instruction) error) error {
+	cfg.opts.Unit = unitName(filename)
+	if filepath.Ext(filename) == bytecodeExt {
+		return translateBytecode(filename, cfg, emit)
+	}
+	if cfg.preprocess {
+		return translatePreprocessed(filename, cfg, emit)
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	err = translateStream(file, cfg.opts, emit)
+	eachSourceError(err, func(srcErr *SourceError) { srcErr.File = filename })
+	return err
+}
+
+// Translate a program encoded by `vm-translator encode`. It was parsed, and
+// any directives expanded, before it was encoded.
+func translateBytecode(filename string, cfg cliConfig, emit func(*Instruction) error) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	instrs, err := decodeProgram(file)
+	if err != nil {
+		return fmt.Errorf("%v: %w", filename, err)
+	}
+
+	err = translateStream(strings.NewReader(programSource(instrs)), cfg.opts, emit)
+	eachSourceError(err, func(srcErr *SourceError) { srcErr.File = filename })
+	return err
+}
+
+// Expand the directives in a .vm file then translate the result. Errors are
+// reported at the line they came from, which may be in an included file.
+func translatePreprocessed(filename string, cfg cliConfig, emit func(*Instruction) error) error {
+	source, origins, err := preprocessFile(filename, cfg.defines)
+	if err != nil {
+		return err
+	}
+
+	err = translateStream(strings.NewReader(source), cfg.opts, emit)
+	eachSourceError(err, func(srcErr *SourceError) {
+		origin := origins[srcErr.Line-1]
+		srcErr.File, srcErr.Line = origin.file, origin.line
+	})
+	return err
+}
+
+// Compile and translate a project directory into dir/<dir>.asm. Sources in
+// other languages are first compiled to VM code by the registered frontends.
+func buildMain(args []string) {
+	fs := newFlagSet("build")
+	jackCompiler := fs.String("jack-compiler", "", "`command` compiling a .jack file to a .vm file beside it, e.g. JackCompiler.sh")
+	preprocess := fs.Bool("preprocess", false, "expand % directives such as %include before parsing")
+	defines := defineFlags{}
+	fs.Var(defines, "D", "define `NAME` for %ifdef in the preprocessor, may be repeated")
+	force := fs.Bool("force", false, "replace the output file if it already exists")
+	backup := fs.Bool("backup", false, "keep the output being replaced as a .bak file")
+	logFile := fs.String("log-file", "", "write progress messages to `file` instead of stderr")
+	quiet := fs.Bool("quiet", false, "don't write progress messages, only errors")
+	perFile := fs.Bool("per-file", false, "also write Foo.asm beside each Foo.vm")
+	parseFlags(fs, args)
+	if fs.NArg() != 1 {
+		log.Fatal("usage: vm-translator build [flags] dir")
+	}
+	check(redirectLog(*logFile, *quiet))
+
+	if *jackCompiler != "" {
+		RegisterFrontend(ExecFrontend{Ext: ".jack", Command: *jackCompiler})
+	}
+
+	cfg := cliConfig{preprocess: *preprocess, defines: defines, force: *force, backup: *backup}
+	if err := buildDir(filepath.Clean(fs.Arg(0)), cfg, *perFile); err != nil {
+		fatal(err)
+	}
+}
+
+// Translate the project in dir into dir/<dir>.asm, and if perFile is set
+// each of its .vm files into an .asm file of its own beside it
+func buildDir(dir string, cfg cliConfig, perFile bool) error {
+	vmPaths, err := compileDir(dir)
+	if err != nil {
+		return err
+	}
+	output := filepath.Join(dir, filepath.Base(dir)+".asm")
+	fragments, err := asmFragments(dir, output, vmPaths)
+	if err != nil {
+		return err
+	}
+	if err := translateFiles(append(vmPaths, fragments...), output, cfg); err != nil {
+		return err
+	}
+	if perFile {
+		for _, path := range vmPaths {
+			output := strings.TrimSuffix(path, ".vm") + ".asm"
+			if err := translateFiles([]string{path}, output, cfg); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Compare two assembly files, ignoring comments, whitespace and the names of
+// labels, returning the exit status: 0 if they're the same, 1 if they differ
+// and 2 on error
+func diffMain(args []string) int {
+	fs := newFlagSet("diff")
+	parseFlags(fs, args)
+	args = fs.Args()
+	if len(args) != 2 {
+		fs.Usage()
+		return 2
+	}
+	var sources [2]string
+	for i, name := range args {
+		text, err := os.ReadFile(name)
+		if err != nil {
+			log.Print(err)
+			return 2
+		}
+		sources[i] = string(text)
+	}
+	same, err := writeAsmDiff(os.Stdout, args[0], sources[0], args[1], sources[1])
+	switch {
+	case err != nil:
+		log.Print(err)
+		return 2
+	case same:
+		return 0
+	}
+	return 1
+}
+
+// Translate the given .vm files, run them on the emulator and write how often
+// each VM command ran, for finding where a program spends its time
+func profileMain(args []string) {
+	fs := newFlagSet("profile")
+	output := fs.String("o", "prof.json", "write the profile to `file`")
+	maxCycles := fs.Int("cycles", 10000000, "give up on programs still running after `n` instructions")
+	var lang Options
+	addLanguageFlags(fs, &lang)
+	parseFlags(fs, args)
+	if fs.NArg() < 1 {
+		log.Fatal("usage: vm-translator profile [flags] file.vm|file.asm...")
+	}
+
+	p, err := loadProgram(fs.Args(), lang)
+	if err != nil {
+		fatal(err)
+	}
+	entries, err := p.run(*maxCycles)
+	if err != nil {
+		fatal(err)
+	}
+	f, err := os.Create(*output)
+	check(err)
+	defer f.Close()
+	check(writeProfile(f, entries))
+	log.Println("Profile written to", *output)
+}
+
+// Run the HTTP translation API until the process is stopped
+func serveMain(args []string) {
+	fs := newFlagSet("serve")
+	addr := fs.String("addr", ":8080", "`address` to listen on")
+	grpcAddr := fs.String("grpc-addr", "", "also serve the gRPC Translator service on this `address`")
+	var lang Options
+	addLanguageFlags(fs, &lang)
+	parseFlags(fs, args)
+
+	if *grpcAddr != "" {
+		lis, err := net.Listen("tcp", *grpcAddr)
+		check(err)
+		log.Println("Serving gRPC on", *grpcAddr)
+		go func() {
+			log.Fatal(newGRPCServer(lang).Serve(lis))
+		}()
+	}
+
+	log.Println("Listening on", *addr)
+	log.Fatal(http.ListenAndServe(*addr, newServer(lang)))
+}
+
+// An output file written under a temporary name and renamed into place once
+// complete, so an interrupted run never leaves truncated output behind
+type outputFile struct {
+	*os.File
+	path   string
+	backup bool
+	done   bool
+}
+
+// Write a file produced alongside the output, replacing an existing one only
+// as cfg allows, and only once it has been written in full
+func writeOutput(path string, cfg cliConfig, write func(io.Writer) error) error {
+	f, err := createOutput(path, cfg.force, cfg.backup)
+	if err != nil {
+		return err
+	}
+	defer f.abort()
+	if err := write(f); err != nil {
+		return err
+	}
+	return f.commit()
+}
+
+// Create a temporary file to become path. Fails if path exists, unless force
+// is set.
+func createOutput(path string, force, backup bool) (*outputFile, error) {
+	if _, err := os.Stat(path); err == nil && !force {
+		return nil, fmt.Errorf("%v already exists, use -force to replace it", path)
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(0o644); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &outputFile{File: f, path: path, backup: backup}, nil
+}
+
+// Move the finished file into place, first keeping any file it replaces as
+// <path>.bak if asked to
+func (f *outputFile) commit() error {
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if f.backup {
+		if err := os.Rename(f.path, f.path+".bak"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Rename(f.Name(), f.path); err != nil {
+		return err
+	}
+	f.done = true
+	return nil
+}
+
+// Discard the file unless it was committed
+func (f *outputFile) abort() {
+	if !f.done {
+		f.Close()
+		os.Remove(f.Name())
+	}
+}
@@ -0,0 +1,830 @@
+//go:build !js
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestTranslateFilesReplacesOutput(t *testing.T) {
+	// setup
+	dir := t.TempDir()
+	input := filepath.Join(dir, "Main.vm")
+	output := filepath.Join(dir, "Main.asm")
+	os.WriteFile(input, []byte("push constant 1\n"), 0o644)
+	os.WriteFile(output, []byte("old"), 0o644)
+	// test
+	err := translateFiles([]string{input}, output, cliConfig{})
+	// assert
+	if err == nil {
+		t.Fatalf("Expected existing output produce err without force")
+	}
+	if got, _ := os.ReadFile(output); string(got) != "old" {
+		t.Fatalf("Existing output was changed to %q", got)
+	}
+
+	// test
+	err = translateFiles([]string{input}, output, cliConfig{force: true, backup: true})
+	// assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(output + ".bak"); string(got) != "old" {
+		t.Fatalf("Wanted the old output kept in the backup, got %q", got)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 3 {
+		t.Fatalf("Wanted only the input, output and backup left, got %v", entries)
+	}
+
+	// setup
+	output = filepath.Join(dir, "Other.asm")
+	for _, ext := range []string{".lst", ".hack"} {
+		os.WriteFile(filepath.Join(dir, "Other"+ext), []byte("old"), 0o644)
+	}
+	for _, cfg := range []cliConfig{{lst: true}, {hack: true}} {
+		os.Remove(output)
+		// test
+		err = translateFiles([]string{input}, output, cfg)
+		// assert
+		if err == nil || !strings.Contains(err.Error(), "use -force") {
+			t.Fatalf("Expected an existing file beside the output produce err without force, got %v", err)
+		}
+	}
+	for _, ext := range []string{".lst", ".hack"} {
+		if got, _ := os.ReadFile(filepath.Join(dir, "Other"+ext)); string(got) != "old" {
+			t.Fatalf("Existing %v was changed to %q", ext, got)
+		}
+	}
+
+	// test
+	err = translateFiles([]string{input}, output, cliConfig{force: true, lst: true, hack: true})
+	// assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "Other.hack")); string(got) == "old" {
+		t.Fatalf("Wanted Other.hack replaced with -force")
+	}
+	entries, _ = os.ReadDir(dir)
+	if len(entries) != 6 {
+		t.Fatalf("Wanted no temporary files left, got %v", entries)
+	}
+}
+
+func TestStaticScopedPerFile(t *testing.T) {
+	// setup
+	dir := t.TempDir()
+	a := filepath.Join(dir, "A.vm")
+	b := filepath.Join(dir, "B.vm")
+	os.WriteFile(a, []byte("push constant 1\npop static 0\n"), 0o644)
+	os.WriteFile(b, []byte("push constant 2\npop static 0\npush static 0\n"), 0o644)
+	output := filepath.Join(dir, "out.asm")
+	// test
+	if err := translateFiles([]string{a, b}, output, cliConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	asm, _ := os.ReadFile(output)
+	rom, err := assemble(string(asm))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMachine(rom)
+	m.RAM[0] = 256
+	check(m.Run(1000))
+	// assert
+	if !strings.Contains(string(asm), "@A.0") || !strings.Contains(string(asm), "@B.0") {
+		t.Fatalf("Expected statics named after their files, got:\n%s", asm)
+	}
+	if m.RAM[16] != 1 || m.RAM[17] != 2 || m.RAM[256] != 2 {
+		t.Fatalf("Wanted A.0 = 1, B.0 = 2 and 2 pushed, got %v %v %v", m.RAM[16], m.RAM[17], m.RAM[256])
+	}
+}
+
+func TestTranslateBytecode(t *testing.T) {
+	// setup
+	dir := writeTestFiles(t, map[string]string{
+		"Main.vm": "// Store 7\npush constant 7\n\npop static 1\n//#asm\n@Main.1 // reload\nD=M\n//#endasm\npush static 1\n",
+	})
+	source, encoded := filepath.Join(dir, "Main.vm"), filepath.Join(dir, "Main.vmbc")
+	cfg := cliConfig{opts: Options{KeepComments: true}, dbg: true}
+	// test
+	encodeMain([]string{source})
+	check(translateFiles([]string{source}, filepath.Join(dir, "want.asm"), cfg))
+	check(translateFiles([]string{encoded}, filepath.Join(dir, "got.asm"), cfg))
+	// assert
+	for _, ext := range []string{".asm", ".dbg"} {
+		want, _ := os.ReadFile(filepath.Join(dir, "want"+ext))
+		got, _ := os.ReadFile(filepath.Join(dir, "got"+ext))
+		if ext == ".dbg" {
+			got = bytes.ReplaceAll(got, []byte("Main.vmbc"), []byte("Main.vm"))
+		}
+		if len(want) == 0 || !bytes.Equal(got, want) {
+			t.Fatalf("Wanted Main.vmbc translated as Main.vm is, into\n%s\ngot\n%s", want, got)
+		}
+	}
+}
+
+func TestTranslatePreprocessedErrorOrigin(t *testing.T) {
+	// setup
+	dir := writeTestFiles(t, map[string]string{
+		"Main.vm": "push constant 1\n%include \"Lib.vm\"\n",
+		"Lib.vm":  "push constant 2\n\nbogus\n",
+	})
+	cfg := cliConfig{preprocess: true}
+	// test
+	err := translateFile(filepath.Join(dir, "Main.vm"), cfg, func(*Instruction) error { return nil })
+	// assert
+	var srcErr *SourceError
+	if !errors.As(err, &srcErr) || !strings.HasSuffix(srcErr.File, "Lib.vm") || srcErr.Line != 3 {
+		t.Fatalf("Wanted error at Lib.vm:3, got %v", err)
+	}
+}
+
+func TestDebugInfo(t *testing.T) {
+	// setup
+	dir := t.TempDir()
+	input := filepath.Join(dir, "Main.vm")
+	output := filepath.Join(dir, "Main.asm")
+	os.WriteFile(input, []byte("push constant 7\n\npop static 1\npush static 1\npush constant 6\nmul\n"), 0o644)
+	cfg := cliConfig{opts: Options{Trace: true, Extended: true}, dbg: true}
+	// test
+	check(translateFiles([]string{input}, output, cfg))
+	f, err := os.Open(filepath.Join(dir, "Main.dbg"))
+	check(err)
+	info, err := readDebugInfo(f)
+	f.Close()
+	// assert
+	if err != nil || len(info.Source) != 5 {
+		t.Fatalf("Wanted debug information for 5 commands, got %+v, %v", info, err)
+	}
+	preamble := 0
+	for _, line := range tracePreamble() {
+		preamble += asmCost(line)
+	}
+	first := info.Source[0]
+	if first.ROM != preamble || first.Line != 1 || first.File != input || first.Command != "push constant 7" {
+		t.Fatalf("Wanted push constant 7 from line 1 after the trace preamble, got %+v", first)
+	}
+	if info.Source[1].Line != 3 || info.Source[1].ROM != first.ROM+first.Words {
+		t.Fatalf("Wanted pop static 1 from line 3 straight after, got %+v", info.Source[1])
+	}
+	if _, ok := info.Labels["Main$mul.6.LOOP"]; !ok || info.Variables["Main.1"] != 16 {
+		t.Fatalf("Wanted the labels of mul and Main.1 at 16, got %v and %v", info.Labels, info.Variables)
+	}
+
+	// test
+	p, err := loadProgram([]string{output}, Options{})
+	check(err)
+	ran, err := p.run(10000)
+	// assert
+	if err != nil || len(ran) != 6 || ran[0].File != output || ran[1].File != input || ran[5].Line != 6 {
+		t.Fatalf("Wanted the preamble and the 5 commands run from their VM lines, got %+v, %v", ran, err)
+	}
+
+	// setup
+	os.WriteFile(output, []byte("@1\n"), 0o644)
+	// test
+	_, err = loadProgram([]string{output}, Options{})
+	// assert
+	if err == nil {
+		t.Fatalf("Expected assembly changed since its debug information produce err")
+	}
+}
+
+func TestEmit(t *testing.T) {
+	// setup
+	dir := t.TempDir()
+	input := filepath.Join(dir, "Main.vm")
+	output := filepath.Join(dir, "Main.asm")
+	os.WriteFile(input, []byte("push constant 7\npop static 1\npush constant 6\nmul\n"), 0o644)
+	emitted, err := parseEmit("hack,lst,map")
+	check(err)
+	cfg := cliConfig{opts: Options{Extended: true}, lst: emitted["lst"], memoryMap: emitted["map"], hack: emitted["hack"], noAsm: !emitted["asm"]}
+	// test
+	check(translateFiles([]string{input}, output, cfg))
+	// assert
+	if _, err := os.Stat(output); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected no assembly written without asm, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "Main.lst")); err != nil {
+		t.Fatal(err)
+	}
+	asm, err := translateString("push constant 7\npop static 1\npush constant 6\nmul\n", Options{Unit: "Main", Extended: true})
+	check(err)
+	rom, err := assemble(asm)
+	check(err)
+	var want strings.Builder
+	check(writeHack(&want, rom))
+	hack, err := os.ReadFile(filepath.Join(dir, "Main.hack"))
+	if err != nil || string(hack) != want.String() {
+		t.Fatalf("Wanted the machine code of the translation, got %v", err)
+	}
+	memoryMap, err := os.ReadFile(filepath.Join(dir, "Main.map"))
+	check(err)
+	if !strings.Contains(string(memoryMap), "    16  Main.1\n") || !strings.Contains(string(memoryMap), "  Main$mul.4.LOOP\n") {
+		t.Fatalf("Expected the labels and variables mapped, got:\n%s", memoryMap)
+	}
+	if _, err := parseEmit("asm,elf"); err == nil {
+		t.Fatalf("Expected %q produce err", "asm,elf")
+	}
+}
+
+func TestRunDirect(t *testing.T) {
+	// setup
+	source := "push constant 255\npop static 0\npush constant 16384\npop pointer 1\npush static 0\npop that 31\n"
+	dir := t.TempDir()
+	input := filepath.Join(dir, "Main.vm")
+	os.WriteFile(input, []byte(source), 0o644)
+	p, err := loadProgram([]string{input}, Options{})
+	check(err)
+	emulated, err := p.machine()
+	check(err)
+	check(emulated.Run(1000))
+	// test
+	m, err := runDirect([]sourceFile{{input, source}}, Options{})
+	// assert
+	// The scratch registers and words above SP are free to differ
+	if err != nil || !slices.Equal(m.RAM[:13], emulated.RAM[:13]) || !slices.Equal(m.RAM[16384:], emulated.RAM[16384:]) || m.RAM[16] != emulated.RAM[16] {
+		t.Fatalf("Wanted the memory running the assembly leaves, got %v", err)
+	}
+	if len(m.ROM) != 0 || m.RAM[16384+31] != 255 {
+		t.Fatalf("Wanted 255 drawn without any code, got %v in %d words of ROM", m.RAM[16384+31], len(m.ROM))
+	}
+
+	// test
+	_, err = runDirect([]sourceFile{{input, "push constant 32000\npop pointer 1\npop that 0\n"}}, Options{})
+	// assert
+	var srcErr *SourceError
+	if !errors.As(err, &srcErr) || srcErr.File != input || srcErr.Line != 3 {
+		t.Fatalf("Expected the access outside memory located at line 3, got %v", err)
+	}
+}
+
+func TestLanguageFlags(t *testing.T) {
+	for _, name := range []string{"translate", "check", "run", "exec", "ir", "lint", "profile", "serve", "lsp"} {
+		// test
+		found := map[string]bool{}
+		for _, f := range commandFlags(name) {
+			found[f.Name] = true
+		}
+		// assert
+		if !found["dialect"] || !found["negative-constants"] {
+			t.Fatalf("Wanted -dialect and -negative-constants for %v", name)
+		}
+	}
+
+	// setup
+	dir := t.TempDir()
+	input := filepath.Join(dir, "Main.vm")
+	source := "push constant 6\npush constant 7\nmul\npop static 0\n"
+	os.WriteFile(input, []byte(source), 0o644)
+	// test
+	status := checkMain([]string{"-dialect=extended", input})
+	m, err := runDirect([]sourceFile{{input, source}}, Options{Extended: true})
+	// assert
+	if status != 0 || err != nil || m.RAM[16] != 42 {
+		t.Fatalf("Wanted mul checked and interpreted in the extended dialect, got status %d and %v", status, err)
+	}
+	if _, err := runDirect([]sourceFile{{input, source}}, Options{}); err == nil {
+		t.Fatalf("Expected mul in the standard dialect produce err")
+	}
+
+	// test
+	m, err = runDirect([]sourceFile{{input, "push constant -5\npop static 0\n"}}, Options{NegativeConstants: true})
+	// assert
+	if err != nil || m.RAM[16] != -5 {
+		t.Fatalf("Wanted -5 interpreted with negative constants, got %v", err)
+	}
+}
+
+func TestTranslationCache(t *testing.T) {
+	// setup
+	dir := t.TempDir()
+	input := filepath.Join(dir, "Main.vm")
+	output := filepath.Join(dir, "Main.asm")
+	os.WriteFile(input, []byte("push constant 7\npush static 1\nadd\n"), 0o644)
+	cache, err := openTranslationCache(filepath.Join(dir, "cache"))
+	check(err)
+	cfg := cliConfig{cache: cache, force: true}
+	check(translateFiles([]string{input}, output, cfg))
+	want, _ := os.ReadFile(output)
+	source, _ := os.ReadFile(input)
+	key := cache.key(string(source), "Main", cfg)
+	instrs, ok := cache.load(key)
+	if !ok || len(instrs) != 3 || instrs[1].Lines[0] != "@Main.1" {
+		t.Fatalf("Wanted the 3 commands cached, got %+v", instrs)
+	}
+
+	// test
+	check(translateFiles([]string{input}, output, cfg))
+	// assert
+	if got, _ := os.ReadFile(output); string(got) != string(want) {
+		t.Fatalf("Wanted the cached translation the same as the first, got:\n%s", got)
+	}
+
+	// setup
+	instrs[0].Lines = []string{"// from the cache"}
+	check(cache.store(key, instrs))
+	// test
+	check(translateFiles([]string{input}, output, cfg))
+	// assert
+	if got, _ := os.ReadFile(output); !strings.Contains(string(got), "// from the cache") {
+		t.Fatalf("Expected the translation read from the cache, got:\n%s", got)
+	}
+	cfg.opts.Trace = true
+	if cache.key(string(source), "Main", cfg) == key || cache.key(string(source), "Other", cliConfig{}) == key {
+		t.Fatalf("Expected the options and unit to change the key")
+	}
+}
+
+// Write n .vm files of size commands each to a new directory
+func writeProgramFiles(t testing.TB, n, size int) []string {
+	dir := t.TempDir()
+	var files []string
+	for i := 0; i < n; i++ {
+		file := filepath.Join(dir, fmt.Sprintf("Unit%d.vm", i))
+		check(os.WriteFile(file, []byte(syntheticProgram(size)+"push static 1\n"), 0o644))
+		files = append(files, file)
+	}
+	return files
+}
+
+func TestTranslateConcurrently(t *testing.T) {
+	// setup
+	files := writeProgramFiles(t, 4, 300)
+	good, bad := files[:3], files[3]
+	os.WriteFile(bad, []byte("push constant 1\npop nowhere 1\n"), 0o644)
+	output := filepath.Join(t.TempDir(), "Out.asm")
+	check(translateFiles(good, output, cliConfig{force: true, jobs: 1}))
+	want, _ := os.ReadFile(output)
+
+	// test
+	err := translateFiles(good, output, cliConfig{force: true, jobs: 4})
+	// assert
+	check(err)
+	if got, _ := os.ReadFile(output); string(got) != string(want) {
+		t.Fatalf("Expected the same output translating files at once")
+	}
+
+	// test
+	err = translateFiles(files, output, cliConfig{force: true, jobs: 4})
+	// assert
+	var srcErr *SourceError
+	if !errors.As(err, &srcErr) || srcErr.File != bad || srcErr.Line != 2 {
+		t.Fatalf("Expected the bad file's err, got %v", err)
+	}
+}
+
+func TestTranslateLLVMFiles(t *testing.T) {
+	// setup
+	dir := t.TempDir()
+	var files []string
+	for i := range 6 {
+		name := filepath.Join(dir, fmt.Sprintf("F%d.vm", i))
+		os.WriteFile(name, []byte(strings.Repeat("push constant 7\npush temp 0\nsub\npop temp 0\n", 50)), 0o644)
+		files = append(files, name)
+	}
+	cache, err := openTranslationCache(filepath.Join(dir, "cache"))
+	check(err)
+	output := filepath.Join(dir, "Out.ll")
+	// A new backend each time, as each run of the translator has
+	translate := func(filenames []string) {
+		backend, err := lookupBackend("llvm")
+		check(err)
+		check(translateFiles(filenames, output, cliConfig{opts: Options{Backend: backend}, cache: cache, force: true, jobs: 4}))
+	}
+	translate(files[:1])
+	// test
+	slices.Reverse(files)
+	translate(files)
+	// assert
+	ir, _ := os.ReadFile(output)
+	defined := map[string]bool{}
+	for _, line := range strings.Split(string(ir), "\n") {
+		if name, _, ok := strings.Cut(strings.TrimSpace(line), " = "); ok && strings.HasPrefix(name, "%") {
+			if defined[name] {
+				t.Fatalf("Expected each value defined once, got %v twice", name)
+			}
+			defined[name] = true
+		}
+	}
+}
+
+func TestTranslateFilesTooLarge(t *testing.T) {
+	// setup
+	files := writeProgramFiles(t, 1, hackROMSize/5)
+	output := filepath.Join(t.TempDir(), "Out.asm")
+	// test
+	err := translateFiles(files, output, cliConfig{})
+	// assert
+	if err == nil || !strings.Contains(err.Error(), "more than the 32768 the Hack ROM holds") {
+		t.Fatalf("Expected a program too large for the ROM produce err, got %v", err)
+	}
+	if _, err := os.Stat(output); err == nil {
+		t.Fatalf("Expected no output for a program too large")
+	}
+}
+
+func BenchmarkTranslateFiles(b *testing.B) {
+	files := writeProgramFiles(b, 8, 400)
+	output := filepath.Join(b.TempDir(), "Out.asm")
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	for _, jobs := range []int{1, 4} {
+		b.Run(fmt.Sprintf("jobs=%d", jobs), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				check(translateFiles(files, output, cliConfig{force: true, jobs: jobs}))
+			}
+		})
+	}
+}
+
+func TestStartProfiling(t *testing.T) {
+	// setup
+	dir := t.TempDir()
+	cpu, mem := filepath.Join(dir, "cpu.prof"), filepath.Join(dir, "mem.prof")
+	// test
+	stop, err := startProfiling(cpu, mem)
+	check(err)
+	translateString(syntheticProgram(1000), Options{})
+	err = stop()
+	// assert
+	check(err)
+	for _, file := range []string{cpu, mem} {
+		if info, err := os.Stat(file); err != nil || info.Size() == 0 {
+			t.Fatalf("Expected a profile written to %v, got %v", file, err)
+		}
+	}
+	if stop, err := startProfiling("", ""); err != nil || stop() != nil {
+		t.Fatalf("Expected no profiles to do nothing, got %v", err)
+	}
+}
+
+func TestTranslateFilesDryRun(t *testing.T) {
+	// setup
+	dir := t.TempDir()
+	input := filepath.Join(dir, "Main.vm")
+	output := filepath.Join(dir, "Main.asm")
+	os.WriteFile(input, []byte("push constant 1\n"), 0o644)
+	os.WriteFile(output, []byte("old"), 0o644)
+	stdout, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	check(err)
+	defer func(f *os.File) { os.Stdout = f }(os.Stdout)
+	os.Stdout = stdout
+
+	// test
+	err = translateFiles([]string{input}, output, cliConfig{dryRun: true})
+
+	// assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(output); string(got) != "old" {
+		t.Fatalf("Existing output was changed to %q", got)
+	}
+	if got, _ := os.ReadFile(stdout.Name()); !strings.Contains(string(got), "// push constant 1\n") {
+		t.Fatalf("Wanted the assembly printed, got %q", got)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Fatalf("Wanted only the input and old output left, got %v", entries)
+	}
+}
+
+func TestTranslateFilesFailureKeepsOutput(t *testing.T) {
+	// setup
+	dir := t.TempDir()
+	input := filepath.Join(dir, "Main.vm")
+	output := filepath.Join(dir, "Main.asm")
+	os.WriteFile(input, []byte("push constant 1\npop constant 1\n"), 0o644)
+	os.WriteFile(output, []byte("old"), 0o644)
+	// test
+	err := translateFiles([]string{input}, output, cliConfig{force: true})
+	// assert
+	if err == nil {
+		t.Fatalf("Expected pop constant produce err")
+	}
+	entries, _ := os.ReadDir(dir)
+	if got, _ := os.ReadFile(output); string(got) != "old" || len(entries) != 2 {
+		t.Fatalf("Wanted the old output left alone and no temporary files, got %q and %v", got, entries)
+	}
+}
+
+func TestBuildDirPerFile(t *testing.T) {
+	// setup
+	dir := filepath.Join(t.TempDir(), "Prog")
+	os.Mkdir(dir, 0o755)
+	os.WriteFile(filepath.Join(dir, "Main.vm"), []byte("push constant 1\npop static 0\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "Sys.vm"), []byte("push constant 2\n"), 0o644)
+	// test
+	err := buildDir(dir, cliConfig{}, true)
+	// assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"Prog.asm", "Main.asm", "Sys.asm"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatalf("Expected %v to be written: %v", name, err)
+		}
+	}
+	main, _ := os.ReadFile(filepath.Join(dir, "Main.asm"))
+	if !strings.Contains(string(main), "@Main.0") || strings.Contains(string(main), "@2") {
+		t.Fatalf("Expected Main.asm to hold only Main.vm, got:\n%s", main)
+	}
+}
+
+func TestBuildDirAsmFragments(t *testing.T) {
+	// setup
+	dir := filepath.Join(t.TempDir(), "Prog")
+	os.Mkdir(dir, 0o755)
+	os.WriteFile(filepath.Join(dir, "Main.vm"), []byte("push constant 1\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "Main.asm"), []byte("// generated before\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "Fast.asm"), []byte("@5\r\nD=A\r\n@R14\r\nM=D\r\n"), 0o644)
+	// test
+	err := buildDir(dir, cliConfig{force: true}, false)
+	// assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	asm, _ := os.ReadFile(filepath.Join(dir, "Prog.asm"))
+	if strings.Contains(string(asm), "generated before") {
+		t.Fatalf("Expected Main.asm translated from Main.vm to be left out, got:\n%s", asm)
+	}
+	rom, err := assemble(string(asm))
+	check(err)
+	m := NewMachine(rom)
+	m.RAM[0] = 256
+	check(m.Run(1000))
+	if m.RAM[256] != 1 || m.RAM[14] != 5 {
+		t.Fatalf("Expected the VM code then Fast.asm to run, got RAM[256] = %v, R14 = %v", m.RAM[256], m.RAM[14])
+	}
+
+	// test
+	os.WriteFile(filepath.Join(dir, "Fast.asm"), []byte("@5\nD=Q\n"), 0o644)
+	err = buildDir(dir, cliConfig{force: true}, false)
+	// assert
+	if err == nil || !strings.HasPrefix(err.Error(), filepath.Join(dir, "Fast.asm")+":2:") {
+		t.Fatalf("Expected invalid Fast.asm produce err on line 2, got %v", err)
+	}
+}
+
+func TestPrepareInputs(t *testing.T) {
+	// setup
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	for _, name := range []string{"Project/B.vm", "Project/A.vm", "Project/README"} {
+		f, _ := zw.Create(name)
+		f.Write([]byte("push constant 1\n"))
+	}
+	zw.Close()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/SimpleAdd.vm":
+			w.Write([]byte("push constant 7\npush constant 8\nadd\n"))
+		case "/Project.zip":
+			w.Write(archive.Bytes())
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	defer func(client *http.Client) { remoteClient = client }(remoteClient)
+	remoteClient = srv.Client()
+	dir := t.TempDir()
+	// test
+	paths, err := prepareInputs([]string{srv.URL + "/SimpleAdd.vm", "Local.vm", srv.URL + "/Project.zip"}, dir)
+	// assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, p := range paths {
+		names = append(names, filepath.Base(p))
+	}
+	if strings.Join(names, " ") != "SimpleAdd.vm Local.vm A.vm B.vm" {
+		t.Fatalf("Wanted the download, the local file and the archive's .vm files in order, got %v", names)
+	}
+	if got, _ := os.ReadFile(paths[0]); !strings.HasPrefix(string(got), "push constant 7") {
+		t.Fatalf("Wanted the downloaded source, got %q", got)
+	}
+	if got := remoteUnitName(srv.URL + "/Project.zip"); got != "Project" {
+		t.Fatalf("Wanted output named after the archive, got %v", got)
+	}
+
+	if _, err := prepareInputs([]string{srv.URL + "/Missing.vm"}, dir); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("Expected missing file produce err, got %v", err)
+	}
+	plain := "http://" + strings.TrimPrefix(srv.URL, "https://") + "/SimpleAdd.vm"
+	if _, err := prepareInputs([]string{plain}, dir); err == nil || !strings.Contains(err.Error(), "use an https:// URL") {
+		t.Fatalf("Expected a plain http URL produce err, got %v", err)
+	}
+}
+
+func TestTranslateZipProject(t *testing.T) {
+	// setup
+	dir := t.TempDir()
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	f, _ := zw.Create("Student/Main.vm")
+	f.Write([]byte("push constant 7\npush constant 8\nadd\n"))
+	zw.Close()
+	input := filepath.Join(dir, "Student.zip")
+	os.WriteFile(input, archive.Bytes(), 0o644)
+	output := filepath.Join(dir, "Graded.zip")
+	// test
+	paths, err := prepareInputs([]string{input}, t.TempDir())
+	if err == nil {
+		err = translateToZip(paths, output, cliConfig{lst: true})
+	}
+	// assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.OpenReader(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	if strings.Join(names, " ") != "Graded.asm Graded.lst" {
+		t.Fatalf("Wanted the assembly and listing archived, got %v", names)
+	}
+	rc, _ := zr.File[0].Open()
+	asm, _ := io.ReadAll(rc)
+	rc.Close()
+	if !strings.Contains(string(asm), "// add") {
+		t.Fatalf("Wanted the archive's Main.vm translated, got:\n%s", asm)
+	}
+
+	os.WriteFile(input, []byte("push constant 1\n"), 0o644)
+	if _, err := prepareInputs([]string{input}, t.TempDir()); err == nil {
+		t.Fatalf("Expected .zip that isn't an archive produce err")
+	}
+
+	// setup
+	archive.Reset()
+	zw = zip.NewWriter(&archive)
+	for _, name := range []string{"a/Main.vm", "b/Main.vm"} {
+		f, _ := zw.Create(name)
+		f.Write([]byte("// " + name + "\n"))
+	}
+	zw.Close()
+	os.WriteFile(input, archive.Bytes(), 0o644)
+	// test
+	_, err = prepareInputs([]string{input}, t.TempDir())
+	// assert
+	if err == nil || !strings.Contains(err.Error(), "a/Main.vm and b/Main.vm would both be unit Main") {
+		t.Fatalf("Expected two Main.vm files produce err, got %v", err)
+	}
+
+	// setup
+	archive.Reset()
+	zw = zip.NewWriter(&archive)
+	f, _ = zw.Create("../Main.vm")
+	f.Write([]byte("push constant 1\n"))
+	zw.Close()
+	os.WriteFile(input, archive.Bytes(), 0o644)
+	// test
+	_, err = prepareInputs([]string{input}, t.TempDir())
+	// assert
+	if err == nil {
+		t.Fatalf("Expected a path outside the archive produce err")
+	}
+}
+
+func TestVersionText(t *testing.T) {
+	// setup
+	info := &debug.BuildInfo{
+		GoVersion: "go1.22.0",
+		Main:      debug.Module{Version: "v1.4.0"},
+		Settings: []debug.BuildSetting{
+			{Key: "vcs.revision", Value: "abc123"},
+			{Key: "vcs.time", Value: "2024-03-01T10:00:00Z"},
+			{Key: "vcs.modified", Value: "true"},
+		},
+	}
+
+	// test
+	got := versionText(info)
+
+	// assert
+	for _, want := range []string{"vm-translator v1.4.0\n", "commit abc123 (modified)\n", "built 2024-03-01T10:00:00Z\n", "go1.22.0 "} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("Wanted %q in %q", want, got)
+		}
+	}
+	if got := versionText(nil); got != "vm-translator (devel)\n" {
+		t.Fatalf("Wanted only the devel version without build info, got %q", got)
+	}
+}
+
+func TestWriteCompletion(t *testing.T) {
+	for _, shell := range []string{"bash", "zsh", "fish"} {
+		// test
+		var b strings.Builder
+		err := writeCompletion(&b, shell)
+
+		// assert
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []string{"max-cycles", "keep-comments", "completion", "bash zsh fish"} {
+			if !strings.Contains(b.String(), want) {
+				t.Fatalf("Wanted %q in the %v completion", want, shell)
+			}
+		}
+		if _, err := exec.LookPath(shell); err == nil {
+			cmd := exec.Command(shell, "-n")
+			cmd.Stdin = strings.NewReader(b.String())
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("Wanted a valid %v script, got %v: %s", shell, err, out)
+			}
+		}
+	}
+	if err := writeCompletion(io.Discard, "tcsh"); err == nil {
+		t.Fatalf("Expected %q produce err", "tcsh")
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	// setup
+	env := map[string]string{
+		"VMTRANSLATOR_OUTPUT":           "All.asm",
+		"VMTRANSLATOR_TRANSLATE_OUTPUT": "Mine.asm",
+		"VMTRANSLATOR_COMMENTS":         "1",
+		"VMTRANSLATOR_OPT":              "2",
+		"VMTRANSLATOR_SCRATCH":          "R14",
+		"VMTRANSLATOR_RUN_MAX_CYCLES":   "5",
+		"VMTRANSLATOR_TRANSLATE_MINIFY": "true",
+		"VMTRANSLATOR_COMMENT_STYLE":    "teach",
+	}
+	lookup := func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+	fs := flag.NewFlagSet("translate", flag.ContinueOnError)
+	output := fs.String("o", "", "")
+	comments := fs.Bool("keep-comments", false, "")
+	style := fs.String("comments", "", "")
+	minify := fs.Bool("minify", false, "")
+	scratch := fs.String("scratch", "R13", "")
+	level := 0
+	for n := 0; n <= 2; n++ {
+		fs.Var(optLevelFlag{&level, n}, "O"+strconv.Itoa(n), "")
+	}
+
+	// test
+	err := applyEnv(fs, lookup)
+	check(err)
+	check(fs.Parse([]string{"-scratch", "R15"}))
+
+	// assert
+	if *output != "Mine.asm" || !*comments || !*minify || level != 2 {
+		t.Fatalf("Wanted the environment to set the flags, got -o %v -keep-comments %v -minify %v -O%d", *output, *comments, *minify, level)
+	}
+	if *style != "teach" {
+		t.Fatalf("Wanted -comments from its alias alone, got %q", *style)
+	}
+	if *scratch != "R15" {
+		t.Fatalf("Wanted the flag given to override the environment, got %v", *scratch)
+	}
+	env["VMTRANSLATOR_OPT"] = "3"
+	if err := applyEnv(fs, lookup); err == nil {
+		t.Fatalf("Expected %q produce err", "VMTRANSLATOR_OPT=3")
+	}
+
+	// setup
+	fs = flag.NewFlagSet("asm", flag.ContinueOnError)
+	output = fs.String("o", "", "")
+	// test
+	check(applyEnv(fs, lookup))
+	// assert
+	if *output != "" {
+		t.Fatalf("Wanted VMTRANSLATOR_OUTPUT to leave asm's -o alone, got %v", *output)
+	}
+	env["VMTRANSLATOR_ASM_O"] = "Mine.hack"
+	check(applyEnv(fs, lookup))
+	if *output != "Mine.hack" {
+		t.Fatalf("Wanted VMTRANSLATOR_ASM_O to set asm's -o, got %v", *output)
+	}
+}
@@ -0,0 +1,53 @@
+// Package codegen holds the memory segments the translator accepts, so
+// programs built on it can add segments of their own, such as one for
+// memory-mapped I/O, without changing the translator. Register them before
+// translating anything, typically from an init function.
+package codegen
+
+import (
+	"iter"
+	"maps"
+)
+
+// A SegmentHandler generates the assembly for `push` and `pop` on one memory
+// segment. Each method appends its lines to asm and returns the result, so
+// handlers don't need to allocate.
+type SegmentHandler interface {
+	// Push segment[index] onto the stack
+	Push(asm []string, index int) ([]string, error)
+
+	// Pop the top of the stack into segment[index]
+	Pop(asm []string, index int) ([]string, error)
+}
+
+// A FileSegment is a segment each .vm file has its own copy of, like
+// `static`. ForFile gives the handler for the file named unit, e.g. Main for
+// Main.vm.
+type FileSegment interface {
+	ForFile(unit string) SegmentHandler
+}
+
+// Segment handlers by name
+var segments = map[string]SegmentHandler{}
+
+// Register the handler for a segment, so `push name i` and `pop name i` are
+// accepted and translated by it. This replaces any handler of the same name,
+// and a nil handler removes the segment.
+func RegisterSegment(name string, handler SegmentHandler) {
+	if handler == nil {
+		delete(segments, name)
+		return
+	}
+	segments[name] = handler
+}
+
+// The handler registered for a segment, if any
+func LookupSegment(name string) (SegmentHandler, bool) {
+	handler, ok := segments[name]
+	return handler, ok
+}
+
+// Every registered segment and its handler, in no particular order
+func Segments() iter.Seq2[string, SegmentHandler] {
+	return maps.All(segments)
+}
@@ -0,0 +1,42 @@
+package codegen_test
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/schallis/vm-translator/codegen"
+)
+
+// A memory-mapped segment at a fixed address, e.g. the keyboard
+type fixedSegment struct{ addr int }
+
+func (s fixedSegment) Push(asm []string, index int) ([]string, error) {
+	return append(asm, fmt.Sprintf("@%d", s.addr+index), "D=M", "@SP", "AM=M+1", "A=A-1", "M=D"), nil
+}
+
+func (s fixedSegment) Pop(asm []string, index int) ([]string, error) {
+	return append(asm, "@SP", "AM=M-1", "D=M", fmt.Sprintf("@%d", s.addr+index), "M=D"), nil
+}
+
+func TestRegisterSegment(t *testing.T) {
+	// setup
+	codegen.RegisterSegment("keyboard", fixedSegment{24576})
+	// test
+	handler, ok := codegen.LookupSegment("keyboard")
+	// assert
+	if !ok {
+		t.Fatalf("Registered segment not found")
+	}
+	asm, err := handler.Push(nil, 0)
+	if err != nil || !slices.Equal(asm[:2], []string{"@24576", "D=M"}) {
+		t.Fatalf("Wanted the registered handler's push, got %q, %v", asm, err)
+	}
+
+	// test
+	codegen.RegisterSegment("keyboard", nil)
+	// assert
+	if _, ok := codegen.LookupSegment("keyboard"); ok {
+		t.Fatalf("Wanted the segment removed by registering nil")
+	}
+}
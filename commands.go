@@ -0,0 +1,601 @@
+//go:build !js
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+)
+
+// A subcommand of vm-translator, described for its help text
+type command struct {
+	name    string
+	args    string // What follows the flags, for the usage line
+	summary string
+}
+
+// Every subcommand, in the order help lists them
+var commands = []command{
+	{"translate", "file.vm|dir.zip|url...", "translate VM code to assembly, the default when no command is given"},
+	{"check", "file.vm|file.asm...", "report errors in VM code and assembly without writing anything"},
+	{"run", "file.vm|file.asm...", "translate and run a program on the Hack emulator"},
+	{"exec", "file.vm...", "interpret VM code directly and print the stack and statics it leaves"},
+	{"ir", "file.vm...", "print the functions and basic blocks VM code is divided into"},
+	{"fmt", "[file.vm...]", "lay out VM code in the standard format (stdin→stdout, or files with -w/-l)"},
+	{"lint", "file.vm...", "warn about VM code that translates but is probably a mistake"},
+	{"asm", "file.asm", "assemble Hack assembly into a .hack file of binary machine code"},
+	{"encode", "file.vm", "parse VM code into a compact .vmbc file, which translate and run accept in place of it"},
+	{"build", "dir", "compile and translate a project directory"},
+	{"diff", "a.asm b.asm", "compare assembly files, ignoring comments, layout and label names"},
+	{"profile", "file.vm|file.asm...", "run a program and write how often each VM command ran"},
+	{"serve", "", "serve the HTTP translation API"},
+	{"lsp", "", "speak the language server protocol on stdin and stdout"},
+	{"version", "", "print the version, commit and build date of vm-translator, also shown by --version"},
+	{"completion", "bash|zsh|fish", "write a script completing commands, flags and file names for the shell"},
+	{"help", "[command]", "describe a command and its flags, or list the commands"},
+}
+
+// The command named, if there is one
+func lookupCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+// Run the command named with the arguments following it
+func runCommand(name string, args []string) {
+	switch name {
+	case "translate":
+		translateMain(args)
+	case "check":
+		os.Exit(checkMain(args))
+	case "run":
+		runMain(args)
+	case "exec":
+		execMain(args)
+	case "ir":
+		irMain(args)
+	case "fmt":
+		os.Exit(fmtMain(args))
+	case "lint":
+		os.Exit(lintMain(args))
+	case "asm":
+		asmMain(args)
+	case "encode":
+		encodeMain(args)
+	case "build":
+		buildMain(args)
+	case "diff":
+		os.Exit(diffMain(args))
+	case "profile":
+		profileMain(args)
+	case "serve":
+		serveMain(args)
+	case "lsp":
+		fs := newFlagSet("lsp")
+		var lang Options
+		addLanguageFlags(fs, &lang)
+		parseFlags(fs, args)
+		check(serveLSP(os.Stdin, os.Stdout, lang))
+	case "version":
+		versionMain(args)
+	case "completion":
+		completionMain(args)
+	case "help":
+		helpMain(args)
+	}
+}
+
+// Set while completion collects the flags of a command, which are passed to
+// it in place of printing the usage
+var collectFlags func(fs *flag.FlagSet)
+
+// Flags for the command named, whose -h prints its usage line and summary
+// before the flags
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	cmd := lookupCommand(name)
+	fs.Usage = func() {
+		if collectFlags != nil {
+			collectFlags(fs)
+		}
+		usage := strings.TrimSpace("vm-translator " + cmd.name + " [flags] " + cmd.args)
+		fmt.Fprintf(fs.Output(), "usage: %v\n\n%v\n\n", usage, cmd.summary)
+		fs.PrintDefaults()
+		fmt.Fprintf(fs.Output(), "\nFlags can also be set with %v<FLAG> or, for this command alone, %v%v_<FLAG>.\n", envPrefix, envPrefix, strings.ToUpper(cmd.name))
+	}
+	return fs
+}
+
+// The -dialect flag, setting whether the extended dialect is accepted
+type dialectFlag struct {
+	extended *bool
+}
+
+func (f dialectFlag) String() string {
+	if f.extended != nil && *f.extended {
+		return "extended"
+	}
+	return "standard"
+}
+
+func (f dialectFlag) Set(dialect string) error {
+	if dialect != "standard" && dialect != "extended" {
+		return fmt.Errorf("unknown dialect %v, want standard or extended", dialect)
+	}
+	*f.extended = dialect == "extended"
+	return nil
+}
+
+// Add the flags choosing the VM language a command accepts, setting them in
+// opts, so every command reading VM code takes the same extensions
+func addLanguageFlags(fs *flag.FlagSet, opts *Options) {
+	fs.Var(dialectFlag{&opts.Extended}, "dialect", "`dialect` of VM code to accept: standard, or extended, which adds mul, div, mod, shiftleft and shiftright")
+	fs.BoolVar(&opts.NegativeConstants, "negative-constants", false, "accept negative constants, e.g. push constant -5, an extension to the VM language")
+}
+
+// Prefix of the environment variables setting flags
+const envPrefix = "VMTRANSLATOR_"
+
+// Names of the environment variables for flags not named after the flag
+var envAliases = map[string]string{"o": "OUTPUT", "keep-comments": "COMMENTS", "comments": "COMMENT_STYLE"}
+
+// Flags that only translate takes from the variables shared by every
+// command, as one output path for all of them would have asm and build
+// write over the translation. Other commands set them with their own.
+var translateOnlyEnv = map[string]bool{"o": true}
+
+// Set flags from the environment then parse args, so flags given override
+// the environment. A flag such as -keep-comments is set by
+// VMTRANSLATOR_KEEP_COMMENTS, or an alias such as VMTRANSLATOR_COMMENTS,
+// and by VMTRANSLATOR_TRANSLATE_KEEP_COMMENTS for one command alone, which
+// takes precedence. VMTRANSLATOR_OPT=n picks the -On level.
+func parseFlags(fs *flag.FlagSet, args []string) {
+	if err := applyEnv(fs, os.LookupEnv); err != nil {
+		log.Fatal(err)
+	}
+	fs.Parse(args)
+}
+
+// Set each flag of fs with a variable from lookup
+func applyEnv(fs *flag.FlagSet, lookup func(string) (string, bool)) error {
+	prefixes := []string{envPrefix, envPrefix + strings.ToUpper(fs.Name()) + "_"}
+	var err error
+	set := func(name, key string) {
+		for i, prefix := range prefixes {
+			if i == 0 && translateOnlyEnv[name] && fs.Name() != "translate" {
+				continue
+			}
+			value, ok := lookup(prefix + key)
+			if !ok || err != nil {
+				continue
+			}
+			if serr := fs.Set(name, value); serr != nil {
+				err = fmt.Errorf("%v%v: %v", prefix, key, serr)
+			}
+		}
+	}
+	// A variable another flag has as its alias only sets that flag, e.g.
+	// VMTRANSLATOR_COMMENTS is -keep-comments rather than -comments
+	aliased := map[string]bool{}
+	for name, alias := range envAliases {
+		if fs.Lookup(name) != nil {
+			aliased[alias] = true
+		}
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		if key := strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_")); !aliased[key] {
+			set(f.Name, key)
+		}
+		if alias, ok := envAliases[f.Name]; ok {
+			set(f.Name, alias)
+		}
+	})
+	if fs.Lookup("O0") != nil {
+		for _, prefix := range prefixes {
+			if level, ok := lookup(prefix + "OPT"); ok && err == nil {
+				if fs.Lookup("O"+level) == nil {
+					return fmt.Errorf("%vOPT: unknown level %v, want 0, 1 or 2", prefix, level)
+				}
+				err = fs.Set("O"+level, "true")
+			}
+		}
+	}
+	return err
+}
+
+// List the commands with what each does
+func writeHelp(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("usage: vm-translator <command> [flags] [arguments]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(&b, "  %-10v %v\n", cmd.name, cmd.summary)
+	}
+	b.WriteString("\nRun vm-translator help <command> for its flags.\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Describe a command, or all of them
+func helpMain(args []string) {
+	if len(args) == 0 {
+		check(writeHelp(os.Stdout))
+		return
+	}
+	if lookupCommand(args[0]) == nil || args[0] == "help" {
+		log.Fatalf("unknown command %v, run vm-translator help for the list", args[0])
+	}
+	runCommand(args[0], []string{"-h"})
+}
+
+// Translate each file without writing the output, reporting every error
+// found and warning about code that is probably a mistake, as lint does.
+// Returns the exit status: 0 if all are fine, or only have warnings, and 1
+// otherwise.
+func checkMain(args []string) int {
+	fs := newFlagSet("check")
+	preprocess := fs.Bool("preprocess", false, "expand % directives such as %include before parsing")
+	defines := defineFlags{}
+	fs.Var(defines, "D", "define `NAME` for %ifdef in the preprocessor, may be repeated")
+	keepGoing := fs.Bool("keep-going", false, "report every error in each file rather than only the first")
+	werror := fs.Bool("Werror", false, "treat warnings as errors, failing if there are any")
+	var lang Options
+	addLanguageFlags(fs, &lang)
+	parseFlags(fs, args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return 2
+	}
+
+	cfg := cliConfig{opts: Options{Backend: nullBackend{}, CheckStack: true, KeepGoing: *keepGoing, NegativeConstants: lang.NegativeConstants, Extended: lang.Extended}, preprocess: *preprocess, defines: defines}
+	r := &reporter{errOut: os.Stderr, warnOut: os.Stderr, color: useColor(os.Stderr), werror: *werror}
+	for _, filename := range fs.Args() {
+		var err error
+		if filepath.Ext(filename) == ".asm" {
+			_, err = assembleFile(filename)
+		} else {
+			err = translateFile(filename, cfg, func(*Instruction) error { return nil })
+			if err == nil {
+				err = lintFile(filename, cfg, r)
+			}
+		}
+		if err != nil {
+			r.error(err)
+		}
+	}
+	r.summary(os.Stderr)
+	return r.status()
+}
+
+// Lint a .vm file, expanding its directives first if cfg says to, and
+// report its warnings to r
+func lintFile(filename string, cfg cliConfig, r *reporter) error {
+	var source string
+	var origins []lineOrigin
+	if cfg.preprocess {
+		var err error
+		if source, origins, err = preprocessFile(filename, cfg.defines); err != nil {
+			return err
+		}
+	} else {
+		text, err := os.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		source = string(text)
+	}
+
+	warnings, err := lintVM(source, unitName(filename), cfg.opts)
+	eachSourceError(err, func(srcErr *SourceError) {
+		srcErr.File = filename
+		if origins != nil {
+			origin := origins[srcErr.Line-1]
+			srcErr.File, srcErr.Line = origin.file, origin.line
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for _, warning := range warnings {
+		file, line := filename, warning.Line
+		if origins != nil {
+			file, line = origins[line-1].file, origins[line-1].line
+		}
+		r.warn(file, line, warning.Message)
+	}
+	return nil
+}
+
+// Assemble a hand-written Hack assembly file, locating any error in it
+func assembleFile(filename string) ([]uint16, error) {
+	text, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	rom, err := assemble(strings.ReplaceAll(string(text), "\r\n", "\n"))
+	var srcErr *SourceError
+	if errors.As(err, &srcErr) {
+		srcErr.File = filename
+	}
+	return rom, err
+}
+
+// Read the .vm files named, in order
+func readSources(filenames []string) ([]sourceFile, error) {
+	var sources []sourceFile
+	for _, filename := range filenames {
+		text, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, sourceFile{name: filename, text: string(text)})
+	}
+	return sources, nil
+}
+
+// Interpret the .vm files in order, then print the values left on the stack,
+// bottom first, and each static by name
+func execMain(args []string) {
+	fs := newFlagSet("exec")
+	var lang Options
+	addLanguageFlags(fs, &lang)
+	parseFlags(fs, args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	sources, err := readSources(fs.Args())
+	check(err)
+	v := newVMInterpreter()
+	if err := v.run(sources, lang); err != nil {
+		fatal(err)
+	}
+	w := bufio.NewWriter(os.Stdout)
+	w.WriteString("stack:")
+	for addr := int(courseRAM[0]); addr < int(uint16(v.RAM[0])); addr++ {
+		fmt.Fprintf(w, " %d", v.RAM[addr])
+	}
+	w.WriteString("\n")
+	names := make([]string, 0, len(v.statics))
+	for name := range v.statics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "%v = %d\n", name, v.RAM[v.statics[name]])
+	}
+	check(w.Flush())
+}
+
+// Print the IR of the .vm files, for seeing what analyses work from
+func irMain(args []string) {
+	fs := newFlagSet("ir")
+	var lang Options
+	addLanguageFlags(fs, &lang)
+	parseFlags(fs, args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	sources, err := readSources(fs.Args())
+	check(err)
+	prog, err := BuildIR(sources, lang)
+	if err != nil {
+		fatal(err)
+	}
+	os.Stdout.WriteString(prog.String())
+}
+
+// Format VM code in place, to stdout, or list the files that need it.
+// Returns the exit status, 1 if a file couldn't be read or written.
+func fmtMain(args []string) int {
+	fs := newFlagSet("fmt")
+	write := fs.Bool("w", false, "write the result back to each file instead of to stdout")
+	list := fs.Bool("l", false, "only list the files whose formatting differs")
+	parseFlags(fs, args)
+
+	if fs.NArg() == 0 {
+		text, err := io.ReadAll(os.Stdin)
+		check(err)
+		os.Stdout.WriteString(formatVM(string(text)))
+		return 0
+	}
+	status := 0
+	for _, filename := range fs.Args() {
+		text, err := os.ReadFile(filename)
+		if err == nil {
+			formatted := formatVM(string(text))
+			switch {
+			case *list:
+				if formatted != string(text) {
+					fmt.Println(filename)
+				}
+			case *write:
+				if formatted != string(text) {
+					err = os.WriteFile(filename, []byte(formatted), 0o644)
+				}
+			default:
+				_, err = os.Stdout.WriteString(formatted)
+			}
+		}
+		if err != nil {
+			log.Print(err)
+			status = 1
+		}
+	}
+	return status
+}
+
+// Lint each .vm file, printing its warnings. Returns the exit status: 0 if
+// there were only warnings, or none, and 1 if there were errors or -Werror
+// was given and there were warnings.
+func lintMain(args []string) int {
+	fs := newFlagSet("lint")
+	preprocess := fs.Bool("preprocess", false, "expand % directives such as %include before parsing")
+	defines := defineFlags{}
+	fs.Var(defines, "D", "define `NAME` for %ifdef in the preprocessor, may be repeated")
+	werror := fs.Bool("Werror", false, "treat warnings as errors, failing if there are any")
+	var lang Options
+	addLanguageFlags(fs, &lang)
+	parseFlags(fs, args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return 2
+	}
+
+	cfg := cliConfig{opts: lang, preprocess: *preprocess, defines: defines}
+	r := &reporter{errOut: os.Stderr, warnOut: os.Stdout, color: useColor(os.Stderr), werror: *werror}
+	for _, filename := range fs.Args() {
+		if err := lintFile(filename, cfg, r); err != nil {
+			r.error(err)
+		}
+	}
+	r.summary(os.Stderr)
+	return r.status()
+}
+
+// Assemble a Hack assembly file into the .hack format the course's CPU
+// emulator loads, each instruction as 16 binary digits on a line of its own
+func asmMain(args []string) {
+	fs := newFlagSet("asm")
+	output := fs.String("o", "", "write the machine code to `file`, by default beside the input with a .hack extension")
+	force := fs.Bool("force", false, "replace the output file if it already exists")
+	parseFlags(fs, args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	filename := fs.Arg(0)
+	if *output == "" {
+		*output = strings.TrimSuffix(filename, filepath.Ext(filename)) + ".hack"
+	}
+
+	rom, err := assembleFile(filename)
+	if err != nil {
+		fatal(err)
+	}
+	ofile, err := createOutput(*output, *force, false)
+	if err != nil {
+		fatal(err)
+	}
+	defer ofile.abort()
+	check(writeHack(ofile, rom))
+	check(ofile.commit())
+	log.Println("Output to", *output)
+}
+
+// Parse a .vm file and write it in the bytecode format, keeping its comments
+// and inline assembly
+func encodeMain(args []string) {
+	fs := newFlagSet("encode")
+	output := fs.String("o", "", "write the bytecode to `file`, by default beside the input with a .vmbc extension")
+	force := fs.Bool("force", false, "replace the output file if it already exists")
+	preprocess := fs.Bool("preprocess", false, "expand % directives such as %include before parsing")
+	defines := defineFlags{}
+	fs.Var(defines, "D", "define `NAME` for %ifdef in the preprocessor, may be repeated")
+	var lang Options
+	addLanguageFlags(fs, &lang)
+	parseFlags(fs, args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	filename := fs.Arg(0)
+	if *output == "" {
+		*output = strings.TrimSuffix(filename, filepath.Ext(filename)) + bytecodeExt
+	}
+
+	lang.Backend, lang.KeepComments = nullBackend{}, true
+	cfg := cliConfig{opts: lang, preprocess: *preprocess, defines: defines}
+	var instrs []*Instruction
+	err := translateFile(filename, cfg, func(instr *Instruction) error {
+		kept := *instr
+		kept.translatedLines = append([]string(nil), instr.translatedLines...)
+		instrs = append(instrs, &kept)
+		return nil
+	})
+	if err != nil {
+		fatal(err)
+	}
+	ofile, err := createOutput(*output, *force, false)
+	if err != nil {
+		fatal(err)
+	}
+	defer ofile.abort()
+	check(encodeProgram(ofile, instrs))
+	check(ofile.commit())
+	log.Println("Output to", *output)
+}
+
+// Version and build date of a release, set with -ldflags "-X main.version=..."
+// when building outside a module checkout. Otherwise they come from the build
+// info Go records.
+var (
+	version   = ""
+	buildDate = ""
+)
+
+// Describe the build: its version, the commit it was built from, noting
+// uncommitted changes, the build date, or failing that the commit's, and the
+// Go toolchain used
+func versionText(info *debug.BuildInfo) string {
+	v, date, commit, modified := version, buildDate, "", false
+	if info != nil {
+		if v == "" {
+			v = info.Main.Version
+		}
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				commit = setting.Value
+			case "vcs.time":
+				if date == "" {
+					date = setting.Value
+				}
+			case "vcs.modified":
+				modified = setting.Value == "true"
+			}
+		}
+	}
+	if v == "" {
+		v = "(devel)"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "vm-translator %v\n", v)
+	if commit != "" {
+		if modified {
+			commit += " (modified)"
+		}
+		fmt.Fprintf(&b, "commit %v\n", commit)
+	}
+	if date != "" {
+		fmt.Fprintf(&b, "built %v\n", date)
+	}
+	if info != nil {
+		fmt.Fprintf(&b, "%v %v/%v\n", info.GoVersion, runtime.GOOS, runtime.GOARCH)
+	}
+	return b.String()
+}
+
+// Print the version of vm-translator and how it was built, for bug reports
+func versionMain(args []string) {
+	fs := newFlagSet("version")
+	parseFlags(fs, args)
+	info, _ := debug.ReadBuildInfo()
+	os.Stdout.WriteString(versionText(info))
+}
@@ -0,0 +1,253 @@
+//go:build !js
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// What completion offers for a command, taken from its flags and the
+// arguments in its usage line
+type completionSpec struct {
+	command
+	flags []*flag.Flag
+	exts  []string // Extensions of the files it takes, e.g. vm
+	dirs  bool     // Whether it takes a directory
+	words []string // Fixed words it takes instead of files
+}
+
+// Extensions of the files named in a usage line, e.g. vm in file.vm
+var argExtension = regexp.MustCompile(`\.([a-z]+)\b`)
+
+// The flags of the command named, collected by asking it for its help with
+// the usage swapped for a function that stops it before it prints or exits
+func commandFlags(name string) (flags []*flag.Flag) {
+	collected := errors.New("flags collected")
+	collectFlags = func(fs *flag.FlagSet) {
+		fs.VisitAll(func(f *flag.Flag) { flags = append(flags, f) })
+		panic(collected)
+	}
+	defer func() {
+		collectFlags = nil
+		if r := recover(); r != nil && r != collected {
+			panic(r)
+		}
+	}()
+	runCommand(name, []string{"-h"})
+	return flags
+}
+
+// What to complete for each command, in the order help lists them
+func completionSpecs() []completionSpec {
+	var specs []completionSpec
+	for _, cmd := range commands {
+		spec := completionSpec{command: cmd}
+		switch cmd.name {
+		case "help":
+			for _, other := range commands {
+				spec.words = append(spec.words, other.name)
+			}
+			specs = append(specs, spec)
+			continue
+		case "completion":
+			spec.words = []string{"bash", "zsh", "fish"}
+		}
+		spec.flags = commandFlags(cmd.name)
+		spec.dirs = slices.Contains(strings.Fields(cmd.args), "dir")
+		for _, m := range argExtension.FindAllStringSubmatch(cmd.args, -1) {
+			if ext := m[1]; !slices.Contains(spec.exts, ext) {
+				spec.exts = append(spec.exts, ext)
+			}
+		}
+		specs = append(specs, spec)
+	}
+	return specs
+}
+
+// Whether a flag is given on its own rather than followed by a value
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// Write the completion script for shell, one of bash, zsh or fish
+func writeCompletion(w io.Writer, shell string) error {
+	specs := completionSpecs()
+	var b strings.Builder
+	switch shell {
+	case "bash":
+		writeBashCompletion(&b, specs)
+	case "zsh":
+		writeZshCompletion(&b, specs)
+	case "fish":
+		writeFishCompletion(&b, specs)
+	default:
+		return fmt.Errorf("can't complete for shell %v, want bash, zsh or fish", shell)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Names of the commands, separated by spaces
+func commandNames(specs []completionSpec) string {
+	var names []string
+	for _, spec := range specs {
+		names = append(names, spec.name)
+	}
+	return strings.Join(names, " ")
+}
+
+func writeBashCompletion(b *strings.Builder, specs []completionSpec) {
+	b.WriteString("# bash completion for vm-translator, written by vm-translator completion bash\n\n")
+	b.WriteString("_vm_translator() {\n")
+	b.WriteString("\tlocal cur=${COMP_WORDS[COMP_CWORD]} prev=${COMP_WORDS[COMP_CWORD-1]}\n")
+	fmt.Fprintf(b, "\tlocal commands=%q cmd=translate\n", commandNames(specs))
+	b.WriteString("\tif [[ $COMP_CWORD -gt 1 && \" $commands \" == *\" ${COMP_WORDS[1]} \"* ]]; then\n")
+	b.WriteString("\t\tcmd=${COMP_WORDS[1]}\n\tfi\n\n")
+	b.WriteString("\tlocal flags values exts words dirs\n\tcase $cmd in\n")
+	for _, spec := range specs {
+		var flags, values []string
+		for _, f := range spec.flags {
+			flags = append(flags, "-"+f.Name)
+			if !isBoolFlag(f) {
+				values = append(values, "-"+f.Name)
+			}
+		}
+		fmt.Fprintf(b, "\t%v)\n", spec.name)
+		fmt.Fprintf(b, "\t\tflags=%q values=%q exts=%q words=%q", strings.Join(flags, " "), strings.Join(values, " "), strings.Join(spec.exts, " "), strings.Join(spec.words, " "))
+		if spec.dirs {
+			b.WriteString(" dirs=1")
+		}
+		b.WriteString(" ;;\n")
+	}
+	b.WriteString("\tesac\n\n")
+	b.WriteString(`	if [[ " $values " == *" $prev "* ]]; then
+		COMPREPLY=($(compgen -f -- "$cur"))
+		return
+	fi
+	if [[ $cur == -* ]]; then
+		COMPREPLY=($(compgen -W "$flags" -- "$cur"))
+		return
+	fi
+	COMPREPLY=($(compgen -W "$words" -- "$cur"))
+	if [[ $COMP_CWORD -eq 1 ]]; then
+		COMPREPLY+=($(compgen -W "$commands" -- "$cur"))
+	fi
+	if [[ -n $dirs || -n $exts ]]; then
+		COMPREPLY+=($(compgen -d -- "$cur"))
+	fi
+	local ext
+	for ext in $exts; do
+		COMPREPLY+=($(compgen -f -X "!*.$ext" -- "$cur"))
+	done
+}
+
+complete -o filenames -F _vm_translator vm-translator
+`)
+}
+
+// Quote s for a zsh _arguments spec in single quotes
+func zshQuote(s string) string {
+	return strings.NewReplacer("'", `'\''`, "[", `\[`, "]", `\]`, ":", `\:`).Replace(s)
+}
+
+func writeZshCompletion(b *strings.Builder, specs []completionSpec) {
+	b.WriteString("#compdef vm-translator\n# zsh completion for vm-translator, written by vm-translator completion zsh\n\n")
+	b.WriteString("_vm_translator() {\n\tlocal -a commands\n\tcommands=(\n")
+	for _, spec := range specs {
+		fmt.Fprintf(b, "\t\t'%v:%v'\n", spec.name, zshQuote(spec.summary))
+	}
+	b.WriteString("\t)\n\n\tlocal cmd=translate\n")
+	fmt.Fprintf(b, "\tif (( CURRENT > 2 )) && [[ \" %v \" == *\" $words[2] \"* ]]; then\n", commandNames(specs))
+	b.WriteString("\t\tcmd=$words[2]\n\t\tshift words\n\t\t(( CURRENT-- ))\n")
+	b.WriteString("\telif (( CURRENT == 2 )); then\n\t\t_describe -t commands command commands\n\tfi\n\n")
+	b.WriteString("\tcase $cmd in\n")
+	for _, spec := range specs {
+		fmt.Fprintf(b, "\t(%v)\n\t\t_arguments", spec.name)
+		for _, f := range spec.flags {
+			name, usage := flag.UnquoteUsage(f)
+			fmt.Fprintf(b, " \\\n\t\t\t'-%v[%v]", f.Name, zshQuote(usage))
+			if !isBoolFlag(f) {
+				if name == "" {
+					name = "value"
+				}
+				fmt.Fprintf(b, ":%v:_files", zshQuote(name))
+			}
+			b.WriteString("'")
+		}
+		switch {
+		case len(spec.words) > 0:
+			fmt.Fprintf(b, " \\\n\t\t\t'1:argument:(%v)'", strings.Join(spec.words, " "))
+		case spec.dirs:
+			b.WriteString(" \\\n\t\t\t'*:directory:_files -/'")
+		case len(spec.exts) > 0:
+			fmt.Fprintf(b, " \\\n\t\t\t'*:file:_files -g \"*.(%v)\"'", strings.Join(spec.exts, "|"))
+		}
+		b.WriteString("\n\t\t;;\n")
+	}
+	b.WriteString("\tesac\n}\n\n_vm_translator \"$@\"\n")
+}
+
+// Quote s for fish in single quotes
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
+
+func writeFishCompletion(b *strings.Builder, specs []completionSpec) {
+	b.WriteString("# fish completion for vm-translator, written by vm-translator completion fish\n\n")
+	b.WriteString("complete -c vm-translator -f\n")
+	var others []string
+	for _, spec := range specs {
+		fmt.Fprintf(b, "complete -c vm-translator -n __fish_use_subcommand -a %v -d %v\n", spec.name, fishQuote(spec.summary))
+		if spec.name != "translate" {
+			others = append(others, spec.name)
+		}
+	}
+	sort.Strings(others)
+	for _, spec := range specs {
+		// Files given without a command are translated
+		cond := fishQuote("__fish_seen_subcommand_from " + spec.name)
+		if spec.name == "translate" {
+			cond = fishQuote("not __fish_seen_subcommand_from " + strings.Join(others, " "))
+		}
+		b.WriteString("\n")
+		for _, f := range spec.flags {
+			_, usage := flag.UnquoteUsage(f)
+			fmt.Fprintf(b, "complete -c vm-translator -n %v -o %v", cond, f.Name)
+			if !isBoolFlag(f) {
+				b.WriteString(" -r -F")
+			}
+			fmt.Fprintf(b, " -d %v\n", fishQuote(usage))
+		}
+		if len(spec.words) > 0 {
+			fmt.Fprintf(b, "complete -c vm-translator -n %v -a %v\n", cond, fishQuote(strings.Join(spec.words, " ")))
+		}
+		if spec.dirs {
+			fmt.Fprintf(b, "complete -c vm-translator -n %v -a '(__fish_complete_directories)'\n", cond)
+		}
+		for _, ext := range spec.exts {
+			fmt.Fprintf(b, "complete -c vm-translator -n %v -a '(__fish_complete_suffix .%v)'\n", cond, ext)
+		}
+	}
+}
+
+// Write the completion script for the shell named
+func completionMain(args []string) {
+	fs := newFlagSet("completion")
+	parseFlags(fs, args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if err := writeCompletion(os.Stdout, fs.Arg(0)); err != nil {
+		fatal(err)
+	}
+}
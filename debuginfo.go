@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+// Version of the .dbg format, changed whenever a reader of the old one would
+// misread the new
+const debugFormat = 1
+
+// Debug information on a Hack program, written beside its assembly with -dbg
+// as a .dbg file of JSON for the emulator and external debuggers, e.g.
+//
+//	{
+//	  "format": 1,
+//	  "size": 42,
+//	  "source": [
+//	    {"rom": 0, "words": 7, "file": "Main.vm", "line": 1, "command": "push constant 7"},
+//	    ...
+//	  ],
+//	  "labels": {"Main$mul.3.LOOP": 21},
+//	  "variables": {"Main.0": 16}
+//	}
+//
+// source maps each VM command to the ROM words its code was assembled to, in
+// ROM order, and code from hand-written .asm files to none. labels gives the
+// ROM address of each label, and variables the RAM address the assembler
+// allocated each variable, among them the statics, named after their file.
+// VM code has no functions yet, so there are no function boundaries to give.
+type debugInfo struct {
+	Format    int            `json:"format"`
+	Size      int            `json:"size"` // ROM words of the whole program
+	Source    []debugSource  `json:"source"`
+	Labels    map[string]int `json:"labels"`
+	Variables map[string]int `json:"variables"`
+}
+
+// The run of ROM words a VM command was assembled to
+type debugSource struct {
+	ROM     int    `json:"rom"` // Address of the first word
+	Words   int    `json:"words"`
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Command string `json:"command"`
+}
+
+// The debug information of a program of size ROM words, whose commands are at
+// source and whose labels and variables the assembler put at those addresses
+func newDebugInfo(size int, source []debugSource, labels, vars map[string]int) *debugInfo {
+	return &debugInfo{Format: debugFormat, Size: size, Source: source, Labels: labels, Variables: vars}
+}
+
+func (d *debugInfo) write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(d)
+}
+
+// Read debug information in the .dbg format, failing if it's a format this
+// translator doesn't know
+func readDebugInfo(r io.Reader) (*debugInfo, error) {
+	var d debugInfo
+	if err := json.NewDecoder(r).Decode(&d); err != nil {
+		return nil, err
+	}
+	if d.Format != debugFormat {
+		return nil, fmt.Errorf("debug information is format %d, expected %d", d.Format, debugFormat)
+	}
+	return &d, nil
+}
+
+// Add the lines of the assembly file named file to the program, divided into
+// the commands the debug information says they were translated from. Code
+// outside any command, such as hand-written assembly, is added as the file's.
+func (p *profiler) addDebugged(file string, lines []string, d *debugInfo) error {
+	words := 0
+	for _, line := range lines {
+		words += asmCost(line)
+	}
+	if words != d.Size {
+		return fmt.Errorf("%v is %d instructions but its debug information is for %d, so is out of date", file, words, d.Size)
+	}
+
+	rom, next := 0, 0
+	var instr *Instruction
+	owner := file
+	end := 0 // ROM address after the command being added
+	for _, line := range lines {
+		if cost := asmCost(line); cost > 0 {
+			switch {
+			case next < len(d.Source) && d.Source[next].ROM == rom:
+				if instr != nil {
+					p.add(owner, instr)
+				}
+				s := d.Source[next]
+				instr = &Instruction{lineNum: s.Line, stripped: s.Command}
+				owner, end = s.File, s.ROM+s.Words
+				next++
+			case instr == nil || rom == end:
+				if instr != nil {
+					p.add(owner, instr)
+				}
+				instr = &Instruction{stripped: filepath.Base(file)}
+				owner, end = file, -1
+			}
+		}
+		if instr == nil {
+			instr = &Instruction{stripped: filepath.Base(file)}
+			owner, end = file, -1
+		}
+		instr.outputLines(line)
+		rom += asmCost(line)
+	}
+	if instr != nil {
+		p.add(owner, instr)
+	}
+	return nil
+}
@@ -0,0 +1,279 @@
+//go:build !js
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+/*
+A remote debug protocol for the emulator, framed as GDB's remote serial
+protocol so existing client libraries can drive it over TCP. Each packet is
+$data#xx, where xx is the sum of data's bytes modulo 256 in hex, and is
+acknowledged with +, or with - if the checksum is wrong. A 0x03 byte outside
+a packet interrupts the running program.
+
+Hack memory is 16-bit words addressed by word, so addresses and lengths count
+words and each word is 4 hex digits, most significant first. Numbers are hex,
+as in GDB. The commands are:
+
+	?             why the program is stopped: S05, or W00 once it has ended
+	g             the registers A, D and PC, a word each
+	m addr,len    len words of RAM from addr, e.g. m64,2 for RAM[100-101]
+	Z0,addr,kind  break before the ROM instruction at addr; kind is ignored
+	z0,addr,kind  remove the breakpoint at addr
+	s             run one instruction
+	c             run until a breakpoint (S05), an interrupt (S02), a fault
+	              such as an access outside memory (S0b) or the end of the
+	              program (W00)
+	D             detach, leaving the program to carry on undebugged
+	k             kill the program
+
+Anything else gets an empty reply, meaning it isn't supported.
+*/
+type debugSession struct {
+	m           *Machine
+	breakpoints map[int]bool
+	w           io.Writer
+	pending     []rspEvent // Packets sent while running, answered once stopped
+}
+
+// What the client sent: a packet, or an interrupt, or the error ending the
+// connection
+type rspEvent struct {
+	packet    string
+	valid     bool // Whether the packet's checksum matched
+	interrupt bool
+	err       error
+}
+
+// Instructions run between checks for an interrupt while continuing
+const interruptCheckCycles = 1024
+
+// Listen on addr for a debugger, then debug m for the one client that
+// connects until it detaches or kills the program. Returns whether it did the
+// latter.
+func debugMachine(addr string, m *Machine) (killed bool, err error) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return false, err
+	}
+	log.Println("Waiting for a debugger on", lis.Addr())
+	conn, err := lis.Accept()
+	lis.Close()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	return newDebugSession(m, conn).serve(conn)
+}
+
+func newDebugSession(m *Machine, w io.Writer) *debugSession {
+	return &debugSession{m: m, breakpoints: map[int]bool{}, w: w}
+}
+
+// Answer the packets read from r until the client detaches, kills the
+// program or disconnects
+func (s *debugSession) serve(r io.Reader) (killed bool, err error) {
+	events := make(chan rspEvent)
+	done := make(chan struct{})
+	defer close(done)
+	go readRSP(bufio.NewReader(r), events, done)
+	for {
+		var ev rspEvent
+		if len(s.pending) > 0 {
+			ev, s.pending = s.pending[0], s.pending[1:]
+		} else {
+			ev = <-events
+		}
+		switch {
+		case errors.Is(ev.err, io.EOF):
+			return false, nil
+		case ev.err != nil:
+			return false, ev.err
+		case ev.interrupt:
+			// Already stopped
+			continue
+		case !ev.valid:
+			if _, err := io.WriteString(s.w, "-"); err != nil {
+				return false, err
+			}
+			continue
+		}
+		if _, err := io.WriteString(s.w, "+"); err != nil {
+			return false, err
+		}
+		switch ev.packet {
+		case "k":
+			return true, nil
+		case "D":
+			return false, s.reply("OK")
+		}
+		reply, err := s.handle(ev.packet, events)
+		if errors.Is(err, io.EOF) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		if err := s.reply(reply); err != nil {
+			return false, err
+		}
+	}
+}
+
+// Read packets and interrupts from r, sending them to events until reading
+// fails or done is closed
+func readRSP(r *bufio.Reader, events chan<- rspEvent, done <-chan struct{}) {
+	send := func(ev rspEvent) bool {
+		select {
+		case events <- ev:
+			return true
+		case <-done:
+			return false
+		}
+	}
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			send(rspEvent{err: err})
+			return
+		}
+		switch b {
+		case 0x03:
+			if !send(rspEvent{interrupt: true}) {
+				return
+			}
+		case '$':
+			data, err := r.ReadString('#')
+			var sum [2]byte
+			if err == nil {
+				_, err = io.ReadFull(r, sum[:])
+			}
+			if err != nil {
+				send(rspEvent{err: err})
+				return
+			}
+			data = strings.TrimSuffix(data, "#")
+			want, err := strconv.ParseUint(string(sum[:]), 16, 8)
+			if !send(rspEvent{packet: data, valid: err == nil && byte(want) == rspChecksum(data)}) {
+				return
+			}
+		}
+		// Acknowledgements, and anything else between packets, are ignored
+	}
+}
+
+func rspChecksum(data string) byte {
+	var sum byte
+	for i := 0; i < len(data); i++ {
+		sum += data[i]
+	}
+	return sum
+}
+
+// Send data to the client as a packet
+func (s *debugSession) reply(data string) error {
+	_, err := fmt.Fprintf(s.w, "$%v#%02x", data, rspChecksum(data))
+	return err
+}
+
+// The reply to a packet. Continuing watches events for an interrupt.
+func (s *debugSession) handle(packet string, events <-chan rspEvent) (string, error) {
+	m := s.m
+	switch {
+	case packet == "?":
+		if m.Halted() {
+			return "W00", nil
+		}
+		return "S05", nil
+	case packet == "g":
+		return fmt.Sprintf("%04x%04x%04x", uint16(m.A), uint16(m.D), uint16(m.PC)), nil
+	case strings.HasPrefix(packet, "m"):
+		addr, n, ok := parseRSPRange(packet[1:])
+		if !ok {
+			return "E01", nil
+		}
+		var b strings.Builder
+		for i := range n {
+			v, err := m.RAM.Read(addr + i)
+			if err != nil {
+				return "E02", nil
+			}
+			fmt.Fprintf(&b, "%04x", uint16(v))
+		}
+		return b.String(), nil
+	case strings.HasPrefix(packet, "Z0,"), strings.HasPrefix(packet, "z0,"):
+		addr, _, ok := parseRSPRange(packet[3:])
+		if !ok {
+			return "E01", nil
+		}
+		if packet[0] == 'Z' {
+			s.breakpoints[addr] = true
+		} else {
+			delete(s.breakpoints, addr)
+		}
+		return "OK", nil
+	case packet == "s":
+		if m.Halted() {
+			return "W00", nil
+		}
+		if err := m.Step(); err != nil {
+			return "S0b", nil
+		}
+		return "S05", nil
+	case packet == "c":
+		return s.resume(events)
+	}
+	return "", nil
+}
+
+// Run until the program stops, replying with why. Packets other than an
+// interrupt are kept to be answered after the reply.
+func (s *debugSession) resume(events <-chan rspEvent) (string, error) {
+	m := s.m
+	for n := 1; ; n++ {
+		if m.Halted() {
+			return "W00", nil
+		}
+		if n%interruptCheckCycles == 0 {
+			select {
+			case ev := <-events:
+				if ev.err != nil {
+					return "", ev.err
+				}
+				if ev.interrupt {
+					return "S02", nil
+				}
+				s.pending = append(s.pending, ev)
+			default:
+			}
+		}
+		if err := m.Step(); err != nil {
+			return "S0b", nil
+		}
+		if s.breakpoints[m.PC] {
+			return "S05", nil
+		}
+	}
+}
+
+// Parse the hex numbers of addr,len, or addr,kind, as in packets
+func parseRSPRange(s string) (addr, n int, ok bool) {
+	a, b, found := strings.Cut(s, ",")
+	x, err := strconv.ParseUint(a, 16, 16)
+	if err != nil || !found {
+		return 0, 0, false
+	}
+	y, err := strconv.ParseUint(b, 16, 16)
+	if err != nil {
+		return 0, 0, false
+	}
+	return int(x), int(y), true
+}
@@ -0,0 +1,155 @@
+//go:build !js
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// A client of the remote debug protocol, for driving a session in tests
+type rspClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// Start a debug session on m, returning a client connected to it and a
+// channel giving whether the session ended by killing the program
+func startDebugSession(t *testing.T, m *Machine) (*rspClient, <-chan bool) {
+	server, client := net.Pipe()
+	killed := make(chan bool, 1)
+	go func() {
+		k, err := newDebugSession(m, server).serve(server)
+		if err != nil {
+			t.Error(err)
+		}
+		server.Close()
+		killed <- k
+	}()
+	t.Cleanup(func() { client.Close() })
+	return &rspClient{t, client, bufio.NewReader(client)}, killed
+}
+
+// Send a packet, returning the acknowledgement and the reply, if wanted
+func (c *rspClient) send(packet string, wantReply bool) (ack byte, reply string) {
+	c.t.Helper()
+	fmt.Fprintf(c.conn, "$%v#%02x", packet, rspChecksum(packet))
+	ack, err := c.r.ReadByte()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if wantReply {
+		reply = c.read()
+	}
+	return ack, reply
+}
+
+// Read a packet from the session
+func (c *rspClient) read() string {
+	c.t.Helper()
+	if _, err := c.r.ReadString('$'); err != nil {
+		c.t.Fatal(err)
+	}
+	data, err := c.r.ReadString('#')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	io.ReadFull(c.r, make([]byte, 2))
+	return strings.TrimSuffix(data, "#")
+}
+
+func TestDebugSession(t *testing.T) {
+	// setup
+	rom, err := assemble("@5\nD=A\n@100\nM=D\n@7\nD=A\n@101\nM=D")
+	check(err)
+	m := NewMachine(rom)
+	c, killed := startDebugSession(t, m)
+
+	type exchange struct {
+		packet, reply string
+	}
+	for _, e := range []exchange{
+		{"?", "S05"},
+		{"Z0,4,2", "OK"},
+		{"Z0,6,2", "OK"},
+		{"z0,6,2", "OK"},
+		{"c", "S05"},
+		{"g", "0064" + "0005" + "0004"},
+		{"m64,2", "00050000"},
+		{"s", "S05"},
+		{"g", "0007" + "0005" + "0005"},
+		{"m6000,2", "E02"},
+		{"vMustReplyEmpty", ""},
+		{"c", "W00"},
+		{"m64,2", "00050007"},
+	} {
+		// test
+		ack, reply := c.send(e.packet, true)
+		// assert
+		if ack != '+' || reply != e.reply {
+			t.Fatalf("Wanted %q for %q, got %c %q", e.reply, e.packet, ack, reply)
+		}
+	}
+
+	// test
+	fmt.Fprint(c.conn, "$g#00")
+	ack, _ := c.r.ReadByte()
+	// assert
+	if ack != '-' {
+		t.Fatalf("Expected a bad checksum to be refused, got %c", ack)
+	}
+
+	// test
+	c.send("k", false)
+	// assert
+	if !<-killed {
+		t.Fatalf("Wanted k to kill the program")
+	}
+}
+
+func TestDebugSessionInterrupt(t *testing.T) {
+	// setup
+	rom, err := assemble("(LOOP)\n@LOOP\n0;JMP")
+	check(err)
+	m := NewMachine(rom)
+	c, killed := startDebugSession(t, m)
+	// test
+	c.send("c", false)
+	c.conn.Write([]byte{0x03})
+	reply := c.read()
+	// assert
+	if reply != "S02" || m.Cycles == 0 {
+		t.Fatalf("Wanted S02 once interrupted, got %q after %d cycles", reply, m.Cycles)
+	}
+
+	// test
+	_, reply = c.send("D", true)
+	// assert
+	if reply != "OK" || <-killed {
+		t.Fatalf("Wanted D to detach without killing, got %q", reply)
+	}
+}
+
+func TestDebugSessionPacketsWhileRunning(t *testing.T) {
+	// setup
+	rom, err := assemble("(LOOP)\n@LOOP\n0;JMP")
+	check(err)
+	c, _ := startDebugSession(t, NewMachine(rom))
+	c.send("c", false)
+	// test
+	fmt.Fprintf(c.conn, "$m0,1#%02x", rspChecksum("m0,1"))
+	c.conn.Write([]byte{0x03})
+	stop := c.read()
+	ack, _ := c.r.ReadByte()
+	reply := c.read()
+	// assert
+	if stop != "S02" || ack != '+' || reply != "0000" {
+		t.Fatalf("Wanted the stop reply then m answered, got %q, %c %q", stop, ack, reply)
+	}
+	c.send("k", false)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ANSI escapes for coloured diagnostics
+const (
+	ansiBold    = "\x1b[1m"
+	ansiRed     = "\x1b[1;31m"
+	ansiGreen   = "\x1b[1;32m"
+	ansiMagenta = "\x1b[1;35m"
+	ansiReset   = "\x1b[0m"
+)
+
+// Write an error for the user, located like file:line: error: msg. Errors in
+// the source are followed by the offending line, with a caret under the bad
+// token when it's known, e.g.
+//
+//	Main.vm:2: error: undefined segment type nowhere
+//	    2 | pop nowhere 1
+//	      |     ^~~~~~~
+//
+// Each error of an ErrorList is written in turn.
+func writeDiagnostic(w io.Writer, err error, color bool) error {
+	var list ErrorList
+	if errors.As(err, &list) {
+		for _, srcErr := range list {
+			if werr := writeDiagnostic(w, srcErr, color); werr != nil {
+				return werr
+			}
+		}
+		return nil
+	}
+
+	var srcErr *SourceError
+	if !errors.As(err, &srcErr) {
+		_, werr := fmt.Fprintf(w, "%v %v\n", paintANSI(color, ansiRed, "error:"), err)
+		return werr
+	}
+	return writeSourceDiagnostic(w, srcErr, "error:", ansiRed, color)
+}
+
+// Wrap s in the ANSI escape code if color is set
+func paintANSI(color bool, code, s string) string {
+	if !color {
+		return s
+	}
+	return code + s + ansiReset
+}
+
+// Write a diagnostic located in the source, labelled e.g. error: in the
+// colour labelCode
+func writeSourceDiagnostic(w io.Writer, srcErr *SourceError, label, labelCode string, color bool) error {
+	paint := func(code, s string) string { return paintANSI(color, code, s) }
+	location := fmt.Sprintf("%v:%d:", srcErr.File, srcErr.Line)
+	if srcErr.File == "" {
+		location = fmt.Sprintf("line %d:", srcErr.Line)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%v %v %v\n", paint(ansiBold, location), paint(labelCode, label), srcErr.Err)
+	if srcErr.Source != "" {
+		gutter := fmt.Sprintf("%5d | ", srcErr.Line)
+		fmt.Fprintf(&b, "%v%v\n", gutter, srcErr.Source)
+
+		var tokErr *tokenError
+		if errors.As(srcErr.Err, &tokErr) {
+			if start, end, ok := tokenSpan(srcErr.Source, tokErr.token); ok {
+				// Keep tabs so the caret lines up under the token
+				pad := strings.Map(func(r rune) rune {
+					if r == '\t' {
+						return r
+					}
+					return ' '
+				}, srcErr.Source[:start])
+				caret := "^" + strings.Repeat("~", end-start-1)
+				fmt.Fprintf(&b, "%v| %v%v\n", strings.Repeat(" ", len(gutter)-2), pad, paint(ansiGreen, caret))
+			}
+		}
+	}
+	_, werr := io.WriteString(w, b.String())
+	return werr
+}
+
+// Byte offsets of the nth space separated token of a line of VM code,
+// ignoring any comment
+func tokenSpan(line string, n int) (start, end int, ok bool) {
+	code, _, _ := strings.Cut(line, "//")
+	for i := 0; i < len(code); {
+		if code[i] == ' ' {
+			i++
+			continue
+		}
+		j := i
+		for j < len(code) && code[j] != ' ' {
+			j++
+		}
+		if n == 0 {
+			return i, j, true
+		}
+		n--
+		i = j
+	}
+	return 0, 0, false
+}
+
+// How serious a diagnostic is. Warnings are for code that is legal but
+// probably a mistake, errors for code that can't be translated.
+type severity int
+
+const (
+	severityWarning severity = iota
+	severityError
+)
+
+func (s severity) String() string {
+	if s == severityWarning {
+		return "warning"
+	}
+	return "error"
+}
+
+// Writes diagnostics as they're found, counting each severity for the
+// summary at the end. With werror warnings are reported and counted as
+// errors.
+type reporter struct {
+	errOut  io.Writer // Where errors are written
+	warnOut io.Writer // Where warnings are written
+	color   bool
+	werror  bool
+	counts  [severityError + 1]int
+}
+
+// Report err, counting each error of an ErrorList
+func (r *reporter) error(err error) {
+	var list ErrorList
+	if errors.As(err, &list) {
+		r.counts[severityError] += len(list)
+	} else {
+		r.counts[severityError]++
+	}
+	writeDiagnostic(r.errOut, err, r.color)
+}
+
+// Report the warning at line of file
+func (r *reporter) warn(file string, line int, message string) {
+	srcErr := &SourceError{File: file, Line: line, Err: errors.New(message)}
+	if r.werror {
+		r.counts[severityError]++
+		srcErr.Err = fmt.Errorf("%v [-Werror]", message)
+		writeSourceDiagnostic(r.errOut, srcErr, "error:", ansiRed, r.color)
+		return
+	}
+	r.counts[severityWarning]++
+	writeSourceDiagnostic(r.warnOut, srcErr, "warning:", ansiMagenta, r.color)
+}
+
+// Write how many warnings and errors there were to w, if there were any
+func (r *reporter) summary(w io.Writer) {
+	var parts []string
+	for s := severityWarning; s <= severityError; s++ {
+		switch n := r.counts[s]; n {
+		case 0:
+		case 1:
+			parts = append(parts, "1 "+s.String())
+		default:
+			parts = append(parts, fmt.Sprintf("%d %vs", n, s))
+		}
+	}
+	if len(parts) > 0 {
+		fmt.Fprintln(w, strings.Join(parts, " and "))
+	}
+}
+
+// The exit status for what was reported: 1 if there were errors, else 0
+func (r *reporter) status() int {
+	if r.counts[severityError] > 0 {
+		return 1
+	}
+	return 0
+}
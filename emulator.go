@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/schallis/vm-translator/machine"
+)
+
+/*
+A Hack assembler and CPU, so generated code can be run and checked without the
+course's Java tools. Programs are assembled to ROM words as the official
+assembler does, with variables allocated from RAM[16], and the CPU executes
+them one instruction per cycle until the program counter runs off the end of
+the ROM.
+*/
+
+// Addresses of the predefined symbols
+var hackSymbols = map[string]int{
+	"SP": 0, "LCL": 1, "ARG": 2, "THIS": 3, "THAT": 4,
+	"SCREEN": 16384, "KBD": 24576,
+}
+
+func init() {
+	for i := 0; i <= 15; i++ {
+		hackSymbols["R"+strconv.Itoa(i)] = i
+	}
+}
+
+// Bits of the comp field, including the a bit, for each computation
+var hackComp = map[string]uint16{
+	"0": 0b0101010, "1": 0b0111111, "-1": 0b0111010,
+	"D": 0b0001100, "A": 0b0110000, "!D": 0b0001101, "!A": 0b0110001,
+	"-D": 0b0001111, "-A": 0b0110011, "D+1": 0b0011111, "A+1": 0b0110111,
+	"D-1": 0b0001110, "A-1": 0b0110010, "D+A": 0b0000010, "D-A": 0b0010011,
+	"A-D": 0b0000111, "D&A": 0b0000000, "D|A": 0b0010101,
+	"M": 0b1110000, "!M": 0b1110001, "-M": 0b1110011, "M+1": 0b1110111,
+	"M-1": 0b1110010, "D+M": 0b1000010, "D-M": 0b1010011, "M-D": 0b1000111,
+	"D&M": 0b1000000, "D|M": 0b1010101,
+}
+
+var hackJump = map[string]uint16{
+	"": 0, "JGT": 1, "JEQ": 2, "JGE": 3, "JLT": 4, "JNE": 5, "JLE": 6, "JMP": 7,
+}
+
+// Assemble Hack assembly into ROM words. Errors are located by their
+// 1-based line in asm.
+func assemble(asm string) ([]uint16, error) {
+	rom, _, err := assembleLabels(asm)
+	return rom, err
+}
+
+// Write the machine code in the .hack format, a word of binary digits a line
+func writeHack(w io.Writer, rom []uint16) error {
+	bw := bufio.NewWriter(w)
+	for _, word := range rom {
+		fmt.Fprintf(bw, "%016b\n", word)
+	}
+	return bw.Flush()
+}
+
+// Assemble as assemble does, also returning the ROM address of each label
+// defined in asm
+func assembleLabels(asm string) ([]uint16, map[string]int, error) {
+	rom, labels, _, err := assembleSymbols(asm)
+	return rom, labels, err
+}
+
+// Assemble as assembleLabels does, also returning the RAM address allocated
+// to each variable
+func assembleSymbols(asm string) ([]uint16, map[string]int, map[string]int, error) {
+	lines := strings.Split(asm, "\n")
+
+	// First pass: strip comments and find the address of each label
+	symbols := map[string]int{}
+	for name, addr := range hackSymbols {
+		symbols[name] = addr
+	}
+	type sourceLine struct {
+		num  int
+		text string
+	}
+	labels := map[string]int{}
+	var instrs []sourceLine
+	for i, line := range lines {
+		if comment := strings.Index(line, "//"); comment >= 0 {
+			line = line[:comment]
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "("):
+			if !strings.HasSuffix(line, ")") {
+				return nil, nil, nil, &SourceError{Line: i + 1, Err: fmt.Errorf("malformed label %v", line)}
+			}
+			symbols[line[1:len(line)-1]] = len(instrs)
+			labels[line[1:len(line)-1]] = len(instrs)
+		default:
+			instrs = append(instrs, sourceLine{i + 1, line})
+		}
+	}
+
+	if len(instrs) > hackROMSize {
+		return nil, nil, nil, &SourceError{Line: instrs[hackROMSize].num, Err: fmt.Errorf("program is %d instructions, more than the %d the ROM holds", len(instrs), hackROMSize)}
+	}
+
+	// Second pass: encode each instruction, allocating variables as they're
+	// first seen
+	rom := make([]uint16, 0, len(instrs))
+	nextVar := 16
+	for _, instr := range instrs {
+		word, err := encodeInstruction(instr.text, symbols, &nextVar)
+		if err != nil {
+			return nil, nil, nil, &SourceError{Line: instr.num, Err: err}
+		}
+		rom = append(rom, word)
+	}
+	// Whatever isn't predefined or a label was allocated as a variable
+	vars := map[string]int{}
+	for name, addr := range symbols {
+		_, predefined := hackSymbols[name]
+		_, label := labels[name]
+		if !predefined && !label {
+			vars[name] = addr
+		}
+	}
+	return rom, labels, vars, nil
+}
+
+// Rewrite Hack assembly with each symbol replaced by the address the
+// assembler gives it and the labels dropped, so an assembler without a symbol
+// table can read it in one pass. Comments and layout are kept.
+func resolveSymbols(asm string) (string, error) {
+	_, labels, vars, err := assembleSymbols(asm)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, line := range strings.Split(asm, "\n") {
+		code, _, _ := strings.Cut(line, "//")
+		code = strings.TrimSpace(code)
+		if strings.HasPrefix(code, "(") {
+			continue
+		}
+		if sym, ok := strings.CutPrefix(code, "@"); ok {
+			addr, ok := hackSymbols[sym]
+			if !ok {
+				addr, ok = labels[sym]
+			}
+			if !ok {
+				addr, ok = vars[sym]
+			}
+			if ok {
+				line = strings.Replace(line, code, "@"+strconv.Itoa(addr), 1)
+			}
+		}
+		if b.Len() > 0 {
+			b.WriteString("\n")
+		}
+		b.WriteString(line)
+	}
+	return b.String(), nil
+}
+
+// Encode one A or C instruction
+func encodeInstruction(instr string, symbols map[string]int, nextVar *int) (uint16, error) {
+	if sym, ok := strings.CutPrefix(instr, "@"); ok {
+		if v, err := strconv.ParseUint(sym, 10, 15); err == nil {
+			return uint16(v), nil
+		}
+		if sym != "" && sym[0] >= '0' && sym[0] <= '9' {
+			return 0, fmt.Errorf("constant %v is more than the %d an A-instruction can load", sym, maxAValue)
+		}
+		addr, ok := symbols[sym]
+		if !ok {
+			addr = *nextVar
+			symbols[sym] = addr
+			*nextVar++
+		}
+		if addr > maxAValue {
+			return 0, fmt.Errorf("%v is at address %d, more than the %d an A-instruction can load", sym, addr, maxAValue)
+		}
+		return uint16(addr), nil
+	}
+
+	// dest=comp;jump
+	rest, jump, _ := strings.Cut(instr, ";")
+	dest, comp, ok := strings.Cut(rest, "=")
+	if !ok {
+		dest, comp = "", rest
+	}
+	c, ok := hackComp[comp]
+	if !ok {
+		return 0, fmt.Errorf("invalid computation %v", comp)
+	}
+	j, ok := hackJump[jump]
+	if !ok {
+		return 0, fmt.Errorf("invalid jump %v", jump)
+	}
+	var d uint16
+	for _, r := range dest {
+		switch r {
+		case 'A':
+			d |= 4
+		case 'D':
+			d |= 2
+		case 'M':
+			d |= 1
+		default:
+			return 0, fmt.Errorf("invalid destination %v", dest)
+		}
+	}
+	return 0b111<<13 | c<<6 | d<<3 | j, nil
+}
+
+// Size of the Hack data memory, up to and including the keyboard
+const hackRAMSize = machine.Size
+
+// Size of the Hack instruction memory, every address an A-instruction can
+// load, so jumps anywhere in it need no trampolines
+const hackROMSize = 1 << 15
+
+// The largest value an A-instruction can load, as its top bit marks it
+const maxAValue = hackROMSize - 1
+
+// SP, LCL, ARG, THIS and THAT as the course's test scripts set them before
+// running translated code, which has no bootstrap of its own
+var courseRAM = []int16{256, 300, 400, 3000, 3010}
+
+// The Hack CPU with its ROM and RAM
+type Machine struct {
+	ROM    []uint16
+	RAM    machine.RAM
+	A, D   int16
+	PC     int
+	Cycles int // Number of instructions executed
+
+	// Called, if set, with each RAM address the machine reads or writes
+	Watch func(addr int, write bool)
+}
+
+// Create a machine running the program in rom
+func NewMachine(rom []uint16) *Machine {
+	return &Machine{ROM: rom}
+}
+
+// Whether the program counter has run off the end of the program
+func (m *Machine) Halted() bool {
+	return m.PC < 0 || m.PC >= len(m.ROM)
+}
+
+// Execute the instruction at PC
+func (m *Machine) Step() error {
+	if m.Halted() {
+		return fmt.Errorf("pc %d is outside the program", m.PC)
+	}
+	instr := m.ROM[m.PC]
+	m.Cycles++
+	if instr&0x8000 == 0 {
+		m.A = int16(instr)
+		m.PC++
+		return nil
+	}
+
+	addr := int(uint16(m.A))
+	y := m.A
+	if instr&0x1000 != 0 {
+		var err error
+		if y, err = m.RAM.Read(addr); err != nil {
+			return fmt.Errorf("pc %d: %w", m.PC, err)
+		}
+		if m.Watch != nil {
+			m.Watch(addr, false)
+		}
+	}
+	out := alu(m.D, y, instr>>6)
+
+	if instr&0x08 != 0 {
+		if err := m.RAM.Write(addr, out); err != nil {
+			return fmt.Errorf("pc %d: %w", m.PC, err)
+		}
+		if m.Watch != nil {
+			m.Watch(addr, true)
+		}
+	}
+	if instr&0x20 != 0 {
+		m.A = out
+	}
+	if instr&0x10 != 0 {
+		m.D = out
+	}
+
+	// As on the CPU, a jump goes to A as it was before this instruction set it
+	jump := instr & 7
+	if (jump&4 != 0 && out < 0) || (jump&2 != 0 && out == 0) || (jump&1 != 0 && out > 0) {
+		m.PC = addr
+	} else {
+		m.PC++
+	}
+	return nil
+}
+
+// Run until the program halts, failing if it takes more than maxCycles
+func (m *Machine) Run(maxCycles int) error {
+	for !m.Halted() {
+		if m.Cycles >= maxCycles {
+			return fmt.Errorf("program still running after %d cycles", maxCycles)
+		}
+		if err := m.Step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The Hack ALU, computing from x and y as selected by the control bits
+// zx nx zy ny f no in the low 6 bits of c
+func alu(x, y int16, c uint16) int16 {
+	if c&0x20 != 0 {
+		x = 0
+	}
+	if c&0x10 != 0 {
+		x = ^x
+	}
+	if c&0x08 != 0 {
+		y = 0
+	}
+	if c&0x04 != 0 {
+		y = ^y
+	}
+	var out int16
+	if c&0x02 != 0 {
+		out = x + y
+	} else {
+		out = x & y
+	}
+	if c&0x01 != 0 {
+		out = ^out
+	}
+	return out
+}
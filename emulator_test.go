@@ -0,0 +1,775 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image/png"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/schallis/vm-translator/machine"
+)
+
+func TestAssemble(t *testing.T) {
+	// setup
+	asm := `// count down from 2
+@2
+D=A
+(LOOP)
+@i
+M=D
+D=D-1;JGT
+@LOOP
+0;JMP
+@SCREEN`
+	// test
+	rom, err := assemble(asm)
+	// assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []uint16{
+		2,
+		0b1110110000010000,
+		16,
+		0b1110001100001000,
+		0b1110001110010001,
+		2,
+		0b1110101010000111,
+		16384,
+	}
+	if !reflect.DeepEqual(rom, want) {
+		t.Fatalf("Wanted %016b, got %016b", want, rom)
+	}
+
+	if _, err := assemble("@1\nD=Q"); err == nil || !strings.HasPrefix(err.Error(), "line 2:") {
+		t.Fatalf("Expected invalid computation produce err on line 2, got %v", err)
+	}
+
+	type testCase struct {
+		asm  string
+		line int
+	}
+	for _, c := range []testCase{
+		{"@1\n@40000\n", 2},
+		{strings.Repeat("D=A\n", hackROMSize-1) + "@END\n(END)\n", hackROMSize},
+		{strings.Repeat("D=A\n", hackROMSize+1), hackROMSize + 1},
+	} {
+		// test
+		_, err := assemble(c.asm)
+		// assert
+		var srcErr *SourceError
+		if !errors.As(err, &srcErr) || srcErr.Line != c.line {
+			t.Fatalf("Expected address out of range produce err on line %d, got %v", c.line, err)
+		}
+	}
+}
+
+func TestResolveSymbols(t *testing.T) {
+	// setup
+	asm := "// count down\n@2\nD=A\n(LOOP)\n@i // counter\nM=D\nD=D-1;JGT\n@LOOP\n0;JMP\n@SCREEN"
+	// test
+	resolved, err := resolveSymbols(asm)
+	check(err)
+	// assert
+	want := "// count down\n@2\nD=A\n@16 // counter\nM=D\nD=D-1;JGT\n@2\n0;JMP\n@16384"
+	if resolved != want {
+		t.Fatalf("Wanted:\n%v\ngot:\n%v", want, resolved)
+	}
+	rom, _ := assemble(asm)
+	resolvedROM, _ := assemble(resolved)
+	if !reflect.DeepEqual(rom, resolvedROM) {
+		t.Fatalf("Expected the resolved assembly to assemble the same")
+	}
+}
+
+func TestMachineRun(t *testing.T) {
+	// setup
+	rom, _ := assemble("@5\nD=A\n(LOOP)\n@R1\nM=D+M\nD=D-1\n@LOOP\nD;JGT")
+	m := NewMachine(rom)
+	// test
+	err := m.Run(1000)
+	// assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.RAM[1] != 15 {
+		t.Fatalf("Wanted 5+4+3+2+1 = 15 in R1, got %v", m.RAM[1])
+	}
+
+	// test
+	rom, _ = assemble("@3\nA=A+1;JMP")
+	m = NewMachine(rom)
+	check(m.Step())
+	check(m.Step())
+	// assert
+	if m.PC != 3 || m.A != 4 {
+		t.Fatalf("Wanted a jump to A before it was set, to 3 with A 4, got PC %v and A %v", m.PC, m.A)
+	}
+
+	rom, _ = assemble("(LOOP)\n@LOOP\n0;JMP")
+	if err := NewMachine(rom).Run(1000); err == nil {
+		t.Fatalf("Expected infinite loop produce err")
+	}
+}
+
+// Translate a VM program, then run it from the course's usual starting state
+func runVM(t *testing.T, source string, opts Options) *Machine {
+	t.Helper()
+	return runVMWatched(t, source, opts, nil)
+}
+
+// Run a VM program as runVM does, calling watch with each memory access
+func runVMWatched(t *testing.T, source string, opts Options, watch func(addr int, write bool)) *Machine {
+	t.Helper()
+	asm, err := translateString(source, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rom, err := assemble(asm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMachine(rom)
+	m.Watch = watch
+	copy(m.RAM[:], courseRAM)
+	if err := m.Run(100000); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestTranslatedArithmetic(t *testing.T) {
+	type testCase struct {
+		source string
+		ram    map[int]int16 // Wanted RAM contents after running
+	}
+	cases := []testCase{
+		{"push constant 7\npush constant 8\nadd", map[int]int16{0: 257, 256: 15}},
+		{"push constant 10\npush constant 3\nsub", map[int]int16{0: 257, 256: 7}},
+		{"push constant 3\npush constant 10\nsub", map[int]int16{0: 257, 256: -7}},
+		{"push constant 1\npush constant 2\npush constant 3\nsub\nadd", map[int]int16{0: 257, 256: 0}},
+		{"push constant 32767\npush constant 1\nadd", map[int]int16{256: -32768}},
+		{"push constant 0\npush constant 1\npush constant -1\npush constant 2", map[int]int16{0: 260, 256: 0, 257: 1, 258: -1, 259: 2}},
+		{"push constant -5\npush constant -32768\npush constant 3\nadd", map[int]int16{0: 258, 256: -5, 257: -32765}},
+		{"push constant 5\npop local 2\npush local 2\npush local 2\nadd", map[int]int16{0: 257, 1: 300, 256: 10, 302: 5}},
+		{"push constant 9\npop argument 0\npush constant 4\npop that 1\npush argument 0\npop temp 3\npush temp 3", map[int]int16{0: 257, 256: 9, 400: 9, 3011: 4, 8: 9}},
+		{"push constant 3030\npop pointer 0\npush constant 3040\npop pointer 1\npush pointer 0", map[int]int16{0: 257, 3: 3030, 4: 3040, 256: 3030}},
+	}
+	for _, c := range cases {
+		for level := 0; level <= 2; level++ {
+			// setup
+			pm, _ := newPassManager(level, nil)
+			// test
+			m := runVM(t, c.source, Options{Passes: pm, NegativeConstants: true})
+			// assert
+			for addr, want := range c.ram {
+				if m.RAM[addr] != want {
+					t.Fatalf("Wanted RAM[%v] = %v at -O%d, got %v\n%s", addr, want, level, m.RAM[addr], c.source)
+				}
+			}
+		}
+	}
+}
+
+func TestTranslatedExtendedArithmetic(t *testing.T) {
+	values := []int16{0, 1, -1, 2, 3, -3, 7, -7, 100, -100, 255, 12345, -12345, 16384, 32767, -32768}
+	for _, x := range values {
+		for _, y := range values {
+			for level := 0; level <= 2; level++ {
+				// setup
+				pm, _ := newPassManager(level, nil)
+				source := fmt.Sprintf("push constant %d\nshiftleft\npush constant %d\nshiftright\npush constant %d\npush constant %d\nmul\n", x, x, x, y)
+				want := map[int]int16{0: 259, 256: x << 1, 257: x >> 1, 258: x * y}
+				if y != 0 {
+					source += fmt.Sprintf("push constant %d\npush constant %d\ndiv\npush constant %d\npush constant %d\nmod\n", x, y, x, y)
+					want[0], want[259], want[260] = 261, x/y, x%y
+				}
+				// test
+				m := runVM(t, source, Options{Passes: pm, NegativeConstants: true, Extended: true})
+				// assert
+				for addr, v := range want {
+					if m.RAM[addr] != v {
+						t.Fatalf("Wanted RAM[%v] = %v at -O%d, got %v\n%s", addr, v, level, m.RAM[addr], source)
+					}
+				}
+			}
+		}
+	}
+
+	// setup
+	asm, _ := translateString("push constant 1\npush constant 0\ndiv\n", Options{Extended: true})
+	rom, _ := assemble(asm)
+	m := NewMachine(rom)
+	copy(m.RAM[:], courseRAM)
+	// test
+	err := m.Run(10000)
+	// assert
+	if err == nil {
+		t.Fatalf("Expected division by zero to halt in a loop")
+	}
+}
+
+func TestExtendedStatsBoundCycles(t *testing.T) {
+	values := []int16{0, 1, -1, 7, 255, -12345, 32767, -32768}
+	for _, op := range []string{"mul", "div", "mod", "shiftright"} {
+		for _, x := range values {
+			for _, y := range values {
+				if y == 0 && op != "mul" {
+					continue
+				}
+				// setup
+				source := fmt.Sprintf("push constant %d\npush constant %d\n%v\n", x, y, op)
+				opts := Options{NegativeConstants: true, Extended: true}
+				instrs, err := translateInstructions(strings.NewReader(source), opts)
+				check(err)
+				// test
+				stats := computeStats("Test", instrs)
+				m := runVM(t, source, opts)
+				// assert
+				if m.Cycles > stats.worstCycles || stats.callCycles > stats.worstCycles {
+					t.Fatalf("Wanted %d cycles and %d a call at most the worst case %d\n%s", m.Cycles, stats.callCycles, stats.worstCycles, source)
+				}
+			}
+		}
+	}
+
+	// setup
+	instrs, err := translateInstructions(strings.NewReader("//#asm\n(LOOP)\n@LOOP\n0;JMP\n//#endasm\n"), Options{})
+	check(err)
+	// test
+	stats := computeStats("Test", instrs)
+	// assert
+	if stats.worstCycles != unboundedCycles {
+		t.Fatalf("Wanted a loop in inline assembly unbounded, got %d", stats.worstCycles)
+	}
+}
+
+// Course tests these translations pass
+var courseTests = []string{
+	"StackArithmetic/SimpleAdd",
+	"MemoryAccess/BasicTest",
+	"MemoryAccess/PointerTest",
+	"MemoryAccess/StaticTest",
+}
+
+var (
+	tstSet    = regexp.MustCompile(`set RAM\[(\d+)\] (-?\d+)`)
+	tstRepeat = regexp.MustCompile(`repeat (\d+)`)
+	cmpRAM    = regexp.MustCompile(`RAM\[(\d+)`)
+)
+
+// Run the course's test scripts, setting RAM as the .tst file does and
+// comparing the results with the .cmp file
+func TestCourseTests(t *testing.T) {
+	for _, test := range courseTests {
+		for level := 0; level <= 2; level++ {
+			runCourseTest(t, test, level)
+		}
+	}
+}
+
+func runCourseTest(t *testing.T, test string, level int) {
+	t.Helper()
+	// setup
+	dir := filepath.Join("test_files", test)
+	name := filepath.Base(dir)
+	source, err := os.ReadFile(filepath.Join(dir, name+".vm"))
+	check(err)
+	tst, err := os.ReadFile(filepath.Join(dir, name+".tst"))
+	check(err)
+	cmp, err := os.ReadFile(filepath.Join(dir, name+".cmp"))
+	check(err)
+	pm, _ := newPassManager(level, nil)
+	asm, err := translateString(string(source), Options{Passes: pm})
+	if err != nil {
+		t.Fatalf("%v: %v", test, err)
+	}
+	rom, err := assemble(asm)
+	if err != nil {
+		t.Fatalf("%v: %v", test, err)
+	}
+	m := NewMachine(rom)
+	for _, set := range tstSet.FindAllStringSubmatch(string(tst), -1) {
+		addr, _ := strconv.Atoi(set[1])
+		v, _ := strconv.Atoi(set[2])
+		m.RAM[addr] = int16(v)
+	}
+	cycles, _ := strconv.Atoi(tstRepeat.FindStringSubmatch(string(tst))[1])
+	// test
+	for i := 0; i < cycles && !m.Halted(); i++ {
+		if err := m.Step(); err != nil {
+			t.Fatalf("%v: %v", test, err)
+		}
+	}
+	// assert
+	rows := strings.Split(strings.TrimSpace(string(cmp)), "\n")
+	addrs := cmpRAM.FindAllStringSubmatch(rows[0], -1)
+	values := strings.FieldsFunc(rows[1], func(r rune) bool { return r == '|' || r == ' ' })
+	for i, addr := range addrs {
+		a, _ := strconv.Atoi(addr[1])
+		if got := strconv.Itoa(int(m.RAM[a])); got != values[i] {
+			t.Fatalf("%v at -O%d: wanted RAM[%v] = %v, got %v", test, level, a, values[i], got)
+		}
+	}
+}
+
+func TestProfiler(t *testing.T) {
+	// setup
+	source := "push constant 1\n//#asm\n(LOOP)\n@R5\nM=M+1\nD=M\n@3\nD=D-A\n@LOOP\nD;JLT\n//#endasm\npop temp 1\n"
+	var p profiler
+	err := translateStream(strings.NewReader(source), Options{}, func(instr *Instruction) error {
+		p.add("Main.vm", instr)
+		return nil
+	})
+	check(err)
+	// test
+	entries, err := p.run(1000)
+	// assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	type want struct {
+		line          int
+		count, cycles int
+	}
+	wants := []want{{1, 1, 4}, {2, 3, 21}, {12, 1, 6}}
+	if len(entries) != len(wants) {
+		t.Fatalf("Wanted %v commands profiled, got %+v", len(wants), entries)
+	}
+	for i, w := range wants {
+		if e := entries[i]; e.Line != w.line || e.Count != w.count || e.Cycles != w.cycles {
+			t.Fatalf("Wanted line %v run %v times in %v cycles, got %+v", w.line, w.count, w.cycles, e)
+		}
+	}
+}
+
+func TestProfilerFault(t *testing.T) {
+	// setup
+	source := "push constant 32000\npop pointer 1\npush constant 2\npop that 0\n"
+	var p profiler
+	err := translateStream(strings.NewReader(source), Options{}, func(instr *Instruction) error {
+		p.add("Main.vm", instr)
+		return nil
+	})
+	check(err)
+	// test
+	_, err = p.run(1000)
+	// assert
+	var srcErr *SourceError
+	var addrErr *machine.AddressError
+	if !errors.As(err, &srcErr) || !errors.As(err, &addrErr) {
+		t.Fatalf("Expected a located access outside memory, got %v", err)
+	}
+	if srcErr.File != "Main.vm" || srcErr.Line != 4 || srcErr.Source != "pop that 0" {
+		t.Fatalf("Wanted the fault at Main.vm:4, got %+v", srcErr)
+	}
+}
+
+func TestScreenRendering(t *testing.T) {
+	// setup
+	m := NewMachine(nil)
+	m.RAM[screenBase] = 1               // pixel 0, 0
+	m.RAM[screenBase+32*3+31] = -0x8000 // pixel 511, 3
+	var text, img bytes.Buffer
+	// test
+	err := writeScreenText(&text, m, 1)
+	check(err)
+	check(writeScreenPNG(&img, m))
+	// assert
+	rows := strings.Split(text.String(), "\n")
+	if len(rows) != screenHeight/4+1 || utf8.RuneCountInString(rows[0]) != screenWidth/2 {
+		t.Fatalf("Wanted %v rows of %v characters, got %v rows of %v", screenHeight/4, screenWidth/2, len(rows)-1, utf8.RuneCountInString(rows[0]))
+	}
+	runes := []rune(rows[0])
+	if runes[0] != '⠁' || runes[len(runes)-1] != '⢀' || runes[1] != '⠀' {
+		t.Fatalf("Wanted the top left and bottom right dots of the first row raised, got %q", rows[0])
+	}
+	decoded, err := png.Decode(&img)
+	check(err)
+	if r, _, _, _ := decoded.At(0, 0).RGBA(); r != 0 {
+		t.Fatalf("Wanted pixel 0, 0 black")
+	}
+	if r, _, _, _ := decoded.At(1, 0).RGBA(); r == 0 {
+		t.Fatalf("Wanted pixel 1, 0 white")
+	}
+}
+
+func TestKeyScript(t *testing.T) {
+	// setup
+	events, err := parseKeys("Space:4, ArrowUp:0\n# then release\nNone:6,q:12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Copy the keyboard into R0 each cycle
+	rom, _ := assemble(strings.Repeat("@KBD\nD=M\n@R0\nM=D\n", 3))
+	m := NewMachine(rom)
+	script := keyScript{events}
+	var seen []int16
+	// test
+	for !m.Halted() {
+		script.apply(m)
+		check(m.Step())
+		if m.PC%4 == 0 {
+			seen = append(seen, m.RAM[0])
+		}
+	}
+	// assert
+	if want := []int16{131, 32, 0}; !reflect.DeepEqual(seen, want) {
+		t.Fatalf("Wanted keys %v read, got %v", want, seen)
+	}
+	if _, err := parseKeys("Shift:10"); err == nil {
+		t.Fatalf("Expected unknown key produce err")
+	}
+	if _, err := parseKeys("Space"); err == nil {
+		t.Fatalf("Expected missing cycle produce err")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	// setup
+	rom, _ := assemble("@5\nD=A\n(LOOP)\n@R1\nM=D+M\nD=D-1\n@LOOP\nD;JGT")
+	m := NewMachine(rom)
+	for i := 0; i < 9; i++ {
+		check(m.Step())
+	}
+	var b bytes.Buffer
+	// test
+	err := m.saveSnapshot(&b)
+	check(err)
+	resumed := NewMachine(rom)
+	err = resumed.loadSnapshot(bytes.NewReader(b.Bytes()))
+	// assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(resumed, m) {
+		t.Fatalf("Wanted the machine restored, got PC %v, cycles %v", resumed.PC, resumed.Cycles)
+	}
+	check(resumed.Run(1000))
+	if resumed.RAM[1] != 15 {
+		t.Fatalf("Wanted the resumed run to finish with 15 in R1, got %v", resumed.RAM[1])
+	}
+
+	other, _ := assemble("@5\nD=A")
+	if err := NewMachine(other).loadSnapshot(bytes.NewReader(b.Bytes())); err == nil {
+		t.Fatalf("Expected snapshot of a different program produce err")
+	}
+}
+
+func TestHeapTracker(t *testing.T) {
+	// setup
+	var h heapTracker
+	rom, _ := assemble("@2048\nM=1\n@2049\nM=1\n@2052\nM=1\n@2050\nD=M")
+	m := NewMachine(rom)
+	m.Watch = h.watch
+	// test
+	check(m.Run(100))
+	var b strings.Builder
+	check(h.report(&b))
+	// assert
+	if h.inUse != 3 || h.peak != 2052 {
+		t.Fatalf("Wanted 3 words in use up to 2052, got %v up to %v", h.inUse, h.peak)
+	}
+	if gaps := h.gaps(); !reflect.DeepEqual(gaps, [][2]int{{2050, 2}}) {
+		t.Fatalf("Wanted one gap of 2 words at 2050, got %v", gaps)
+	}
+	if !strings.Contains(b.String(), "1 reads of words never written, first at 2050") {
+		t.Fatalf("Expected the read of 2050 reported, got:\n%v", b.String())
+	}
+}
+
+func TestTraceRingBuffer(t *testing.T) {
+	// setup
+	// More commands than the buffer holds
+	source := strings.Repeat("push constant 1\npop temp 0\n", traceSize)
+	var outside []int
+	watch := func(addr int, write bool) {
+		if write && addr >= heapBase && (addr < traceCursor || addr >= screenBase) {
+			outside = append(outside, addr)
+		}
+	}
+	// test
+	m := runVMWatched(t, source, Options{Trace: true}, watch)
+	// assert
+	if len(outside) > 0 {
+		t.Fatalf("Wanted only the trace region written above the stack, got writes to %v", outside[:min(len(outside), 10)])
+	}
+	cursor := int(m.RAM[traceCursor])
+	if cursor < traceBuffer || cursor >= screenBase {
+		t.Fatalf("Wanted the cursor inside the buffer, got %v", cursor)
+	}
+	last := traceBuffer + (cursor-traceBuffer+traceSize-1)%traceSize
+	if want := 2 * traceSize; m.RAM[last] != int16(want) || m.RAM[cursor] != int16(want-traceSize+1) {
+		t.Fatalf("Wanted lines %v to %v in the buffer, got %v to %v", want-traceSize+1, want, m.RAM[cursor], m.RAM[last])
+	}
+}
+
+func TestHeatMap(t *testing.T) {
+	// setup
+	var h heatMap
+	m := runVMWatched(t, "push constant 7\npop static 0\npush static 0", Options{}, h.watch)
+	var csv, img bytes.Buffer
+	// test
+	check(h.writeCSV(&csv))
+	check(h.writePNG(&img))
+	// assert
+	if m.RAM[256] != 7 {
+		t.Fatalf("Wanted 7 pushed, got %v", m.RAM[256])
+	}
+	if !strings.Contains(csv.String(), "\n16,static,1,1\n") || !strings.Contains(csv.String(), "\n0,SP,") {
+		t.Fatalf("Expected the static and SP accesses counted, got:\n%v", csv.String())
+	}
+	decoded, err := png.Decode(&img)
+	check(err)
+	if r, _, _, _ := decoded.At(16, 0).RGBA(); r == 0 {
+		t.Fatalf("Wanted the static's pixel lit")
+	}
+	if r, _, _, _ := decoded.At(100, 0).RGBA(); r != 0 {
+		t.Fatalf("Wanted an unused address dark")
+	}
+}
+
+func TestLcov(t *testing.T) {
+	// setup
+	source := "push constant 2\n//#asm\n@SKIP\n0;JMP\n//#endasm\npush constant 3\n//#asm\n(SKIP)\n//#endasm\npop temp 0\n"
+	var p profiler
+	err := translateStream(strings.NewReader(source), Options{}, func(instr *Instruction) error {
+		p.add("Main.vm", instr)
+		return nil
+	})
+	check(err)
+	_, err = p.run(1000)
+	check(err)
+	var lcov, summary strings.Builder
+	// test
+	check(p.writeLcov(&lcov))
+	check(p.writeCoverage(&summary))
+	// assert
+	want := "TN:\nSF:Main.vm\nDA:1,1\nDA:2,1\nDA:6,0\nDA:10,1\nLF:4\nLH:3\nend_of_record\n"
+	if lcov.String() != want {
+		t.Fatalf("Wanted tracefile\n%v\ngot\n%v", want, lcov.String())
+	}
+	if summary.String() != "Main.vm: 3 of 4 lines run (75.0%)\n" {
+		t.Fatalf("Unexpected summary %q", summary.String())
+	}
+	if rows := p.coverageTable().rows; !reflect.DeepEqual(rows, [][]any{{"Main.vm", 4, 3, 75.0}}) {
+		t.Fatalf("Unexpected coverage table %v", rows)
+	}
+}
+
+func TestWatchpoints(t *testing.T) {
+	// setup
+	source := "push constant 3000\npop pointer 0\npush constant 3000\npop pointer 0\npush constant 3010\npop pointer 0\n"
+	var p profiler
+	err := translateStream(strings.NewReader(source), Options{}, func(instr *Instruction) error {
+		p.add("Main.vm", instr)
+		return nil
+	})
+	check(err)
+	m, err := p.machine()
+	check(err)
+	var watched watchFlags
+	check(watched.Set("this"))
+	w := newWatchpoints(m, watched)
+	m.Watch = w.watch
+	// test
+	var hit *watchHit
+	pc := 0
+	for !m.Halted() && hit == nil {
+		pc = m.PC
+		check(m.Step())
+		hit = w.take()
+	}
+	// assert
+	if hit == nil {
+		t.Fatalf("Expected the change to THIS caught")
+	}
+	if got := hit.describe(&p, pc); got != "RAM[3] (THIS) changed from 3000 to 3010 at Main.vm:6: pop pointer 0" {
+		t.Fatalf("Unexpected watchpoint %q", got)
+	}
+	if err := watched.Set("16384x"); err == nil {
+		t.Fatalf("Expected %q produce err", "16384x")
+	}
+}
+
+func TestDifferential(t *testing.T) {
+	// setup
+	var programs [][]sourceFile
+	for _, test := range courseTests {
+		name := filepath.Base(test)
+		text, err := os.ReadFile(filepath.Join("test_files", test, name+".vm"))
+		check(err)
+		programs = append(programs, []sourceFile{{name + ".vm", string(text)}})
+	}
+	programs = append(programs, []sourceFile{
+		{"A.vm", "push constant 5\npop static 1\npush constant 3031\npop pointer 1\npush static 1\npop that 2\n"},
+		{"B.vm", "push constant 9\npush constant 4\npop static 1\npop static 0\npush static 1\npush static 0\nsub\n"},
+	})
+	for _, program := range programs {
+		// test
+		err := differentialTest(program, Options{}, 100000)
+		// assert
+		if err != nil {
+			t.Fatalf("%v: %v", program[0].name, err)
+		}
+	}
+
+	// setup
+	v := newVMInterpreter()
+	nodes, err := ParseNodes(strings.NewReader("push constant 7\npush constant 2\nsub\npop local 1\n"), "Main", Options{})
+	check(err)
+	// test
+	check(Walk(nodes, v))
+	// assert
+	if v.RAM[301] != 5 || v.RAM[0] != 256 {
+		t.Fatalf("Wanted 7-2 popped to local 1, got %v with SP %v", v.RAM[301], v.RAM[0])
+	}
+	if err := differentialTest([]sourceFile{{"Main.vm", "//#asm\n@1\n//#endasm\n"}}, Options{}, 100); err == nil {
+		t.Fatalf("Expected inline assembly produce err")
+	}
+}
+
+func TestCompiledInterpreter(t *testing.T) {
+	// setup
+	outside := "push constant 5\npop static 3\npush constant 32000\npop pointer 1\npush static 3\npop that 1000\n"
+	sources := []string{syntheticProgram(1000), outside}
+	for _, source := range sources {
+		prog, err := BuildIR([]sourceFile{{"Main.vm", source}}, Options{})
+		check(err)
+		walked, compiled := newVMInterpreter(), newVMInterpreter()
+		// test
+		walkErr := prog.Walk(walked)
+		err = compiled.compile(prog).run(compiled)
+		// assert
+		if fmt.Sprint(err) != fmt.Sprint(walkErr) || (source == outside && err == nil) {
+			t.Fatalf("Wanted error %v, got %v", walkErr, err)
+		}
+		if walked.RAM != compiled.RAM || !reflect.DeepEqual(walked.statics, compiled.statics) {
+			t.Fatalf("Expected compiling to leave the memory interpreting does")
+		}
+	}
+}
+
+// Interpret a program over and over, from the course's starting state each
+// time, with run
+func benchmarkInterpreter(b *testing.B, run func(v *vmInterpreter, prog *IRProgram) func() error) {
+	prog, err := BuildIR([]sourceFile{{"Main.vm", syntheticProgram(10000)}}, Options{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	v := newVMInterpreter()
+	step := run(v, prog)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		copy(v.RAM[:], courseRAM)
+		if err := step(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkInterpreterWalk(b *testing.B) {
+	benchmarkInterpreter(b, func(v *vmInterpreter, prog *IRProgram) func() error {
+		return func() error { return prog.Walk(v) }
+	})
+}
+
+func BenchmarkInterpreterCompiled(b *testing.B) {
+	benchmarkInterpreter(b, func(v *vmInterpreter, prog *IRProgram) func() error {
+		compiled := v.compile(prog)
+		return func() error { return compiled.run(v) }
+	})
+}
+
+// A random program of push, pop, add and sub on the segments that don't move,
+// popping whatever it leaves so the stack ends empty. Returns the program,
+// the addresses it pops to and how deep the stack goes.
+func randomVMProgram(r *rand.Rand, length int) (string, map[int]bool, int) {
+	bases := map[string]int{"local": 300, "argument": 400, "this": 3000, "that": 3010, "temp": 5}
+	segments := []string{"local", "argument", "this", "that", "temp", "static"}
+	var b strings.Builder
+	targets := map[int]bool{}
+	depth, deepest := 0, 0
+	pop := func() {
+		segment := segments[r.Intn(len(segments))]
+		index := r.Intn(8)
+		if segment != "static" {
+			targets[bases[segment]+index] = true
+		}
+		fmt.Fprintf(&b, "pop %v %d\n", segment, index)
+		depth--
+	}
+	for i := 0; i < length; i++ {
+		switch k := r.Intn(4); {
+		case k == 0 || depth == 0:
+			if r.Intn(2) == 0 {
+				fmt.Fprintf(&b, "push %v %d\n", segments[r.Intn(len(segments))], r.Intn(8))
+			} else {
+				fmt.Fprintf(&b, "push constant %d\n", r.Intn(32768))
+			}
+			depth++
+			deepest = max(deepest, depth)
+		case k == 1 && depth >= 2:
+			fmt.Fprintf(&b, "%v\n", []string{"add", "sub"}[r.Intn(2)])
+			depth--
+		default:
+			pop()
+		}
+	}
+	for depth > 0 {
+		pop()
+	}
+	return b.String(), targets, deepest
+}
+
+func TestRandomProgramProperties(t *testing.T) {
+	r := rand.New(rand.NewSource(878))
+	for n := 0; n < 300; n++ {
+		// setup
+		source, targets, deepest := randomVMProgram(r, 1+r.Intn(40))
+		for level := 0; level <= 2; level++ {
+			pm, _ := newPassManager(level, nil)
+			opts := Options{Passes: pm}
+			var stray []int
+			watch := func(addr int, write bool) {
+				stack := addr >= 256 && addr < 256+deepest
+				if write && addr != 0 && !stack && (addr < 13 || addr > 255) && !targets[addr] {
+					stray = append(stray, addr)
+				}
+			}
+
+			// test
+			m := runVMWatched(t, source, opts, watch)
+			again := runVM(t, source, opts)
+
+			// assert
+			if m.RAM[0] != 256 {
+				t.Fatalf("-O%d: Wanted SP restored to 256, got %v\n%v", level, m.RAM[0], source)
+			}
+			for i, base := range courseRAM[1:] {
+				if m.RAM[i+1] != base {
+					t.Fatalf("-O%d: Wanted RAM[%d] left at %v, got %v\n%v", level, i+1, base, m.RAM[i+1], source)
+				}
+			}
+			if len(stray) > 0 {
+				t.Fatalf("-O%d: Expected writes only to the stack and popped addresses, got %v\n%v", level, stray, source)
+			}
+			if m.RAM != again.RAM || m.Cycles != again.Cycles {
+				t.Fatalf("-O%d: Wanted the same result from each run\n%v", level, source)
+			}
+		}
+		if err := differentialTest([]sourceFile{{"Main.vm", source}}, Options{}, 100000); err != nil {
+			t.Fatalf("%v\n%v", err, source)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Pointers holding the base address of each segment addressed through one
+var segmentPointers = map[string]string{"local": "LCL", "argument": "ARG", "this": "THIS", "that": "THAT"}
+
+// A plain-English description of what the unoptimised Hack assembly for
+// instr does, for -explain. Returns "" for lines that aren't commands.
+func explainInstruction(instr *Instruction) string {
+	switch instr.operation {
+	case "push", "pop":
+		return explainPushPop(instr)
+	case "add":
+		return "decrements SP, adds the value on top of the stack to the one below it and leaves the sum in its place"
+	case "sub":
+		return "decrements SP, subtracts the value on top of the stack from the one below it and leaves the difference in its place"
+	case "mul":
+		return "decrements SP, multiplies the value below the top of the stack by the one on top, adding the first shifted left for each bit set in the second, and leaves the product in its place"
+	case "div":
+		return "decrements SP, divides the value below the top of the stack by the one on top, subtracting doubled multiples of it, and leaves the quotient in its place, rounded towards zero"
+	case "mod":
+		return "decrements SP, divides the value below the top of the stack by the one on top, subtracting doubled multiples of it, and leaves the remainder in its place"
+	case "shiftleft":
+		return "doubles the value on top of the stack, shifting it left a bit"
+	case "shiftright":
+		return "shifts the value on top of the stack right a bit, keeping its sign, by setting each bit of the result whose next bit up is set"
+	case "asm":
+		return "copies the assembly written in the VM code as is"
+	}
+	return ""
+}
+
+func explainPushPop(instr *Instruction) string {
+	// Where the value goes to or comes from
+	var place string
+	i := instr.value
+	switch seg := instr.segment; seg {
+	case "constant":
+		return fmt.Sprintf("stores %d at the address in SP, on top of the stack, and increments SP", i)
+	case "local", "argument", "this", "that":
+		if instr.operation == "push" {
+			return fmt.Sprintf("computes %v+%d, pushes the value at that address onto the stack and increments SP", segmentPointers[seg], i)
+		}
+		return fmt.Sprintf("computes %v+%d, keeps it in %v, decrements SP and stores the value on top of the stack at that address", segmentPointers[seg], i, strings.TrimPrefix(scratchRegister, "@"))
+	case "temp":
+		place = fmt.Sprintf("in RAM[%d] (temp %d)", 5+i, i)
+	case "pointer":
+		moved := map[int]string{0: "this", 1: "that"}[i]
+		place = fmt.Sprintf("in %v, which moves the %v segment", thisThat(i), moved)
+		if instr.operation == "push" {
+			place = fmt.Sprintf("in %v (the base of the %v segment)", thisThat(i), moved)
+		}
+	case "static":
+		unit := instr.unit
+		if unit == "" {
+			unit = defaultUnit
+		}
+		place = fmt.Sprintf("in the variable %v.%d", unit, i)
+	}
+	if instr.operation == "push" {
+		return fmt.Sprintf("pushes the value %v onto the stack and increments SP", place)
+	}
+	return fmt.Sprintf("decrements SP and stores the value on top of the stack %v", place)
+}
+
+// Comments on what instr's assembly does, for -comments=teach: its goal,
+// from the comment opening the template it was rendered from, the registers
+// and symbols its lines use, and its effect on the stack
+func teachComments(instr *Instruction) []string {
+	var comments []string
+	if doc := snippetDoc(instr.snippet); doc != "" {
+		comments = append(comments, "goal: "+doc)
+	}
+	registers, symbols := asmOperands(instr.translatedLines)
+	if len(registers) > 0 {
+		comments = append(comments, "registers: "+strings.Join(registers, ", "))
+	}
+	if len(symbols) > 0 {
+		comments = append(comments, "symbols: "+strings.Join(symbols, ", "))
+	}
+	switch instr.operation {
+	case "push", "pop", "add", "sub", "mul", "div", "mod", "shiftleft", "shiftright":
+		pops, pushes := stackEffect(instr)
+		comments = append(comments, fmt.Sprintf("stack: pops %d, pushes %d", pops, pushes))
+	}
+	return comments
+}
+
+// The CPU registers, A and D, that Hack assembly lines use and the symbols
+// they load into A, each in the order first seen
+func asmOperands(lines []string) (registers, symbols []string) {
+	var usesA, usesD bool
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || strings.HasPrefix(line, "//") || strings.HasPrefix(line, "("):
+		case strings.HasPrefix(line, "@"):
+			usesA = true
+			symbol := line[1:]
+			if _, err := strconv.Atoi(symbol); err != nil && !slices.Contains(symbols, symbol) {
+				symbols = append(symbols, symbol)
+			}
+		default:
+			code, _, _ := strings.Cut(line, ";")
+			usesA = usesA || strings.ContainsAny(code, "AM")
+			usesD = usesD || strings.Contains(code, "D")
+		}
+	}
+	if usesA {
+		registers = append(registers, "A")
+	}
+	if usesD {
+		registers = append(registers, "D")
+	}
+	return registers, symbols
+}
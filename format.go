@@ -0,0 +1,44 @@
+package main
+
+import "strings"
+
+// Rewrite VM code in a standard layout: the words of each command separated
+// by single spaces, trailing comments a space after the command, full-line
+// comments and directives unindented, no trailing whitespace and no more than
+// one blank line in a row. Lines of inline assembly are kept as written,
+// apart from trailing whitespace.
+func formatVM(source string) string {
+	var b strings.Builder
+	blank := false
+	inAsm := false
+	for _, line := range strings.Split(strings.ReplaceAll(source, "\r\n", "\n"), "\n") {
+		line = strings.TrimRight(line, " \t")
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case inAsm:
+			inAsm = trimmed != asmBlockEnd
+			if !inAsm {
+				line = trimmed
+			}
+		case trimmed == "":
+			blank = b.Len() > 0
+			continue
+		case strings.HasPrefix(trimmed, "//"):
+			inAsm = trimmed == asmBlockStart
+			line = trimmed
+		default:
+			code, comment, hasComment := strings.Cut(trimmed, "//")
+			line = strings.Join(strings.Fields(code), " ")
+			if hasComment {
+				line += " //" + comment
+			}
+		}
+		if blank {
+			b.WriteString("\n")
+			blank = false
+		}
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+	return b.String()
+}
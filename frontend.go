@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A Frontend compiles source files in a higher level language, such as Jack,
+// down to VM code so they can be translated in the same run
+type Frontend interface {
+	// Extension of the source files the frontend compiles, e.g. ".jack"
+	Extension() string
+
+	// Compile the source files, returning the paths of the .vm files written
+	Compile(paths []string) ([]string, error)
+}
+
+// Frontends by the source file extension they compile
+var frontends = map[string]Frontend{}
+
+// Register a frontend used by `build` for files with its extension, replacing
+// any frontend already registered for that extension
+func RegisterFrontend(f Frontend) {
+	frontends[f.Extension()] = f
+}
+
+// A frontend that runs an external compiler once per source file, expecting
+// it to write a .vm file of the same name next to the source. This suits the
+// course's JackCompiler, which lives outside this module.
+type ExecFrontend struct {
+	Ext     string   // Source extension, e.g. ".jack"
+	Command string   // Compiler executable
+	Args    []string // Arguments before the source path
+}
+
+func (f ExecFrontend) Extension() string {
+	return f.Ext
+}
+
+func (f ExecFrontend) Compile(paths []string) ([]string, error) {
+	var vmPaths []string
+	for _, path := range paths {
+		cmd := exec.Command(f.Command, append(f.Args, path)...)
+		cmd.Stdout = os.Stderr // keep stdout for our own output
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("%v %v: %v", f.Command, path, err)
+		}
+
+		vmPath := strings.TrimSuffix(path, f.Ext) + ".vm"
+		if _, err := os.Stat(vmPath); err != nil {
+			return nil, fmt.Errorf("%v didn't produce %v", f.Command, vmPath)
+		}
+		vmPaths = append(vmPaths, vmPath)
+	}
+	return vmPaths, nil
+}
+
+// Sorted paths of the files in dir with the given extension
+func filesWithExt(dir, ext string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, e := range entries {
+		if !e.IsDir() && filepath.Ext(e.Name()) == ext {
+			paths = append(paths, filepath.Join(dir, e.Name()))
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// The hand-written .asm files in dir to copy into the output, leaving out
+// output itself and any Foo.asm translated from one of vmPaths
+func asmFragments(dir, output string, vmPaths []string) ([]string, error) {
+	paths, err := filesWithExt(dir, ".asm")
+	if err != nil {
+		return nil, err
+	}
+	generated := map[string]bool{filepath.Clean(output): true}
+	for _, path := range vmPaths {
+		generated[strings.TrimSuffix(path, ".vm")+".asm"] = true
+	}
+	var fragments []string
+	for _, path := range paths {
+		if !generated[path] {
+			fragments = append(fragments, path)
+		}
+	}
+	return fragments, nil
+}
+
+// Run each registered frontend over its source files in dir, then return
+// every .vm file in dir, sorted, ready for translation
+func compileDir(dir string) ([]string, error) {
+	var exts []string
+	for ext := range frontends {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+
+	for _, ext := range exts {
+		paths, err := filesWithExt(dir, ext)
+		if err != nil {
+			return nil, err
+		}
+		if len(paths) == 0 {
+			continue
+		}
+		if _, err := frontends[ext].Compile(paths); err != nil {
+			return nil, err
+		}
+	}
+
+	vmPaths, err := filesWithExt(dir, ".vm")
+	if err == nil && len(vmPaths) == 0 {
+		err = fmt.Errorf("no .vm files in %v", dir)
+	}
+	return vmPaths, err
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Compiles .fake files by copying them to .vm files
+type copyFrontend struct{}
+
+func (copyFrontend) Extension() string { return ".fake" }
+
+func (copyFrontend) Compile(paths []string) ([]string, error) {
+	var vmPaths []string
+	for _, path := range paths {
+		text, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		vmPath := strings.TrimSuffix(path, ".fake") + ".vm"
+		if err := os.WriteFile(vmPath, text, 0o644); err != nil {
+			return nil, err
+		}
+		vmPaths = append(vmPaths, vmPath)
+	}
+	return vmPaths, nil
+}
+
+func TestCompileDir(t *testing.T) {
+	// setup
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "Main.fake"), []byte("push constant 1"), 0o644)
+	os.WriteFile(filepath.Join(dir, "Lib.vm"), []byte("add"), 0o644)
+	os.WriteFile(filepath.Join(dir, "README"), []byte("not code"), 0o644)
+	RegisterFrontend(copyFrontend{})
+	defer delete(frontends, ".fake")
+	// test
+	vmPaths, err := compileDir(dir)
+	// assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(dir, "Lib.vm"), filepath.Join(dir, "Main.vm")}
+	if strings.Join(vmPaths, ",") != strings.Join(want, ",") {
+		t.Fatalf("Wanted %v, got %v", want, vmPaths)
+	}
+}
@@ -0,0 +1,112 @@
+//go:build !js
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/schallis/vm-translator/rpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Assembly is buffered up to this many bytes before being streamed back
+const grpcChunkSize = 32 << 10
+
+// Implements the Translator service defined in rpc/translator.proto
+type grpcServer struct {
+	rpc.UnimplementedTranslatorServer
+	opts Options // Translating every source
+}
+
+func newGRPCServer(opts Options) *grpc.Server {
+	s := grpc.NewServer()
+	rpc.RegisterTranslatorServer(s, grpcServer{opts: opts})
+	return s
+}
+
+// Convert a translation error to a gRPC status
+func grpcError(err error) error {
+	var srcErr *SourceError
+	switch {
+	case errors.As(err, &srcErr):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	}
+	return err
+}
+
+func (g grpcServer) TranslateStream(stream rpc.Translator_TranslateStreamServer) error {
+	ctx := stream.Context()
+
+	// Feed the received chunks to the translator as one continuous source
+	pr, pw := io.Pipe()
+	go func() {
+		for {
+			chunk, err := stream.Recv()
+			if err == io.EOF {
+				pw.Close()
+				return
+			} else if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if _, err := io.WriteString(pw, chunk.Source); err != nil {
+				return // translation has stopped
+			}
+		}
+	}()
+	defer pr.Close()
+
+	var b strings.Builder
+	aw := newAsmWriter(&b, g.opts)
+	flush := func() error {
+		if b.Len() == 0 {
+			return nil
+		}
+		err := stream.Send(&rpc.AsmChunk{Asm: b.String()})
+		b.Reset()
+		return err
+	}
+	err := translateStream(pr, g.opts, func(instr *Instruction) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		aw.writeInstruction(instr)
+		if b.Len() >= grpcChunkSize {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		aw.finish()
+		err = flush()
+	}
+	return grpcError(err)
+}
+
+func (g grpcServer) TranslateProject(ctx context.Context, project *rpc.Project) (*rpc.ProjectResult, error) {
+	var sources []sourceFile
+	for _, f := range project.Files {
+		sources = append(sources, sourceFile{name: f.Name, text: f.Source})
+	}
+	resp, err := translateSources(ctx, sources, g.opts)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	result := &rpc.ProjectResult{Asm: resp.Asm}
+	for _, d := range resp.Diagnostics {
+		result.Diagnostics = append(result.Diagnostics, &rpc.Diagnostic{
+			File:    d.File,
+			Line:    int32(d.Line),
+			Message: d.Message,
+		})
+	}
+	return result, nil
+}
@@ -0,0 +1,114 @@
+//go:build !js
+
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/schallis/vm-translator/rpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// Start a server on an in-memory listener and connect a client to it
+func newGRPCTestClient(t *testing.T) rpc.TranslatorClient {
+	lis := bufconn.Listen(1 << 20)
+	s := newGRPCServer(Options{})
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return rpc.NewTranslatorClient(conn)
+}
+
+func TestGRPCTranslateStream(t *testing.T) {
+	// setup
+	client := newGRPCTestClient(t)
+	stream, err := client.TranslateStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// test: chunks split commands part way through
+	for _, chunk := range []string{"push cons", "tant 7\npush constant 8\na", "dd\n"} {
+		if err := stream.Send(&rpc.SourceChunk{Source: chunk}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stream.CloseSend()
+	var asm strings.Builder
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		asm.WriteString(chunk.Asm)
+	}
+	// assert
+	want, _ := translateString("push constant 7\npush constant 8\nadd\n", Options{})
+	if asm.String() != want {
+		t.Fatalf("Streamed assembly differs, got:\n%v\nwanted:\n%v", asm.String(), want)
+	}
+}
+
+func TestGRPCTranslateStreamError(t *testing.T) {
+	// setup
+	client := newGRPCTestClient(t)
+	stream, _ := client.TranslateStream(context.Background())
+	// test
+	stream.Send(&rpc.SourceChunk{Source: "push constant 7\nbogus\n"})
+	stream.CloseSend()
+	var err error
+	for err == nil {
+		_, err = stream.Recv()
+	}
+	// assert
+	if status.Code(err) != codes.InvalidArgument || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("Wanted InvalidArgument on line 2, got %v", err)
+	}
+}
+
+func TestGRPCTranslateProject(t *testing.T) {
+	// setup
+	client := newGRPCTestClient(t)
+	project := &rpc.Project{Files: []*rpc.SourceFile{
+		{Name: "A.vm", Source: "push constant 1"},
+		{Name: "B.vm", Source: "pop local 0\npop nowhere 1"},
+	}}
+	// test
+	result, err := client.TranslateProject(context.Background(), project)
+	// assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Diagnostics) != 1 || result.Diagnostics[0].File != "B.vm" || result.Diagnostics[0].Line != 2 {
+		t.Fatalf("Wanted a diagnostic for B.vm line 2, got %v", result.Diagnostics)
+	}
+
+	// test: an expired deadline is propagated to the server
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	_, err = client.TranslateProject(ctx, project)
+	// assert
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("Wanted DeadlineExceeded, got %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// The heap, where the OS's Memory.alloc hands out blocks
+const (
+	heapBase = 2048
+	heapEnd  = traceCursor - 1 // Last word of the heap, below the trace region
+)
+
+// Most uninitialised reads listed in a heap report
+const maxUninitReads = 10
+
+// Watches a machine's accesses to the heap, tracking which words are in use.
+// Without the allocator's own bookkeeping a word counts as in use once it has
+// been written.
+type heapTracker struct {
+	written     [heapEnd - heapBase + 1]bool
+	inUse       int // Words written so far
+	peak        int // Highest address written, 0 if none
+	uninitReads int // Reads of words never written
+	firstReads  []int
+}
+
+// Record an access by the machine, for use as Machine.Watch
+func (h *heapTracker) watch(addr int, write bool) {
+	if addr < heapBase || addr > heapEnd {
+		return
+	}
+	i := addr - heapBase
+	switch {
+	case write && !h.written[i]:
+		h.written[i] = true
+		h.inUse++
+		h.peak = max(h.peak, addr)
+	case !write && !h.written[i]:
+		h.uninitReads++
+		if len(h.firstReads) < maxUninitReads {
+			h.firstReads = append(h.firstReads, addr)
+		}
+	}
+}
+
+// Runs of words below the peak never written, as (start, length) pairs
+func (h *heapTracker) gaps() [][2]int {
+	var gaps [][2]int
+	for addr := heapBase; addr < h.peak; addr++ {
+		if h.written[addr-heapBase] {
+			continue
+		}
+		start := addr
+		for addr < h.peak && !h.written[addr-heapBase] {
+			addr++
+		}
+		gaps = append(gaps, [2]int{start, addr - start})
+	}
+	return gaps
+}
+
+// How much of the heap was used, as a table of one row
+func (h *heapTracker) table() reportTable {
+	span := h.peak - heapBase + 1
+	free := 0
+	gaps := h.gaps()
+	for _, g := range gaps {
+		free += g[1]
+	}
+	used, fragmented := 0.0, 0.0
+	if h.peak > 0 {
+		used = 100 * float64(span) / float64(heapEnd-heapBase+1)
+		fragmented = 100 * float64(free) / float64(span)
+	}
+	return reportTable{
+		name:     "heap",
+		headings: []string{"in use", "peak", "% of heap", "gaps", "free", "% fragmented", "uninitialised reads"},
+		keys:     []string{"in_use", "peak", "percent_of_heap", "gaps", "free", "percent_fragmented", "uninitialised_reads"},
+		rows:     [][]any{{h.inUse, h.peak, used, len(gaps), free, fragmented, h.uninitReads}},
+	}
+}
+
+// Write how much of the heap was used, how fragmented it is and any reads of
+// memory that was never written, which usually means a block was used
+// without being allocated or past its end
+func (h *heapTracker) report(w io.Writer) error {
+	var b strings.Builder
+	if h.peak == 0 {
+		b.WriteString("heap: never written\n")
+	} else {
+		span := h.peak - heapBase + 1
+		gaps := h.gaps()
+		free := 0
+		for _, g := range gaps {
+			free += g[1]
+		}
+		fmt.Fprintf(&b, "heap: %d words in use, up to %d (%.1f%% of the heap)\n", h.inUse, h.peak, 100*float64(span)/float64(heapEnd-heapBase+1))
+		fmt.Fprintf(&b, "heap: %d free gaps below the peak, %d words (%.1f%% fragmented)\n", len(gaps), free, 100*float64(free)/float64(span))
+	}
+	if h.uninitReads > 0 {
+		fmt.Fprintf(&b, "heap: %d reads of words never written, first at", h.uninitReads)
+		for _, addr := range h.firstReads {
+			fmt.Fprintf(&b, " %d", addr)
+		}
+		b.WriteString("\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
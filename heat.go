@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"strings"
+)
+
+// Counts the reads and writes of each RAM address as a machine runs
+type heatMap struct {
+	reads, writes [hackRAMSize]int
+}
+
+// Record an access by the machine, for use as Machine.Watch
+func (h *heatMap) watch(addr int, write bool) {
+	if write {
+		h.writes[addr]++
+	} else {
+		h.reads[addr]++
+	}
+}
+
+// Name of the part of memory an address is in
+func ramRegion(addr int) string {
+	switch {
+	case addr <= 4:
+		return []string{"SP", "LCL", "ARG", "THIS", "THAT"}[addr]
+	case addr <= 12:
+		return "temp"
+	case addr <= 15:
+		return "scratch"
+	case addr < 256:
+		return "static"
+	case addr < heapBase:
+		return "stack"
+	case addr <= heapEnd:
+		return "heap"
+	case addr < screenBase:
+		return "trace"
+	case addr < keyboardAddr:
+		return "screen"
+	}
+	return "keyboard"
+}
+
+// Write the counts of every address accessed as CSV, with the part of memory
+// it is in so accesses where a program shouldn't be stand out
+func (h *heatMap) writeCSV(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("address,region,reads,writes\n")
+	for addr := range h.reads {
+		if h.reads[addr] > 0 || h.writes[addr] > 0 {
+			fmt.Fprintf(&b, "%d,%v,%d,%d\n", addr, ramRegion(addr), h.reads[addr], h.writes[addr])
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Addresses to each row of the heat map image
+const heatRowWidth = 128
+
+// Write the accesses as a PNG with a pixel to each address, heatRowWidth to a
+// row, from black for none through red to yellow for the most. Brightness
+// follows the log of the count so rarely used addresses still show.
+func (h *heatMap) writePNG(w io.Writer) error {
+	most := 0
+	for addr := range h.reads {
+		most = max(most, h.reads[addr]+h.writes[addr])
+	}
+	rows := (hackRAMSize + heatRowWidth - 1) / heatRowWidth
+	img := image.NewRGBA(image.Rect(0, 0, heatRowWidth, rows))
+	for addr := range h.reads {
+		heat := 0.0
+		if n := h.reads[addr] + h.writes[addr]; n > 0 {
+			heat = math.Log1p(float64(n)) / math.Log1p(float64(most))
+		}
+		c := color.RGBA{A: 255}
+		if heat > 0 {
+			c.R = uint8(64 + 191*math.Min(1, 2*heat))
+			c.G = uint8(255 * math.Max(0, 2*heat-1))
+		}
+		img.SetRGBA(addr%heatRowWidth, addr/heatRowWidth, c)
+	}
+	return png.Encode(w, img)
+}
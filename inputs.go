@@ -0,0 +1,138 @@
+//go:build !js
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Largest file fetched for a remote input, in bytes
+const maxRemoteSize = 10 << 20
+
+// Fetches remote inputs, giving up on one after 30 seconds. Tests replace it
+// with their server's client.
+var remoteClient = &http.Client{Timeout: 30 * time.Second}
+
+// Whether an input names a file to download rather than a local path. Only
+// https is fetched, so what's translated can't be altered in transit.
+func isRemote(input string) bool {
+	return strings.HasPrefix(input, "https://")
+}
+
+// Name of the unit a remote input translates to: the last element of its
+// path without the extension, e.g. SimpleAdd for .../SimpleAdd.vm
+func remoteUnitName(input string) string {
+	u, err := url.Parse(input)
+	if err != nil {
+		return defaultUnit
+	}
+	name := strings.TrimSuffix(path.Base(u.Path), path.Ext(u.Path))
+	if name == "" || name == "." || name == "/" {
+		return defaultUnit
+	}
+	return name
+}
+
+// Download each remote input into dir and unpack each zip of a project there,
+// leaving other local paths as they are. An archive's .vm files take its
+// place in path order.
+func prepareInputs(inputs []string, dir string) ([]string, error) {
+	var paths []string
+	for i, input := range inputs {
+		var data []byte
+		var err error
+		switch {
+		case strings.HasPrefix(input, "http://"):
+			return nil, fmt.Errorf("%v: plain http isn't supported, use an https:// URL", input)
+		case isRemote(input):
+			log.Printf("Fetching %v", input)
+			data, err = fetchRemote(input)
+		case filepath.Ext(input) == ".zip":
+			data, err = os.ReadFile(input)
+		default:
+			paths = append(paths, input)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Each input gets its own directory so files of the same name from
+		// different places don't collide
+		into := filepath.Join(dir, fmt.Sprint(i))
+		if err := os.Mkdir(into, 0o755); err != nil {
+			return nil, err
+		}
+		if isRemote(input) && !bytes.HasPrefix(data, []byte("PK\x03\x04")) {
+			name := filepath.Join(into, remoteUnitName(input)+".vm")
+			if err := os.WriteFile(name, data, 0o644); err != nil {
+				return nil, err
+			}
+			paths = append(paths, name)
+			continue
+		}
+		unpacked, err := unpackZip(data, into)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", input, err)
+		}
+		paths = append(paths, unpacked...)
+	}
+	return paths, nil
+}
+
+// Write the .vm files of a zip archive into dir, returning their paths in
+// the order they are translated
+func unpackZip(data []byte, dir string) ([]string, error) {
+	sources, err := readZipSources(data)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, src := range sources {
+		// Keep the file's path in the archive. readZipSources has made sure
+		// no two files share a name, as a unit is named after its file.
+		rel := filepath.FromSlash(path.Clean(src.name))
+		if !filepath.IsLocal(rel) {
+			return nil, fmt.Errorf("%v is outside the archive", src.name)
+		}
+		name := filepath.Join(dir, rel)
+		if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(name, []byte(src.text), 0o644); err != nil {
+			return nil, err
+		}
+		paths = append(paths, name)
+	}
+	return paths, nil
+}
+
+// Fetch the body of a remote input, failing on anything but a 200
+func fetchRemote(input string) ([]byte, error) {
+	resp, err := remoteClient.Get(input)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %v: %v", input, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxRemoteSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxRemoteSize {
+		return nil, fmt.Errorf("fetching %v: larger than %d bytes", input, maxRemoteSize)
+	}
+	return data, nil
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/schallis/vm-translator/machine"
+)
+
+// Runs VM commands directly on a Hack memory image, without translating
+// them, so the effect of generated code can be checked against it. Statics
+// get addresses from RAM[16] in the order they're first used, as the
+// assembler allocates them.
+type vmInterpreter struct {
+	RAM     machine.RAM
+	statics map[string]int
+}
+
+func newVMInterpreter() *vmInterpreter {
+	v := &vmInterpreter{statics: map[string]int{}}
+	copy(v.RAM[:], courseRAM)
+	return v
+}
+
+// Address of a segment's word, allocating statics as they're first seen
+func (v *vmInterpreter) address(n *PushPop) (int, error) {
+	if n.Segment != "static" {
+		seg, err := v.RAM.Segment(n.Segment)
+		if err != nil {
+			return 0, err
+		}
+		return seg.Address(n.Index)
+	}
+	unit := n.Unit
+	if unit == "" {
+		unit = defaultUnit
+	}
+	name := fmt.Sprintf("%v.%d", unit, n.Index)
+	addr, ok := v.statics[name]
+	if !ok {
+		addr = machine.StaticBase + len(v.statics)
+		v.statics[name] = addr
+	}
+	if addr >= machine.Size {
+		return 0, fmt.Errorf("%v %d is RAM[%d], outside memory", n.Segment, n.Index, addr)
+	}
+	return addr, nil
+}
+
+// Check SP is in memory before a command moves it
+func (v *vmInterpreter) checkSP() error {
+	if sp := int(uint16(v.RAM[machine.SP])); sp < 1 || sp >= machine.Size {
+		return fmt.Errorf("SP %d is outside memory", sp)
+	}
+	return nil
+}
+
+func (v *vmInterpreter) VisitPushPop(n *PushPop) error {
+	if err := v.checkSP(); err != nil {
+		return err
+	}
+	stack := v.RAM.Stack()
+	switch {
+	case n.Segment == "constant" && n.Pop:
+		return errors.New("can't pop to constant")
+	case n.Segment == "constant":
+		return stack.Push(int16(n.Index))
+	}
+	// Address first, as popping to pointer changes THIS or THAT
+	addr, err := v.address(n)
+	if err != nil {
+		return err
+	}
+	if !n.Pop {
+		return stack.Push(v.RAM[addr])
+	}
+	x, err := stack.Pop()
+	if err != nil {
+		return err
+	}
+	v.RAM[addr] = x
+	return nil
+}
+
+func (v *vmInterpreter) VisitArithmetic(n *Arithmetic) error {
+	if err := v.checkSP(); err != nil {
+		return err
+	}
+	stack := v.RAM.Stack()
+	y, err := stack.Pop()
+	if err != nil {
+		return err
+	}
+	switch n.Op {
+	case "shiftleft":
+		return stack.Push(y << 1)
+	case "shiftright":
+		return stack.Push(y >> 1)
+	}
+	x, err := stack.Pop()
+	if err != nil {
+		return err
+	}
+	switch n.Op {
+	case "add":
+		return stack.Push(x + y)
+	case "sub":
+		return stack.Push(x - y)
+	case "mul":
+		return stack.Push(x * y)
+	case "div", "mod":
+		if y == 0 {
+			return errors.New("division by zero")
+		}
+		if n.Op == "div" {
+			return stack.Push(x / y)
+		}
+		return stack.Push(x % y)
+	}
+	return fmt.Errorf("can't interpret %v", n.Op)
+}
+
+func (v *vmInterpreter) VisitInlineAsm(*InlineAsm) error {
+	return errors.New("inline assembly can't be interpreted")
+}
+
+// Run the commands of each source in turn, compiled to closures, accepting
+// the extensions to the language opts does
+func (v *vmInterpreter) run(sources []sourceFile, opts Options) error {
+	prog, err := BuildIR(sources, opts)
+	if err != nil {
+		return err
+	}
+	return v.compile(prog).run(v)
+}
+
+// A VM command compiled for an interpreter, deciding what it does once, when
+// it's compiled, rather than each time it runs
+type vmOp func(v *vmInterpreter) error
+
+// A program compiled to vmOps, with the node and file each came from to
+// locate their errors
+type compiledVM struct {
+	ops   []vmOp
+	nodes []Node
+	files []string
+}
+
+// Compile the program for v, which it must then be run with. Statics are
+// allocated as they're compiled, in the order they're first used, as with no
+// jumps the program runs in the order it's written.
+func (v *vmInterpreter) compile(prog *IRProgram) *compiledVM {
+	var c compiledVM
+	compiler := vmCompiler{v: v}
+	for _, fn := range prog.Functions {
+		for _, block := range fn.Blocks {
+			for _, node := range block.Nodes {
+				node.Accept(&compiler)
+				c.ops = append(c.ops, compiler.op)
+				c.nodes = append(c.nodes, node)
+				c.files = append(c.files, fn.File)
+			}
+		}
+	}
+	return &c
+}
+
+// Run the compiled program on v, stopping at the first error, which is
+// located at its node's file and line as with walking the IR
+func (c *compiledVM) run(v *vmInterpreter) error {
+	for i, op := range c.ops {
+		if err := op(v); err != nil {
+			pos := c.nodes[i].Position()
+			return &SourceError{File: c.files[i], Line: pos.Line, Source: pos.Source, Err: err}
+		}
+	}
+	return nil
+}
+
+// Compiles each node it visits to op, with the same effect as the
+// interpreter visiting it
+type vmCompiler struct {
+	v  *vmInterpreter
+	op vmOp
+}
+
+// An op failing with err, for commands that can only fail
+func failingOp(err error) vmOp {
+	return func(*vmInterpreter) error { return err }
+}
+
+func (c *vmCompiler) VisitPushPop(n *PushPop) error {
+	switch {
+	case n.Segment == "constant" && n.Pop:
+		c.op = func(v *vmInterpreter) error {
+			if err := v.checkSP(); err != nil {
+				return err
+			}
+			return errors.New("can't pop to constant")
+		}
+		return nil
+	case n.Segment == "constant":
+		x := int16(n.Index)
+		c.op = func(v *vmInterpreter) error {
+			if err := v.checkSP(); err != nil {
+				return err
+			}
+			return v.RAM.Stack().Push(x)
+		}
+		return nil
+	}
+
+	// The address, looked up as the command runs for segments with a pointer
+	var address func() (int, error)
+	if n.Segment == "static" {
+		addr, err := c.v.address(n)
+		address = func() (int, error) { return addr, err }
+	} else {
+		seg, err := c.v.RAM.Segment(n.Segment)
+		if err != nil {
+			c.op = failingOp(err)
+			return nil
+		}
+		index := n.Index
+		address = func() (int, error) { return seg.Address(index) }
+	}
+	if !n.Pop {
+		c.op = func(v *vmInterpreter) error {
+			if err := v.checkSP(); err != nil {
+				return err
+			}
+			addr, err := address()
+			if err != nil {
+				return err
+			}
+			return v.RAM.Stack().Push(v.RAM[addr])
+		}
+		return nil
+	}
+	c.op = func(v *vmInterpreter) error {
+		if err := v.checkSP(); err != nil {
+			return err
+		}
+		// Address first, as popping to pointer changes THIS or THAT
+		addr, err := address()
+		if err != nil {
+			return err
+		}
+		x, err := v.RAM.Stack().Pop()
+		if err != nil {
+			return err
+		}
+		v.RAM[addr] = x
+		return nil
+	}
+	return nil
+}
+
+func (c *vmCompiler) VisitArithmetic(n *Arithmetic) error {
+	var unary func(y int16) int16
+	var binary func(x, y int16) (int16, error)
+	switch n.Op {
+	case "shiftleft":
+		unary = func(y int16) int16 { return y << 1 }
+	case "shiftright":
+		unary = func(y int16) int16 { return y >> 1 }
+	case "add":
+		binary = func(x, y int16) (int16, error) { return x + y, nil }
+	case "sub":
+		binary = func(x, y int16) (int16, error) { return x - y, nil }
+	case "mul":
+		binary = func(x, y int16) (int16, error) { return x * y, nil }
+	case "div", "mod":
+		div := n.Op == "div"
+		binary = func(x, y int16) (int16, error) {
+			switch {
+			case y == 0:
+				return 0, errors.New("division by zero")
+			case div:
+				return x / y, nil
+			}
+			return x % y, nil
+		}
+	}
+
+	c.op = func(v *vmInterpreter) error {
+		if err := v.checkSP(); err != nil {
+			return err
+		}
+		stack := v.RAM.Stack()
+		y, err := stack.Pop()
+		if err != nil {
+			return err
+		}
+		if unary != nil {
+			return stack.Push(unary(y))
+		}
+		x, err := stack.Pop()
+		if err != nil {
+			return err
+		}
+		if binary == nil {
+			return fmt.Errorf("can't interpret %v", n.Op)
+		}
+		z, err := binary(x, y)
+		if err != nil {
+			return err
+		}
+		return stack.Push(z)
+	}
+	return nil
+}
+
+func (c *vmCompiler) VisitInlineAsm(n *InlineAsm) error {
+	c.op = func(v *vmInterpreter) error { return v.VisitInlineAsm(n) }
+	return nil
+}
+
+// Run a program both ways, interpreted and as the assembly generated at each
+// optimisation level, and compare the memory they finish with. Statics,
+// registers and the stack below SP should match exactly; the scratch
+// registers and anything above SP are free to differ.
+func differentialTest(sources []sourceFile, opts Options, maxCycles int) error {
+	v := newVMInterpreter()
+	if err := v.run(sources, opts); err != nil {
+		return err
+	}
+
+	for level := 0; level <= 2; level++ {
+		pm, _ := newPassManager(level, nil)
+		var asm strings.Builder
+		for _, src := range sources {
+			text, err := translateString(src.text, Options{Passes: pm, Unit: unitName(src.name), NegativeConstants: opts.NegativeConstants, Extended: opts.Extended})
+			if err != nil {
+				return fmt.Errorf("%v: %w", src.name, err)
+			}
+			asm.WriteString(text + "\n")
+		}
+		rom, _, vars, err := assembleSymbols(asm.String())
+		if err != nil {
+			return fmt.Errorf("-O%d: %w", level, err)
+		}
+		m := NewMachine(rom)
+		copy(m.RAM[:], courseRAM)
+		if err := m.Run(maxCycles); err != nil {
+			return fmt.Errorf("-O%d: %w", level, err)
+		}
+		sp := int(uint16(v.RAM[0]))
+		for addr := range v.RAM {
+			skip := (addr >= 13 && addr < 256) || (addr >= sp && addr < heapBase)
+			if !skip && m.RAM[addr] != v.RAM[addr] {
+				return fmt.Errorf("-O%d: RAM[%d] (%v) is %d, want %d as interpreted", level, addr, ramRegion(addr), m.RAM[addr], v.RAM[addr])
+			}
+		}
+		// Statics are compared by name, as passes may reorder their first use
+		for name, addr := range v.statics {
+			if got := m.RAM[vars[name]]; got != v.RAM[addr] {
+				return fmt.Errorf("-O%d: static %v is %d, want %d as interpreted", level, name, got, v.RAM[addr])
+			}
+		}
+	}
+	return nil
+}
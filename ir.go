@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// A program as the functions of its files, each split into basic blocks: runs
+// of commands that execute in order from the first to the last. Analyses,
+// interpreters and backends can work from it rather than from text.
+type IRProgram struct {
+	Functions []*IRFunction
+}
+
+// The code of one .vm file. Until function commands are supported a file's
+// commands form a single function, named after it.
+type IRFunction struct {
+	Name   string
+	File   string
+	Blocks []*BasicBlock
+}
+
+// Commands always run together. A block of inline assembly is a block of its
+// own, as it may jump anywhere.
+type BasicBlock struct {
+	Nodes []Node
+}
+
+// Build the IR of the sources, in order, accepting the extensions to the
+// language opts does
+func BuildIR(sources []sourceFile, opts Options) (*IRProgram, error) {
+	var prog IRProgram
+	for _, src := range sources {
+		nodes, err := ParseNodes(strings.NewReader(src.text), unitName(src.name), opts)
+		var srcErr *SourceError
+		if errors.As(err, &srcErr) {
+			srcErr.File = src.name
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := unitName(src.name)
+		if name == "" {
+			name = defaultUnit
+		}
+		prog.Functions = append(prog.Functions, &IRFunction{Name: name, File: src.name, Blocks: splitBlocks(nodes)})
+	}
+	return &prog, nil
+}
+
+// Divide nodes into basic blocks, ending one at each block of inline assembly
+func splitBlocks(nodes []Node) []*BasicBlock {
+	var blocks []*BasicBlock
+	var block *BasicBlock
+	for _, node := range nodes {
+		_, isAsm := node.(*InlineAsm)
+		if block == nil || isAsm {
+			block = &BasicBlock{}
+			blocks = append(blocks, block)
+		}
+		block.Nodes = append(block.Nodes, node)
+		if isAsm {
+			block = nil
+		}
+	}
+	return blocks
+}
+
+// Visit every node of the program in order, stopping at the first error,
+// which is located at the node's file and line
+func (p *IRProgram) Walk(v Visitor) error {
+	for _, fn := range p.Functions {
+		for _, block := range fn.Blocks {
+			err := Walk(block.Nodes, v)
+			var srcErr *SourceError
+			if errors.As(err, &srcErr) {
+				srcErr.File = fn.File
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// List the functions and their blocks, with each command and its line
+func (p *IRProgram) String() string {
+	var b strings.Builder
+	for i, fn := range p.Functions {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "function %v (%v)\n", fn.Name, fn.File)
+		for j, block := range fn.Blocks {
+			fmt.Fprintf(&b, "  block %d\n", j)
+			for _, node := range block.Nodes {
+				fmt.Fprintf(&b, "    %-24v // line %d\n", node, node.Position().Line)
+			}
+		}
+	}
+	return b.String()
+}
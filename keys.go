@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Address of the keyboard register, holding the code of the key held down
+const keyboardAddr = 24576
+
+// Codes of the Hack keyboard's special keys by name. Printable characters are
+// their own ASCII code, and None releases the key held down.
+var keyCodes = map[string]int16{
+	"None": 0, "Space": 32, "Enter": 128, "Backspace": 129,
+	"ArrowLeft": 130, "ArrowUp": 131, "ArrowRight": 132, "ArrowDown": 133,
+	"Home": 134, "End": 135, "PageUp": 136, "PageDown": 137,
+	"Insert": 138, "Delete": 139, "Esc": 140,
+}
+
+func init() {
+	for i := 1; i <= 12; i++ {
+		keyCodes["F"+strconv.Itoa(i)] = int16(140 + i)
+	}
+}
+
+// A key pressed at a cycle, held until the next event
+type keyEvent struct {
+	cycle int
+	code  int16
+}
+
+// Parse key events such as "ArrowUp:100,Space:300,None:400", separated by
+// commas or newlines, into cycle order. Blank lines and lines starting with
+// # are skipped so a script can be kept in a file.
+func parseKeys(spec string) ([]keyEvent, error) {
+	var events []keyEvent
+	for _, line := range strings.Split(spec, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		for _, field := range strings.Split(line, ",") {
+			field = strings.TrimSpace(field)
+			if field == "" {
+				continue
+			}
+			i := strings.LastIndex(field, ":")
+			if i < 0 {
+				return nil, fmt.Errorf("key event %q is missing :cycle", field)
+			}
+			name, at := field[:i], field[i+1:]
+			cycle, err := strconv.Atoi(at)
+			if err != nil || cycle < 0 {
+				return nil, fmt.Errorf("key event %q has invalid cycle %v", field, at)
+			}
+			code, ok := keyCodes[name]
+			if !ok {
+				if len(name) != 1 || name[0] < ' ' || name[0] > '~' {
+					return nil, fmt.Errorf("unknown key %q", name)
+				}
+				code = int16(name[0])
+			}
+			events = append(events, keyEvent{cycle, code})
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].cycle < events[j].cycle })
+	return events, nil
+}
+
+// Presses keys on a machine as it runs
+type keyScript struct {
+	events []keyEvent
+}
+
+// Write the events due by the machine's cycle count to the keyboard
+func (k *keyScript) apply(m *Machine) {
+	for len(k.events) > 0 && k.events[0].cycle <= m.Cycles {
+		m.RAM[keyboardAddr] = k.events[0].code
+		k.events = k.events[1:]
+	}
+}
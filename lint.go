@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A command that translates but is probably a mistake, at its 1-based line
+type lintWarning struct {
+	Line    int
+	Message string
+}
+
+// Check VM code for commands that translate but likely don't do what was
+// meant: a pop straight back to where a value was pushed from, adding or
+// subtracting zero, and statics pushed but never popped to, which are always
+// 0. Code that doesn't translate with the extensions to the language opts
+// accepts, or under- or overflows the stack, is returned as an error instead.
+func lintVM(source, unit string, opts Options) ([]lintWarning, error) {
+	lang := Options{Unit: unit, CheckStack: true, NegativeConstants: opts.NegativeConstants, Extended: opts.Extended}
+	instrs, err := translateInstructions(strings.NewReader(source), lang)
+	if err != nil {
+		return nil, err
+	}
+
+	var warnings []lintWarning
+	warn := func(instr *Instruction, format string, a ...interface{}) {
+		warnings = append(warnings, lintWarning{instr.lineNum, fmt.Sprintf(format, a...)})
+	}
+	popped := map[int]bool{}
+	hasAsm := false
+	for _, instr := range instrs {
+		hasAsm = hasAsm || instr.operation == "asm"
+		if instr.operation == "pop" && instr.segment == "static" {
+			popped[instr.value] = true
+		}
+	}
+	var pushedStatics []*Instruction
+	for i, instr := range instrs {
+		if instr.operation == "push" && instr.segment == "static" && !popped[instr.value] {
+			pushedStatics = append(pushedStatics, instr)
+			popped[instr.value] = true // Warn once for each static
+		}
+		if i == 0 {
+			continue
+		}
+		prev := instrs[i-1]
+		switch {
+		case prev.operation == "push" && instr.operation == "pop" && prev.segment == instr.segment && prev.value == instr.value:
+			warn(instr, "pop %v %d straight after pushing it has no effect", instr.segment, instr.value)
+		case prev.operation == "push" && prev.segment == "constant" && prev.value == 0 && (instr.operation == "add" || instr.operation == "sub"):
+			warn(instr, "%v of constant 0 has no effect", instr.operation)
+		}
+	}
+	// Inline assembly may write statics of its own
+	if !hasAsm {
+		for _, instr := range pushedStatics {
+			warn(instr, "static %d is pushed but never popped to, so is always 0", instr.value)
+		}
+	}
+	sort.SliceStable(warnings, func(i, j int) bool { return warnings[i].Line < warnings[j].Line })
+	return warnings, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// One row of the HTML listing, a VM command and the assembly it produced
+type listingEntry struct {
+	Anchor  string // Fragment identifying the row
+	LineNum int
+	Source  string
+	Asm     []string
+	Unit    string // Unit the command is from, to match it with a profile
+	Count   int    // Times the command ran when profiled
+	Hot     bool   // Whether the command is among the most expensive
+}
+
+// Copy what the listing needs from a translated instruction, which may be
+// reused once this returns
+func newListingEntry(instr *Instruction) listingEntry {
+	return listingEntry{
+		Anchor:  "L" + strconv.Itoa(instr.lineNum),
+		LineNum: instr.lineNum,
+		Source:  strings.TrimSpace(instr.stripped),
+		Asm:     append([]string(nil), instr.translatedLines...),
+	}
+}
+
+// Wrap s in a span with the given CSS class
+func span(class, s string) string {
+	return `<span class="` + class + `">` + template.HTMLEscapeString(s) + `</span>`
+}
+
+// Highlight the operation, segment and value of a VM command
+func highlightVM(source string) template.HTML {
+	classes := []string{"op", "seg", "num"}
+	var parts []string
+	for i, token := range strings.Fields(source) {
+		if i < len(classes) {
+			parts = append(parts, span(classes[i], token))
+		} else {
+			parts = append(parts, template.HTMLEscapeString(token))
+		}
+	}
+	return template.HTML(strings.Join(parts, " "))
+}
+
+// Highlight A-instructions, labels and comments in a line of assembly
+func highlightAsm(line string) template.HTML {
+	code, comment, hasComment := strings.Cut(line, "//")
+	var html string
+	switch trimmed := strings.TrimSpace(code); {
+	case strings.HasPrefix(trimmed, "@"):
+		html = span("ainstr", code)
+	case strings.HasPrefix(trimmed, "("):
+		html = span("label", code)
+	default:
+		html = template.HTMLEscapeString(code)
+	}
+	if hasComment {
+		html += span("comment", "//"+comment)
+	}
+	return template.HTML(html)
+}
+
+var listingTemplate = template.Must(template.New("listing").Funcs(template.FuncMap{
+	"vm":  highlightVM,
+	"asm": highlightAsm,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+td { vertical-align: top; padding: 4px 12px; border-top: 1px solid #ddd; font-family: monospace; white-space: pre; }
+td.line a { color: #999; text-decoration: none; }
+tr:target { background: #ffc; }
+tr.hot td.count { background: #fcc; font-weight: bold; }
+td.count { text-align: right; color: #666; }
+.op { color: #07a; font-weight: bold; }
+.seg { color: #690; }
+.num, .ainstr { color: #905; }
+.label { color: #e90; }
+.comment { color: #999; font-style: italic; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<table>
+<tr><th></th>{{if .Profiled}}<th>Runs</th>{{end}}<th>VM</th><th>Assembly</th></tr>
+{{$profiled := .Profiled}}{{range .Entries}}<tr id="{{.Anchor}}"{{if .Hot}} class="hot"{{end}}>
+<td class="line"><a href="#{{.Anchor}}">{{.LineNum}}</a></td>
+{{if $profiled}}<td class="count">{{.Count}}</td>
+{{end}}<td class="vm">{{vm .Source}}</td>
+<td class="asm">{{range .Asm}}{{asm .}}
+{{end}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// Write an HTML page listing each VM command beside its assembly. Every row
+// is anchored by its VM line number, e.g. Foo.html#L12, so rows can be linked.
+// Listings of several files prefix the anchor with the file, e.g. #Foo-L12.
+// Once annotated with a profile, each row also shows how often it ran.
+func writeListing(w io.Writer, title string, entries []listingEntry) error {
+	profiled := false
+	for _, entry := range entries {
+		profiled = profiled || entry.Count > 0
+	}
+	return listingTemplate.Execute(w, struct {
+		Title    string
+		Profiled bool
+		Entries  []listingEntry
+	}{title, profiled, entries})
+}
+
+// Writes a plain text listing of the generated assembly, giving the ROM
+// address each instruction is assembled to and the VM line it came from, to
+// follow along in the course's CPU emulator
+type lstWriter struct {
+	errWriter
+	rom int // ROM address of the next instruction
+}
+
+func newLstWriter(w io.StringWriter) *lstWriter {
+	return &lstWriter{errWriter: errWriter{w: w}}
+}
+
+// Write lines of assembly, noting origin beside the first
+func (lw *lstWriter) writeLines(origin string, lines []string) {
+	for _, line := range lines {
+		addr := ""
+		if asmCost(line) > 0 {
+			addr = strconv.Itoa(lw.rom)
+			lw.rom++
+		}
+		row := fmt.Sprintf("%6s  %-16s %v", addr, line, origin)
+		lw.writeString(strings.TrimRight(row, " "))
+		lw.writeString("\n")
+		origin = ""
+	}
+}
+
+// Write the assembly of an instruction from the named file
+func (lw *lstWriter) writeInstruction(file string, instr *Instruction) {
+	lw.writeLines(fmt.Sprintf("// %v:%d: %v", file, instr.lineNum, strings.TrimSpace(instr.stripped)), instr.translatedLines)
+}
+
+// Write a symbol table giving the ROM address of each label, one per line in
+// address order, for debuggers to show symbolic locations
+func writeSymbols(w io.Writer, labels map[string]int) error {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if labels[names[i]] != labels[names[j]] {
+			return labels[names[i]] < labels[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%6d  %v\n", labels[name], name)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Write a memory map: the ROM address of each label, then the RAM address the
+// assembler allocated each variable, statics among them, in address order
+func writeMemoryMap(w io.Writer, labels, vars map[string]int) error {
+	if _, err := io.WriteString(w, "// ROM addresses of labels\n"); err != nil {
+		return err
+	}
+	if err := writeSymbols(w, labels); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, "\n// RAM addresses of variables\n"); err != nil {
+		return err
+	}
+	return writeSymbols(w, vars)
+}
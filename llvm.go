@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+Lowers VM commands to textual LLVM IR, so programs can be optimised and
+compiled natively, e.g.
+
+	llc -filetype=obj Foo.ll && gcc -no-pie -o Foo Foo.o
+
+Memory is modelled exactly as on Hack: vm_ram is an array of 32K 16-bit words,
+RAM[0] is SP and the stack starts at RAM[256]. Keeping the stack in memory
+rather than in SSA values leaves it to LLVM's own passes to promote it. The
+program is emitted as main, which returns the value on top of the stack as the
+exit status, or 0 if the stack is empty.
+*/
+type llvmBackend struct {
+	unit string // Of the file being translated, which its SSA values are named after
+	n    int    // Number of SSA values used so far in the file
+}
+
+// A backend for translating a file afresh, numbering its SSA values from the
+// start, so a file translates the same whichever order files are translated
+// in and cached translations can be mixed in a module
+func (b *llvmBackend) fresh() Backend {
+	return &llvmBackend{}
+}
+
+// A new SSA value name, e.g. %"Main.t1", unique to the file
+func (b *llvmBackend) tmp() string {
+	b.n++
+	return fmt.Sprintf("%%\"%v.t%d\"", b.unit, b.n)
+}
+
+// Output instructions computing a pointer to RAM[addr], returning the pointer.
+// addr is an i16 value or constant.
+func (b *llvmBackend) ram(instr *Instruction, addr string) string {
+	idx, ptr := b.tmp(), b.tmp()
+	instr.outputLines(
+		fmt.Sprintf("  %v = zext i16 %v to i64", idx, addr),
+		fmt.Sprintf("  %v = getelementptr inbounds [32768 x i16], ptr @vm_ram, i64 0, i64 %v", ptr, idx),
+	)
+	return ptr
+}
+
+// Output instructions loading RAM[addr], returning the loaded value
+func (b *llvmBackend) load(instr *Instruction, addr string) string {
+	ptr := b.ram(instr, addr)
+	v := b.tmp()
+	instr.outputLines(fmt.Sprintf("  %v = load i16, ptr %v", v, ptr))
+	return v
+}
+
+// Output instructions storing v in RAM[addr]
+func (b *llvmBackend) store(instr *Instruction, addr, v string) {
+	ptr := b.ram(instr, addr)
+	instr.outputLines(fmt.Sprintf("  store i16 %v, ptr %v", v, ptr))
+}
+
+// Output instructions pushing v onto the stack
+func (b *llvmBackend) push(instr *Instruction, v string) {
+	sp, next := b.tmp(), b.tmp()
+	instr.outputLines(fmt.Sprintf("  %v = load i16, ptr @vm_ram", sp))
+	b.store(instr, sp, v)
+	instr.outputLines(
+		fmt.Sprintf("  %v = add i16 %v, 1", next, sp),
+		fmt.Sprintf("  store i16 %v, ptr @vm_ram", next),
+	)
+}
+
+// Output instructions popping the top of the stack, returning its value
+func (b *llvmBackend) pop(instr *Instruction) string {
+	sp, top := b.tmp(), b.tmp()
+	instr.outputLines(
+		fmt.Sprintf("  %v = load i16, ptr @vm_ram", sp),
+		fmt.Sprintf("  %v = sub i16 %v, 1", top, sp),
+		fmt.Sprintf("  store i16 %v, ptr @vm_ram", top),
+	)
+	return b.load(instr, top)
+}
+
+// Output instructions computing the RAM address of segment[index]
+func (b *llvmBackend) address(instr *Instruction) (string, error) {
+	i := instr.value
+	switch instr.segment {
+	case "local", "argument", "this", "that":
+		base := b.load(instr, fmt.Sprint(x86SegmentPointers[instr.segment]))
+		addr := b.tmp()
+		instr.outputLines(fmt.Sprintf("  %v = add i16 %v, %d", addr, base, i))
+		return addr, nil
+	case "temp":
+		return fmt.Sprint(5 + i), nil
+	case "pointer":
+		return fmt.Sprint(3 + i), nil
+	}
+	return "", unsupportedSegment(instr, "llvm")
+}
+
+func (*llvmBackend) Extension() string {
+	return ".ll"
+}
+
+func (*llvmBackend) Prologue() []string {
+	return []string{
+		"@vm_ram = global [32768 x i16] zeroinitializer, align 2",
+		"",
+		"define i32 @main() {",
+		"entry:",
+		"  store i16 256, ptr @vm_ram",
+	}
+}
+
+// Named apart from the files' values, as their counts aren't known here
+func (b *llvmBackend) Epilogue() []string {
+	sp, nonEmpty, top, idx, ptr, v, v32, ret := "%exit.sp", "%exit.nonempty", "%exit.top", "%exit.idx", "%exit.ptr", "%exit.v", "%exit.v32", "%exit.ret"
+	return []string{
+		"; return the top of the VM stack, or 0 if it is empty",
+		fmt.Sprintf("  %v = load i16, ptr @vm_ram", sp),
+		fmt.Sprintf("  %v = icmp ugt i16 %v, 256", nonEmpty, sp),
+		fmt.Sprintf("  %v = sub i16 %v, 1", top, sp),
+		fmt.Sprintf("  %v = zext i16 %v to i64", idx, top),
+		fmt.Sprintf("  %v = getelementptr inbounds [32768 x i16], ptr @vm_ram, i64 0, i64 %v", ptr, idx),
+		fmt.Sprintf("  %v = load i16, ptr %v", v, ptr),
+		fmt.Sprintf("  %v = sext i16 %v to i32", v32, v),
+		fmt.Sprintf("  %v = select i1 %v, i32 %v, i32 0", ret, nonEmpty, v32),
+		fmt.Sprintf("  ret i32 %v", ret),
+		"}",
+		"",
+	}
+}
+
+func (*llvmBackend) CommentPrefix() string {
+	return "; "
+}
+
+func (b *llvmBackend) Translate(instr *Instruction) error {
+	b.unit = instr.unit
+	if b.unit == "" {
+		b.unit = defaultUnit
+	}
+	switch instr.operation {
+	case "push":
+		if instr.segment == "constant" {
+			b.push(instr, fmt.Sprint(instr.value))
+			return nil
+		}
+		addr, err := b.address(instr)
+		if err != nil {
+			return err
+		}
+		b.push(instr, b.load(instr, addr))
+	case "pop":
+		if instr.segment == "constant" {
+			return errors.New("`pop constant` not implemented, doesn't make sense")
+		}
+		// Compute the address first, it may read the segment pointer
+		addr, err := b.address(instr)
+		if err != nil {
+			return err
+		}
+		b.store(instr, addr, b.pop(instr))
+	case "add", "sub":
+		y := b.pop(instr)
+		x := b.pop(instr)
+		r := b.tmp()
+		instr.outputLines(fmt.Sprintf("  %v = %v i16 %v, %v", r, instr.operation, x, y))
+		b.push(instr, r)
+	case "mul":
+		y := b.pop(instr)
+		x := b.pop(instr)
+		r := b.tmp()
+		instr.outputLines(fmt.Sprintf("  %v = mul i16 %v, %v", r, x, y))
+		b.push(instr, r)
+	case "shiftleft", "shiftright":
+		op := map[string]string{"shiftleft": "shl", "shiftright": "ashr"}[instr.operation]
+		x := b.pop(instr)
+		r := b.tmp()
+		instr.outputLines(fmt.Sprintf("  %v = %v i16 %v, 1", r, op, x))
+		b.push(instr, r)
+	case "div", "mod":
+		// Divided in 32 bits, as dividing -32768 by -1 overflows i16
+		op := map[string]string{"div": "sdiv", "mod": "srem"}[instr.operation]
+		y := b.pop(instr)
+		x := b.pop(instr)
+		wx, wy, wr, r := b.tmp(), b.tmp(), b.tmp(), b.tmp()
+		instr.outputLines(
+			fmt.Sprintf("  %v = sext i16 %v to i32", wx, x),
+			fmt.Sprintf("  %v = sext i16 %v to i32", wy, y),
+			fmt.Sprintf("  %v = %v i32 %v, %v", wr, op, wx, wy),
+			fmt.Sprintf("  %v = trunc i32 %v to i16", r, wr),
+		)
+		b.push(instr, r)
+	}
+	return nil
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+	A minimal Language Server Protocol server for .vm files, spoken over
+	stdio. It supports:
+
+	- diagnostics from the parser, published whenever a document changes
+	- hover, showing the assembly a command translates to
+
+	Go-to-definition and document symbols need labels and functions, which
+	the translator doesn't support yet, so they aren't advertised.
+*/
+
+// A JSON-RPC request, response or notification
+type lspMessage struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method,omitempty"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+	Result  interface{}      `json:"result,omitempty"`
+	Error   *lspError        `json:"error,omitempty"`
+}
+
+type lspError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// JSON-RPC error code for requests the server doesn't implement
+const lspMethodNotFound = -32601
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"` // 1 is error
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type lspTextDocument struct {
+	URI  string `json:"uri"`
+	Text string `json:"text"`
+}
+
+type lspDocumentParams struct {
+	TextDocument   lspTextDocument `json:"textDocument"`
+	Position       lspPosition     `json:"position"`
+	ContentChanges []struct {
+		Text string `json:"text"`
+	} `json:"contentChanges"`
+}
+
+type lspServer struct {
+	r    *textproto.Reader
+	w    *bufio.Writer
+	docs map[string]string // Open documents by URI
+	opts Options           // Extensions to the language accepted
+}
+
+// Serve LSP requests read from r, writing responses to w, until the client
+// sends `exit` or closes the connection. Documents are checked accepting the
+// extensions to the language opts does.
+func serveLSP(r io.Reader, w io.Writer, opts Options) error {
+	s := lspServer{
+		r:    textproto.NewReader(bufio.NewReader(r)),
+		w:    bufio.NewWriter(w),
+		docs: map[string]string{},
+		opts: opts,
+	}
+	for {
+		msg, err := s.read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if msg.Method == "exit" {
+			return nil
+		}
+		if err := s.handle(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// Read one message, which is a set of headers followed by a JSON body
+func (s *lspServer) read() (*lspMessage, error) {
+	header, err := s.r.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid Content-Length header: %v", err)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(s.r.R, body); err != nil {
+		return nil, err
+	}
+
+	var msg lspMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return nil, fmt.Errorf("invalid message: %v", err)
+	}
+	return &msg, nil
+}
+
+func (s *lspServer) write(msg lspMessage) error {
+	msg.JSONRPC = "2.0"
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(s.w, "Content-Length: %d\r\n\r\n", len(body))
+	s.w.Write(body)
+	return s.w.Flush()
+}
+
+func (s *lspServer) reply(id *json.RawMessage, result interface{}) error {
+	if result == nil {
+		// Responses must always carry a result
+		result = json.RawMessage("null")
+	}
+	return s.write(lspMessage{ID: id, Result: result})
+}
+
+func (s *lspServer) handle(msg *lspMessage) error {
+	var params lspDocumentParams
+	if len(msg.Params) > 0 {
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return fmt.Errorf("invalid params for %v: %v", msg.Method, err)
+		}
+	}
+	uri := params.TextDocument.URI
+
+	switch msg.Method {
+	case "initialize":
+		return s.reply(msg.ID, map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync": 1, // full document on every change
+				"hoverProvider":    true,
+			},
+			"serverInfo": map[string]string{"name": "vm-translator"},
+		})
+	case "shutdown":
+		return s.reply(msg.ID, nil)
+	case "textDocument/didOpen":
+		s.docs[uri] = params.TextDocument.Text
+		return s.publishDiagnostics(uri)
+	case "textDocument/didChange":
+		if n := len(params.ContentChanges); n > 0 {
+			s.docs[uri] = params.ContentChanges[n-1].Text
+		}
+		return s.publishDiagnostics(uri)
+	case "textDocument/didClose":
+		delete(s.docs, uri)
+		return s.publishDiagnostics(uri)
+	case "textDocument/hover":
+		return s.reply(msg.ID, s.hover(uri, params.Position))
+	}
+
+	// Ignore unknown notifications, but requests must be answered
+	if msg.ID != nil {
+		return s.write(lspMessage{ID: msg.ID, Error: &lspError{
+			Code:    lspMethodNotFound,
+			Message: "method not supported: " + msg.Method,
+		}})
+	}
+	return nil
+}
+
+// Split a document into lines, dropping carriage returns like the translator
+func documentLines(text string) []string {
+	var lines []string
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines
+}
+
+// Parse and translate a single line of VM code
+func lspTranslate(text string, opts Options) (Instruction, error) {
+	instr := NewInstruction(text)
+	if err := instr.parse(); err != nil {
+		return instr, err
+	}
+	if err := instr.checkExtensions(opts); err != nil {
+		return instr, err
+	}
+	if !instr.empty {
+		return instr, instr.Translate()
+	}
+	return instr, nil
+}
+
+// The path of the file a document URI names, for finding what it
+// includes, or the URI itself if it isn't a file
+func documentPath(uri string) string {
+	if u, err := url.Parse(uri); err == nil && u.Scheme == "file" {
+		return filepath.FromSlash(u.Path)
+	}
+	return uri
+}
+
+// Check the whole document as translating it would, expanding its
+// directives and keeping its blocks of inline assembly together, and send
+// the errors to the client at the lines they came from. Errors in the files
+// it includes are shown on its first line.
+func (s *lspServer) publishDiagnostics(uri string) error {
+	diagnostics := []lspDiagnostic{}
+	lines := documentLines(s.docs[uri])
+	report := func(num int, msg string) {
+		if num < 0 || num >= len(lines) {
+			num = 0
+		}
+		end := 0
+		if num < len(lines) {
+			end = len(lines[num])
+		}
+		diagnostics = append(diagnostics, lspDiagnostic{
+			Range: lspRange{
+				Start: lspPosition{Line: num},
+				End:   lspPosition{Line: num, Character: end},
+			},
+			Severity: 1,
+			Source:   "vm-translator",
+			Message:  msg,
+		})
+	}
+
+	path := documentPath(uri)
+	source, origins, err := preprocessString(path, s.docs[uri], nil)
+	var srcErr *SourceError
+	if errors.As(err, &srcErr) && srcErr.File == path {
+		report(srcErr.Line-1, srcErr.Err.Error())
+	} else if err != nil {
+		report(0, err.Error())
+	} else {
+		opts := Options{Backend: nullBackend{}, KeepGoing: true, NegativeConstants: s.opts.NegativeConstants, Extended: s.opts.Extended}
+		err = translateStream(strings.NewReader(source), opts, func(*Instruction) error { return nil })
+		eachSourceError(err, func(srcErr *SourceError) {
+			if srcErr.Line < 1 || srcErr.Line > len(origins) {
+				report(0, srcErr.Err.Error())
+			} else if origin := origins[srcErr.Line-1]; origin.file != path {
+				report(0, fmt.Sprintf("%v:%d: %v", origin.file, origin.line, srcErr.Err))
+			} else {
+				report(origin.line-1, srcErr.Err.Error())
+			}
+		})
+	}
+
+	params, err := json.Marshal(map[string]interface{}{
+		"uri":         uri,
+		"diagnostics": diagnostics,
+	})
+	if err != nil {
+		return err
+	}
+	return s.write(lspMessage{Method: "textDocument/publishDiagnostics", Params: params})
+}
+
+// Show the assembly for the command under the cursor, or nothing if the line
+// is empty or invalid
+func (s *lspServer) hover(uri string, pos lspPosition) interface{} {
+	lines := documentLines(s.docs[uri])
+	if pos.Line < 0 || pos.Line >= len(lines) {
+		return nil
+	}
+	instr, err := lspTranslate(lines[pos.Line], s.opts)
+	if err != nil || instr.empty {
+		return nil
+	}
+
+	value := "```asm\n" + strings.Join(instr.translatedLines, "\n") + "\n```"
+	return map[string]interface{}{
+		"contents": map[string]string{"kind": "markdown", "value": value},
+	}
+}
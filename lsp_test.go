@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Frame each JSON body as an LSP message
+func lspInput(bodies ...string) string {
+	var b strings.Builder
+	for _, body := range bodies {
+		fmt.Fprintf(&b, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	}
+	return b.String()
+}
+
+// Parse framed LSP messages written by the server
+func lspOutput(t *testing.T, out string) []lspMessage {
+	var msgs []lspMessage
+	for _, part := range strings.Split(out, "Content-Length: ")[1:] {
+		_, body, _ := strings.Cut(part, "\r\n\r\n")
+		var msg lspMessage
+		if err := json.Unmarshal([]byte(body), &msg); err != nil {
+			t.Fatalf("invalid message %q: %v", body, err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func TestLSP(t *testing.T) {
+	// setup
+	text, _ := json.Marshal("push constant 7\npop nowhere 1\n\n   // indented comment\npop constant 2\n")
+	input := lspInput(
+		`{"jsonrpc":"2.0","id":1,"method":"initialize","params":{}}`,
+		`{"jsonrpc":"2.0","method":"textDocument/didOpen","params":{"textDocument":{"uri":"file:///a.vm","text":`+string(text)+`}}}`,
+		`{"jsonrpc":"2.0","id":2,"method":"textDocument/hover","params":{"textDocument":{"uri":"file:///a.vm"},"position":{"line":0,"character":3}}}`,
+		`{"jsonrpc":"2.0","id":3,"method":"textDocument/hover","params":{"textDocument":{"uri":"file:///a.vm"},"position":{"line":2,"character":0}}}`,
+		`{"jsonrpc":"2.0","id":4,"method":"shutdown"}`,
+		`{"jsonrpc":"2.0","method":"exit"}`,
+	)
+	var out bytes.Buffer
+	// test
+	if err := serveLSP(strings.NewReader(input), &out, Options{}); err != nil {
+		t.Fatalf("serveLSP failed: %v", err)
+	}
+	msgs := lspOutput(t, out.String())
+	// assert
+	if len(msgs) != 5 {
+		t.Fatalf("Wanted 5 messages, got %d: %v", len(msgs), out.String())
+	}
+
+	var diags struct{ Diagnostics []lspDiagnostic }
+	json.Unmarshal(msgs[1].Params, &diags)
+	if len(diags.Diagnostics) != 2 || diags.Diagnostics[0].Range.Start.Line != 1 || diags.Diagnostics[1].Range.Start.Line != 4 {
+		t.Fatalf("Wanted diagnostics on lines 1 and 4, got %+v", diags.Diagnostics)
+	}
+
+	hover, _ := json.Marshal(msgs[2].Result)
+	if !strings.Contains(string(hover), "@7") {
+		t.Fatalf("Wanted hover with assembly, got %s", hover)
+	}
+	if msgs[3].Result != nil {
+		t.Fatalf("Wanted empty hover on a blank line, got %v", msgs[3].Result)
+	}
+}
+
+func TestLSPWholeDocument(t *testing.T) {
+	// setup
+	source := "%define N 3\npush constant N\n//#asm\n@SP\nM=M+1\n//#endasm\n%ifdef DEBUG\npop nowhere 1\n%endif\nmul\npop nowhere 2\n"
+	text, _ := json.Marshal(source)
+	input := lspInput(
+		`{"jsonrpc":"2.0","method":"textDocument/didOpen","params":{"textDocument":{"uri":"file:///a.vm","text":`+string(text)+`}}}`,
+		`{"jsonrpc":"2.0","method":"exit"}`,
+	)
+	var out bytes.Buffer
+	// test
+	if err := serveLSP(strings.NewReader(input), &out, Options{Extended: true}); err != nil {
+		t.Fatalf("serveLSP failed: %v", err)
+	}
+	msgs := lspOutput(t, out.String())
+	// assert
+	var diags struct{ Diagnostics []lspDiagnostic }
+	json.Unmarshal(msgs[0].Params, &diags)
+	if len(diags.Diagnostics) != 1 || diags.Diagnostics[0].Range.Start.Line != 10 {
+		t.Fatalf("Wanted a diagnostic on line 10 alone, got %+v", diags.Diagnostics)
+	}
+}
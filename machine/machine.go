@@ -0,0 +1,165 @@
+// Package machine models the Hack computer's data memory as translated VM
+// code uses it: the RAM, the pointers at its start, and the segments and
+// stack they locate. The emulator, the VM interpreter and analyses of
+// generated code share it so they agree on where everything is.
+package machine
+
+import "fmt"
+
+// Size of the Hack data memory, up to and including the keyboard
+const Size = 24577
+
+// Addresses of the pointers and fixed regions VM code uses
+const (
+	SP          = 0
+	LCL         = 1
+	ARG         = 2
+	THIS        = 3
+	THAT        = 4
+	TempBase    = 5    // temp 0-7 are RAM[5-12]
+	PointerBase = THIS // pointer 0 and 1 are THIS and THAT
+	StaticBase  = 16   // Variables, including statics, are allocated from here
+	StackBase   = 256  // Where the stack starts
+)
+
+// The data memory, indexed by address
+type RAM [Size]int16
+
+// An access to an address outside memory
+type AddressError struct {
+	Addr  int
+	Write bool
+}
+
+func (e *AddressError) Error() string {
+	op := "read"
+	if e.Write {
+		op = "write"
+	}
+	return fmt.Sprintf("%v of RAM[%d] outside memory", op, e.Addr)
+}
+
+// The word at addr, failing with an *AddressError if it's outside memory
+func (r *RAM) Read(addr int) (int16, error) {
+	if addr < 0 || addr >= Size {
+		return 0, &AddressError{Addr: addr}
+	}
+	return r[addr], nil
+}
+
+// Set the word at addr, failing with an *AddressError if it's outside memory
+func (r *RAM) Write(addr int, v int16) error {
+	if addr < 0 || addr >= Size {
+		return &AddressError{Addr: addr, Write: true}
+	}
+	r[addr] = v
+	return nil
+}
+
+// A VM segment seen through the RAM: index i of it is at Base() + i
+type Segment struct {
+	ram     *RAM
+	name    string
+	pointer int // Address holding the base, or -1 for a fixed base
+	base    int // The fixed base
+}
+
+// The view of the segment named, one of local, argument, this, that, temp
+// or pointer. Statics are allocated by the assembler, so have no view.
+func (r *RAM) Segment(name string) (Segment, error) {
+	s := Segment{ram: r, name: name, pointer: -1}
+	switch name {
+	case "local":
+		s.pointer = LCL
+	case "argument":
+		s.pointer = ARG
+	case "this":
+		s.pointer = THIS
+	case "that":
+		s.pointer = THAT
+	case "temp":
+		s.base = TempBase
+	case "pointer":
+		s.base = PointerBase
+	default:
+		return Segment{}, fmt.Errorf("can't address segment %v", name)
+	}
+	return s, nil
+}
+
+// The address of index 0 of the segment, as its pointer is now
+func (s Segment) Base() int {
+	if s.pointer < 0 {
+		return s.base
+	}
+	return int(uint16(s.ram[s.pointer]))
+}
+
+// The address of index i, failing if it's outside memory
+func (s Segment) Address(i int) (int, error) {
+	addr := s.Base() + i
+	if addr < 0 || addr >= Size {
+		return 0, fmt.Errorf("%v %d is RAM[%d], outside memory", s.name, i, addr)
+	}
+	return addr, nil
+}
+
+// The word at index i
+func (s Segment) Read(i int) (int16, error) {
+	addr, err := s.Address(i)
+	if err != nil {
+		return 0, err
+	}
+	return s.ram[addr], nil
+}
+
+// Set the word at index i
+func (s Segment) Write(i int, v int16) error {
+	addr, err := s.Address(i)
+	if err != nil {
+		return err
+	}
+	s.ram[addr] = v
+	return nil
+}
+
+// The stack seen through the RAM, growing up from SP
+type StackView struct {
+	ram *RAM
+}
+
+// The view of the stack at SP
+func (r *RAM) Stack() StackView {
+	return StackView{r}
+}
+
+// The number of values above the start of the stack, negative if SP is
+// below it
+func (s StackView) Len() int {
+	return int(uint16(s.ram[SP])) - StackBase
+}
+
+// Push v, failing with an *AddressError if SP is outside memory
+func (s StackView) Push(v int16) error {
+	if err := s.ram.Write(int(uint16(s.ram[SP])), v); err != nil {
+		return err
+	}
+	s.ram[SP]++
+	return nil
+}
+
+// Pop the top of the stack, failing with an *AddressError if it's outside
+// memory
+func (s StackView) Pop() (int16, error) {
+	v, err := s.Peek()
+	if err != nil {
+		return 0, err
+	}
+	s.ram[SP]--
+	return v, nil
+}
+
+// The top of the stack, left in place
+func (s StackView) Peek() (int16, error) {
+	return s.ram.Read(int(uint16(s.ram[SP])) - 1)
+}
@@ -0,0 +1,79 @@
+package machine
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestReadWrite(t *testing.T) {
+	// setup
+	var ram RAM
+	// test
+	err := ram.Write(Size-1, 7)
+	got, _ := ram.Read(Size - 1)
+	// assert
+	if err != nil || got != 7 {
+		t.Fatalf("Wanted 7 at the last address, got %v, %v", got, err)
+	}
+	var addrErr *AddressError
+	if _, err := ram.Read(Size); !errors.As(err, &addrErr) || addrErr.Write {
+		t.Fatalf("Expected read past memory produce err, got %v", err)
+	}
+	if err := ram.Write(-1, 0); !errors.As(err, &addrErr) || !addrErr.Write {
+		t.Fatalf("Expected write before memory produce err, got %v", err)
+	}
+}
+
+func TestSegment(t *testing.T) {
+	// setup
+	var ram RAM
+	ram[LCL] = 300
+	local, err := ram.Segment("local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	temp, _ := ram.Segment("temp")
+	// test
+	local.Write(2, 5)
+	temp.Write(7, 9)
+	ram[LCL] = 301
+	got, _ := local.Read(1)
+	// assert
+	if ram[302] != 5 || got != 5 || ram[12] != 9 {
+		t.Fatalf("Wanted local 2 at 302 and temp 7 at 12, got RAM[302] %v, local 1 %v, RAM[12] %v", ram[302], got, ram[12])
+	}
+	if _, err := ram.Segment("static"); err == nil {
+		t.Fatalf("Expected static produce err")
+	}
+	ram[ARG] = -1 // 65535
+	arg, _ := ram.Segment("argument")
+	if _, err := arg.Read(0); err == nil {
+		t.Fatalf("Expected argument past memory produce err")
+	}
+}
+
+func TestStack(t *testing.T) {
+	// setup
+	var ram RAM
+	ram[SP] = StackBase
+	stack := ram.Stack()
+	// test
+	stack.Push(1)
+	stack.Push(2)
+	top, _ := stack.Peek()
+	popped, _ := stack.Pop()
+	// assert
+	if top != 2 || popped != 2 || stack.Len() != 1 || ram[SP] != StackBase+1 {
+		t.Fatalf("Wanted 2 on top leaving 1 value, got %v, %v and %d values", top, popped, stack.Len())
+	}
+
+	// setup
+	ram[SP] = 0
+	// test
+	_, err := stack.Pop()
+	// assert
+	var addrErr *AddressError
+	if !errors.As(err, &addrErr) || addrErr.Addr != -1 || ram[SP] != 0 {
+		t.Fatalf("Expected pop with SP 0 produce err, got %v", err)
+	}
+}
@@ -1,7 +1,19 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
 	"testing"
+	"text/template"
+
+	"github.com/schallis/vm-translator/codegen"
 )
 
 func TestParseSuccess(t *testing.T) {
@@ -52,6 +64,9 @@ func TestParseFail(t *testing.T) {
 		"invalid",          // invalid operation
 		"pop invalid 0",    // invalid segment
 		"pop local notnum", // invalid value
+		"push constant 32768",
+		"push constant 40000",
+		"push constant -32769",
 	}
 
 	for _, instruction := range tests {
@@ -66,6 +81,31 @@ func TestParseFail(t *testing.T) {
 	}
 }
 
+func TestExtensions(t *testing.T) {
+	type testCase struct {
+		source string
+		opts   Options // Enabling the extension the source uses
+	}
+	cases := []testCase{
+		{"push constant 1\npush constant -5\n", Options{NegativeConstants: true}},
+		{"push constant 1\nmul\n", Options{Extended: true}},
+		{"push constant 1\nshiftright\n", Options{Extended: true}},
+	}
+	for _, c := range cases {
+		// test
+		_, err := translateInstructions(strings.NewReader(c.source), Options{})
+		_, extErr := translateInstructions(strings.NewReader(c.source), c.opts)
+		// assert
+		var srcErr *SourceError
+		if !errors.As(err, &srcErr) || srcErr.Line != 2 {
+			t.Fatalf("Expected %q produce err on line 2, got %v", c.source, err)
+		}
+		if extErr != nil {
+			t.Fatalf("Expected %q translate with the extension, got %v", c.source, extErr)
+		}
+	}
+}
+
 func TestFilterBlanks(t *testing.T) {
 	// setup
 	s := []string{"hello", "", "world", "", ""}
@@ -77,3 +117,774 @@ func TestFilterBlanks(t *testing.T) {
 		t.Fatalf("Incorrect filtering. Wanted len %d, got %q", expected_len, result)
 	}
 }
+
+func TestTraceLine(t *testing.T) {
+	// setup
+	line := NewInstruction("push constant 7")
+	line.lineNum = 42
+	// test
+	check(line.parse())
+	line.traceLine()
+	line.Translate()
+	// assert
+	if line.translatedLines[0] != "@42" {
+		t.Fatalf("Expected trace of line 42 first, got %q", line.translatedLines)
+	}
+}
+
+func TestComputeStats(t *testing.T) {
+	// setup
+	var instrs []*Instruction
+	for _, text := range []string{"push constant 7", "push constant 8", "add"} {
+		line := NewInstruction(text)
+		check(line.parse())
+		line.Translate()
+		instrs = append(instrs, &line)
+	}
+	line := NewInstruction("pop temp 0")
+	check(line.parse())
+	line.outputLines("// not an instruction", "(LABEL)")
+	expected := 0
+	for _, instr := range instrs {
+		expected += len(instr.translatedLines)
+	}
+	instrs = append(instrs, &line)
+	// test
+	stats := computeStats("Test", instrs)
+	// assert
+	if stats.instructions != expected || stats.worstCycles != expected {
+		t.Fatalf("Wanted %d instructions and cycles, got %+v", expected, stats)
+	}
+	if c := stats.commands["push constant"]; c.count != 2 || c.words != len(instrs[0].translatedLines)*2 {
+		t.Fatalf("Wanted 2 push constant of %d words each, got %+v", len(instrs[0].translatedLines), c)
+	}
+	var report strings.Builder
+	check(writeStats(&report, "table", stats))
+	if !strings.Contains(report.String(), "push constant  2      14            7.0") {
+		t.Fatalf("Expected push constant in the expansion report, got:\n%v", report.String())
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	// setup
+	tables := []reportTable{
+		{name: "units", headings: []string{"unit", "cycles/call"}, keys: []string{"unit", "cycles_per_call"}, rows: [][]any{{"Main", 12}, {"Sys, OS", 3}}},
+		{name: "rates", headings: []string{"rate"}, keys: []string{"rate"}, rows: [][]any{{2.25}}},
+	}
+	wants := map[string]string{
+		"table": "unit     cycles/call\nMain     12\nSys, OS  3\n\nrate\n2.2\n",
+		"csv":   "unit,cycles_per_call\nMain,12\n\"Sys, OS\",3\n\nrate\n2.25\n",
+	}
+	for format, want := range wants {
+		var b strings.Builder
+		// test
+		check(writeReport(&b, format, tables))
+		// assert
+		if b.String() != want {
+			t.Fatalf("Wanted %v\n%v\ngot\n%v", format, want, b.String())
+		}
+	}
+
+	// test
+	var b strings.Builder
+	check(writeReport(&b, "json", tables))
+	var doc map[string][]map[string]any
+	err := json.Unmarshal([]byte(b.String()), &doc)
+	// assert
+	if err != nil || doc["units"][1]["unit"] != "Sys, OS" || doc["units"][0]["cycles_per_call"] != 12.0 || doc["rates"][0]["rate"] != 2.25 {
+		t.Fatalf("Unexpected JSON %v, %v", b.String(), err)
+	}
+}
+
+// Build a VM program of n commands cycling through every supported command
+func syntheticProgram(n int) string {
+	commands := []string{
+		"push constant 17",
+		"push local 2",
+		"add",
+		"push argument 1   // trailing comment",
+		"sub",
+		"pop that 5",
+		"push temp 3",
+		"pop pointer 1",
+		"push static 4",
+		"pop this 0",
+		"",
+	}
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		b.WriteString(commands[i%len(commands)])
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func benchmarkTranslate(b *testing.B, lines int) {
+	program := syntheticProgram(lines)
+	b.SetBytes(int64(len(program)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		instrs, err := translateInstructions(strings.NewReader(program), Options{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		w := bufio.NewWriter(io.Discard)
+		if err := writeInstructions(w, instrs, Options{}); err != nil {
+			b.Fatal(err)
+		}
+		w.Flush()
+	}
+}
+
+func BenchmarkTranslate1k(b *testing.B)   { benchmarkTranslate(b, 1000) }
+func BenchmarkTranslate100k(b *testing.B) { benchmarkTranslate(b, 100000) }
+
+// Streaming reuses one instruction, so memory shouldn't grow with the input
+func BenchmarkTranslateStream100k(b *testing.B) {
+	program := syntheticProgram(100000)
+	b.SetBytes(int64(len(program)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := bufio.NewWriter(io.Discard)
+		aw := newAsmWriter(w, Options{})
+		err := translateStream(strings.NewReader(program), Options{}, func(instr *Instruction) error {
+			aw.writeInstruction(instr)
+			return aw.err
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		aw.finish()
+		w.Flush()
+	}
+}
+
+func BenchmarkParse(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		line := NewInstruction("push  local 1200 // comment")
+		if err := line.parse(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Guard against regressions in the number of allocations per VM command
+func TestTranslateAllocs(t *testing.T) {
+	// setup
+	lines := 1000
+	program := syntheticProgram(lines)
+	maxPerLine := 8.0
+	// test
+	allocs := testing.AllocsPerRun(5, func() {
+		instrs, _ := translateInstructions(strings.NewReader(program), Options{})
+		writeInstructions(bufio.NewWriter(io.Discard), instrs, Options{})
+	})
+	// assert
+	if perLine := allocs / float64(lines); perLine > maxPerLine {
+		t.Fatalf("Wanted at most %v allocs per line, got %v", maxPerLine, perLine)
+	}
+}
+
+func TestWriteListing(t *testing.T) {
+	// setup
+	line := NewInstruction("push constant 7")
+	line.lineNum = 3
+	check(line.parse())
+	line.Translate()
+	line.outputLines("// <seven>")
+	entries := []listingEntry{newListingEntry(&line)}
+	var b strings.Builder
+	// test
+	check(writeListing(&b, "Test.vm", entries))
+	html := b.String()
+	// assert
+	if !strings.Contains(html, `id="L3"`) || !strings.Contains(html, `<span class="ainstr">@7</span>`) {
+		t.Fatalf("Listing missing anchor or assembly:\n%v", html)
+	}
+	if !strings.Contains(html, "&lt;seven&gt;") {
+		t.Fatalf("Listing didn't escape source:\n%v", html)
+	}
+}
+
+func TestAnnotateListing(t *testing.T) {
+	// setup
+	var entries []listingEntry
+	for i, source := range []string{"push constant 1", "push local 0", "add"} {
+		line := NewInstruction(source)
+		line.lineNum = i + 1
+		check(line.parse())
+		line.Translate()
+		entry := newListingEntry(&line)
+		entry.Unit = "Main"
+		entries = append(entries, entry)
+	}
+	profile := []profileEntry{
+		{File: "dir/Main.vm", Line: 1, Count: 4, Cycles: 28},
+		{File: "dir/Main.vm", Line: 2, Count: 2, Cycles: 40},
+		{File: "dir/Other.vm", Line: 3, Count: 9, Cycles: 90},
+	}
+	// test
+	annotateListing(entries, profile, 1)
+	var b strings.Builder
+	check(writeListing(&b, "Main.vm", entries))
+	// assert
+	if entries[0].Count != 4 || entries[1].Count != 2 || entries[2].Count != 0 {
+		t.Fatalf("Wanted counts 4, 2 and 0 matched by unit and line, got %+v", entries)
+	}
+	if entries[0].Hot || !entries[1].Hot || entries[2].Hot {
+		t.Fatalf("Wanted only push local 0, taking the most cycles, hot, got %+v", entries)
+	}
+	if html := b.String(); !strings.Contains(html, `<tr id="L2" class="hot">`) || !strings.Contains(html, `<td class="count">4</td>`) {
+		t.Fatalf("Listing missing hot row or run counts:\n%v", html)
+	}
+}
+
+func TestTranslateString(t *testing.T) {
+	// test
+	asm, err := translateString("push constant 7\n\n// comment\nadd", Options{})
+	// assert
+	if err != nil {
+		t.Fatalf("translateString failed: %v", err)
+	}
+	if !strings.HasPrefix(asm, "// push constant 7\n@7\n") || !strings.Contains(asm, "\n\n// add\n") {
+		t.Fatalf("Unexpected assembly:\n%v", asm)
+	}
+	if _, err := translateString("invalid", Options{}); err == nil {
+		t.Fatalf("Expected invalid source to produce err")
+	}
+}
+
+func TestTranslateMinify(t *testing.T) {
+	// setup
+	source := syntheticProgram(50) + "//#asm\n@SP // trailing comment\nM=M+1\n//#endasm\n"
+	plain, err := translateString(source, Options{Trace: true})
+	check(err)
+	// test
+	minified, err := translateString(source, Options{Trace: true, Minify: true})
+	check(err)
+	// assert
+	if strings.Contains(minified, "//") || strings.Contains(minified, "\n\n") || !strings.Contains(minified, "\n@SP\nM=M+1") {
+		t.Fatalf("Expected no comments or blank lines, got:\n%v", minified)
+	}
+	plainROM, _ := assemble(plain)
+	minifiedROM, _ := assemble(minified)
+	if len(minifiedROM) == 0 || !reflect.DeepEqual(plainROM, minifiedROM) {
+		t.Fatalf("Expected minified output to assemble to the same %d words, got %d", len(plainROM), len(minifiedROM))
+	}
+}
+
+func TestTranslateExplain(t *testing.T) {
+	// setup
+	source := "push local 2\npop pointer 1\nadd\n"
+	// test
+	asm, err := translateString(source, Options{Explain: true, Unit: "Main"})
+	check(err)
+	// assert
+	for _, want := range []string{
+		"// push local 2\n// computes LCL+2, pushes the value at that address onto the stack and increments SP\n@2\n",
+		"// pop pointer 1\n// decrements SP and stores the value on top of the stack in THAT, which moves the that segment\n",
+		"// add\n// decrements SP, adds the value",
+	} {
+		if !strings.Contains(asm, want) {
+			t.Fatalf("Expected %q in:\n%v", want, asm)
+		}
+	}
+	plain, _ := translateString(source, Options{})
+	plainROM, _ := assemble(plain)
+	explainedROM, _ := assemble(asm)
+	if !reflect.DeepEqual(plainROM, explainedROM) {
+		t.Fatalf("Expected explanations to leave the code as it was")
+	}
+}
+
+func TestTranslateTeach(t *testing.T) {
+	// test
+	asm, err := translateString("push static 3\nadd\n", Options{Teach: true, Unit: "Foo"})
+	check(err)
+	// assert
+	want := "// push static 3\n// goal: *SP=Foo.i, SP++\n// registers: A, D\n// symbols: Foo.3, SP\n// stack: pops 0, pushes 1\n@Foo.3\n"
+	if !strings.Contains(asm, want) {
+		t.Fatalf("Wanted %q in:\n%v", want, asm)
+	}
+	if !strings.Contains(asm, "// add\n// goal: SP--, D=*SP, *(SP-1)=*(SP-1)+D\n") || !strings.Contains(asm, "// stack: pops 2, pushes 1\n") {
+		t.Fatalf("Wanted the goal and stack effect of add, got:\n%v", asm)
+	}
+}
+
+func TestTranslatePopConstant(t *testing.T) {
+	// test
+	_, err := translateString("push constant 1\npop constant 2\n", Options{})
+	// assert
+	var srcErr *SourceError
+	if !errors.As(err, &srcErr) || srcErr.Line != 2 {
+		t.Fatalf("Expected pop constant produce err on line 2, got %v", err)
+	}
+}
+
+// A memory-mapped segment at a fixed address, e.g. the keyboard, accessed
+// as temp is
+type fixedSegment struct{ addr int }
+
+func (s fixedSegment) Push(asm []string, index int) ([]string, error) {
+	return renderSnippet(asm, "push-temp", snippetData{Index: index, Address: s.addr + index})
+}
+
+func (s fixedSegment) Pop(asm []string, index int) ([]string, error) {
+	return renderSnippet(asm, "pop-temp", snippetData{Index: index, Address: s.addr + index})
+}
+
+func TestRegisterSegment(t *testing.T) {
+	// setup
+	codegen.RegisterSegment("keyboard", fixedSegment{24576})
+	defer codegen.RegisterSegment("keyboard", nil)
+	line := NewInstruction("push keyboard 0")
+	// test
+	err := line.parse()
+	line.Translate()
+	// assert
+	if err != nil {
+		t.Fatalf("Registered segment didn't parse: %v", err)
+	}
+	want, _ := renderSnippet(nil, "push-temp", snippetData{Address: 24576})
+	if !slices.Equal(line.translatedLines, want) {
+		t.Fatalf("Registered segment not used, wanted %q, got %q", want, line.translatedLines)
+	}
+}
+
+func TestLoadTemplates(t *testing.T) {
+	// setup
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "pop-temp.tmpl"), []byte("@SP\nAM=M-1\nD=M\n  @{{.Address}}\n\nM=D\n"), 0o644)
+	defer func(tmpl *template.Template, docs map[string]string, overrides string) {
+		snippets.tmpl, snippets.docs, snippets.overrides, snippets.cache = tmpl, docs, overrides, nil
+	}(snippets.tmpl, snippets.docs, snippets.overrides)
+
+	// test
+	err := LoadTemplates(dir)
+	check(err)
+	asm, err := translateString("push constant 3\npop temp 2\npush temp 2", Options{})
+
+	// assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "// pop temp 2\n@SP\nAM=M-1\nD=M\n@7\nM=D\n"; !strings.Contains(asm, want) {
+		t.Fatalf("Wanted the template's code %q, got %q", want, asm)
+	}
+	if !strings.Contains(asm, "// push temp 2\n@7\nD=M\n") {
+		t.Fatalf("Wanted the built-in push temp kept, got %q", asm)
+	}
+
+	// setup
+	os.WriteFile(filepath.Join(dir, "pop-tmp.tmpl"), []byte("@SP\n"), 0o644)
+	// test
+	err = LoadTemplates(dir)
+	// assert
+	if err == nil {
+		t.Fatalf("Expected pop-tmp.tmpl produce err")
+	}
+}
+
+func TestScratchRegister(t *testing.T) {
+	// setup
+	defer SetScratchRegister("R13")
+	for _, name := range []string{"R13", "R15"} {
+		if err := SetScratchRegister(name); err != nil {
+			t.Fatal(err)
+		}
+		line := NewInstruction("pop local 2")
+		line.parse()
+		// test
+		line.Translate()
+		// assert
+		asm := strings.Join(line.translatedLines, " ")
+		if !strings.Contains(asm, "@"+name) || strings.Contains(asm, "@LCL M=D") {
+			t.Fatalf("Expected pop through %v leaving LCL alone, got %q", name, asm)
+		}
+	}
+	if err := SetScratchRegister("addr"); err == nil {
+		t.Fatalf("Expected scratch register addr produce err")
+	}
+}
+
+func TestLstWriter(t *testing.T) {
+	// setup
+	instrs, err := translateInstructions(strings.NewReader("push constant 7\npush constant 8\nadd\n"), Options{})
+	check(err)
+	var b strings.Builder
+	lw := newLstWriter(&b)
+	// test
+	lw.writeLines("", []string{"// setup", "(START)"})
+	for _, instr := range instrs {
+		lw.writeInstruction("Main.vm", instr)
+	}
+	// assert
+	lines := strings.Split(b.String(), "\n")
+	if lines[2] != "     0  @7               // Main.vm:1: push constant 7" {
+		t.Fatalf("Unexpected first instruction %q", lines[2])
+	}
+	if !strings.Contains(b.String(), "    14  @SP              // Main.vm:3: add\n") {
+		t.Fatalf("Expected add at ROM address 14, got:\n%v", b.String())
+	}
+	if lw.rom != 19 {
+		t.Fatalf("Wanted 19 ROM words, got %v", lw.rom)
+	}
+}
+
+func TestWriteSymbols(t *testing.T) {
+	// setup
+	asm, err := translateString("push constant 7\n//#asm\n(LOOP)\n@LOOP\n0;JMP\n(END)\n(DONE)\n//#endasm\n", Options{})
+	check(err)
+	_, labels, err := assembleLabels(asm)
+	check(err)
+	var b strings.Builder
+	// test
+	err = writeSymbols(&b, labels)
+	// assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "     7  LOOP\n     9  DONE\n     9  END\n"
+	if b.String() != want {
+		t.Fatalf("Wanted symbols\n%v\ngot\n%v", want, b.String())
+	}
+}
+
+func TestCheckStack(t *testing.T) {
+	type testCase struct {
+		source string
+		line   int // Line of the expected error, 0 for none
+	}
+	cases := []testCase{
+		{"push constant 1\npush constant 2\nadd\npop temp 0\n", 0},
+		{"push constant 1\nadd\n", 2},
+		{"push constant 1\n\n// nothing left\npop temp 0\npop temp 1\n", 5},
+		{strings.Repeat("push constant 1\n", stackCapacity+1), stackCapacity + 1},
+	}
+	for _, c := range cases {
+		// test
+		_, err := translateString(c.source, Options{CheckStack: true})
+		// assert
+		var srcErr *SourceError
+		if c.line == 0 && err != nil {
+			t.Fatalf("Expected %q to pass the stack check, got %v", c.source, err)
+		}
+		if c.line != 0 && (!errors.As(err, &srcErr) || srcErr.Line != c.line) {
+			t.Fatalf("Expected stack error on line %v, got %v", c.line, err)
+		}
+	}
+
+	// assert
+	var underflow *StackUnderflowError
+	_, err := translateString("push constant 1\nadd\n", Options{CheckStack: true})
+	if !errors.As(err, &underflow) || underflow.Op != "add" || underflow.Depth != 1 {
+		t.Fatalf("Expected a StackUnderflowError for add, got %#v", err)
+	}
+	var overflow *StackOverflowError
+	_, err = translateString(strings.Repeat("push constant 1\n", stackCapacity+1), Options{CheckStack: true})
+	if !errors.As(err, &overflow) || overflow.Capacity != stackCapacity {
+		t.Fatalf("Expected a StackOverflowError, got %v", err)
+	}
+}
+
+func TestBytecodeRoundTrip(t *testing.T) {
+	// setup
+	tail := "push constant 32767\n// a comment\n//#asm\n@SP\nM=M+1 // bump\n//#endasm\n"
+	source := syntheticProgram(200) + tail
+	instrs, err := translateInstructions(strings.NewReader(source), Options{Backend: nullBackend{}, KeepComments: true})
+	check(err)
+	var b strings.Builder
+	// test
+	check(encodeProgram(&b, instrs))
+	decoded, err := decodeProgram(strings.NewReader(b.String()))
+	// assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(instrs) {
+		t.Fatalf("Wanted %d instructions, got %d", len(instrs), len(decoded))
+	}
+	for i, instr := range decoded {
+		want := instrs[i]
+		if instr.lineNum != want.lineNum || instr.operation != want.operation || instr.segment != want.segment || instr.value != want.value {
+			t.Fatalf("Instruction %d decoded as %+v, wanted %+v", i, instr, want)
+		}
+		if hasLines(want.operation) && !slices.Equal(instr.translatedLines, want.translatedLines) {
+			t.Fatalf("Instruction %d decoded with lines %q, wanted %q", i, instr.translatedLines, want.translatedLines)
+		}
+	}
+	if n := len(decoded); decoded[n-2].operation != "comment" || decoded[n-1].operation != "asm" {
+		t.Fatalf("Wanted the comment and inline assembly decoded last, got %+v", decoded[n-2:])
+	}
+	// Commands keep their lines, and comments and inline assembly their text
+	if got := programSource(decoded); strings.Count(got, "\n") != strings.Count(source, "\n") || !strings.HasSuffix(got, tail) {
+		t.Fatalf("Wanted the decoded program as source ending\n%v\ngot:\n%v", tail, got)
+	}
+	if b.Len() >= len(source)/2 {
+		t.Fatalf("Expected bytecode well under the %d bytes of source, got %d", len(source), b.Len())
+	}
+
+	if _, err := decodeProgram(strings.NewReader("VMBD\x01")); err == nil {
+		t.Fatalf("Expected bad magic produce err")
+	}
+	if _, err := decodeProgram(strings.NewReader(b.String()[:b.Len()-1])); err == nil {
+		t.Fatalf("Expected truncated bytecode produce err")
+	}
+}
+
+func TestWriteDiagnostic(t *testing.T) {
+	// setup
+	_, err := translateString("push constant 1\npop nowhere 1 // comment\n", Options{})
+	var out strings.Builder
+	// test
+	check(writeDiagnostic(&out, err, false))
+	// assert
+	want := "line 2: error: undefined segment type nowhere\n" +
+		"    2 | pop nowhere 1 // comment\n" +
+		"      |     ^~~~~~~\n"
+	if out.String() != want {
+		t.Fatalf("Wanted diagnostic:\n%q\ngot:\n%q", want, out.String())
+	}
+
+	out.Reset()
+	check(writeDiagnostic(&out, err, true))
+	if !strings.Contains(out.String(), "\x1b[1;31merror:\x1b[0m") {
+		t.Fatalf("Expected a coloured diagnostic, got %q", out.String())
+	}
+}
+
+func TestReporter(t *testing.T) {
+	// setup
+	var errs, warnings, summary strings.Builder
+	r := &reporter{errOut: &errs, warnOut: &warnings}
+	// test
+	r.warn("Main.vm", 3, "sub of constant 0 has no effect")
+	r.warn("Main.vm", 5, "add of constant 0 has no effect")
+	r.summary(&summary)
+	// assert
+	if warnings.String() != "Main.vm:3: warning: sub of constant 0 has no effect\nMain.vm:5: warning: add of constant 0 has no effect\n" || errs.Len() != 0 {
+		t.Fatalf("Expected only warnings, got %q and errors %q", warnings.String(), errs.String())
+	}
+	if summary.String() != "2 warnings\n" || r.status() != 0 {
+		t.Fatalf("Wanted 2 warnings and status 0, got %q and %v", summary.String(), r.status())
+	}
+
+	// setup
+	errs.Reset()
+	summary.Reset()
+	r = &reporter{errOut: &errs, warnOut: &warnings, werror: true}
+	_, err := translateString("pop nowhere 1\n", Options{})
+	// test
+	r.warn("Main.vm", 3, "sub of constant 0 has no effect")
+	r.error(err)
+	r.summary(&summary)
+	// assert
+	if !strings.HasPrefix(errs.String(), "Main.vm:3: error: sub of constant 0 has no effect [-Werror]\n") {
+		t.Fatalf("Expected the warning promoted to an error, got %q", errs.String())
+	}
+	if summary.String() != "2 errors\n" || r.status() != 1 {
+		t.Fatalf("Wanted 2 errors and status 1, got %q and %v", summary.String(), r.status())
+	}
+}
+
+func TestInlineAsm(t *testing.T) {
+	// setup
+	source := "push constant 1\n//#asm\n@7\nD=A\n@R14\nM=D\n  //#endasm\npush constant 2\n"
+	// test
+	m := runVM(t, source, Options{})
+	// assert
+	if m.RAM[14] != 7 || m.RAM[256] != 1 || m.RAM[257] != 2 {
+		t.Fatalf("Expected the block to run between the pushes, got R14 = %v, stack %v", m.RAM[14], m.RAM[256:258])
+	}
+
+	type testCase struct {
+		source string
+		line   int
+	}
+	for _, c := range []testCase{
+		{"push constant 1\n//#asm\n@7\nD=Q\n//#endasm\n", 4},
+		{"push constant 1\n//#asm\n@7\n", 2},
+	} {
+		// test
+		_, err := translateString(c.source, Options{})
+		// assert
+		var srcErr *SourceError
+		if !errors.As(err, &srcErr) || srcErr.Line != c.line {
+			t.Fatalf("Expected err on line %v, got %v", c.line, err)
+		}
+	}
+}
+
+func TestKeepComments(t *testing.T) {
+	// setup
+	source := "// Adds two numbers\n//   carefully\npush constant 1 // one\n\npush constant 2\nadd\n"
+	// test
+	asm, err := translateString(source, Options{KeepComments: true})
+	check(err)
+	// assert
+	if !strings.HasPrefix(asm, "// Adds two numbers\n// carefully\n\n// push constant 1 // one\n@SP\n") {
+		t.Fatalf("Expected comments carried into the output, got:\n%v", asm)
+	}
+	plain, _ := translateString(source, Options{})
+	if strings.Contains(plain, "carefully") || strings.Contains(plain, "// one") {
+		t.Fatalf("Expected comments dropped by default, got:\n%v", plain)
+	}
+}
+
+func TestKeepGoing(t *testing.T) {
+	// setup
+	source := "push constant 1\npop nowhere 1\npush constant 2\nfoo\nadd\n//#asm\n@7\n"
+	var b strings.Builder
+	aw := newAsmWriter(&b, Options{})
+	// test
+	err := translateStream(strings.NewReader(source), Options{KeepGoing: true}, func(instr *Instruction) error {
+		aw.writeInstruction(instr)
+		return aw.err
+	})
+	aw.finish()
+	// assert
+	var list ErrorList
+	if !errors.As(err, &list) || len(list) != 3 || list[0].Line != 2 || list[1].Line != 4 || list[2].Line != 6 {
+		t.Fatalf("Expected errs on lines 2, 4 and 6, got %v", err)
+	}
+	asm := b.String()
+	if !strings.Contains(asm, "// line 2 not translated: undefined segment type nowhere\n") || !strings.Contains(asm, "// add\n") {
+		t.Fatalf("Expected a placeholder for each bad line and the rest translated, got:\n%v", asm)
+	}
+	var out strings.Builder
+	check(writeDiagnostic(&out, err, false))
+	if strings.Count(out.String(), "error:") != 3 {
+		t.Fatalf("Expected a diagnostic for each err, got:\n%v", out.String())
+	}
+}
+
+func TestFormatVM(t *testing.T) {
+	// setup
+	source := "\n\tpush  constant 7   // seven \r\n\n\n  add\n//  note\n  //#asm\n  @5\n//#endasm\n\n"
+	want := "push constant 7 // seven\n\nadd\n//  note\n//#asm\n  @5\n//#endasm\n"
+
+	// test
+	got := formatVM(source)
+
+	// assert
+	if got != want {
+		t.Fatalf("Wanted %q, got %q", want, got)
+	}
+	if again := formatVM(got); again != got {
+		t.Fatalf("Wanted formatting to be stable, got %q", again)
+	}
+}
+
+func TestLintVM(t *testing.T) {
+	// setup
+	source := "push constant 7\npush constant 0\nsub\npop temp 1\npush temp 1\npop temp 1\npush static 2\npush static 4\npop static 4\n"
+	want := []lintWarning{
+		{3, "sub of constant 0 has no effect"},
+		{6, "pop temp 1 straight after pushing it has no effect"},
+		{7, "static 2 is pushed but never popped to, so is always 0"},
+		{9, "pop static 4 straight after pushing it has no effect"},
+	}
+
+	// test
+	got, err := lintVM(source, "Main", Options{})
+
+	// assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Wanted %v, got %v", want, got)
+	}
+	if _, err := lintVM("pop local 0\n", "Main", Options{}); err == nil {
+		t.Fatalf("Expected stack underflow produce err")
+	}
+}
+
+// Counts the arithmetic commands it visits, and fails on pops to temp
+type arithmeticCounter struct {
+	NopVisitor
+	count int
+}
+
+func (c *arithmeticCounter) VisitArithmetic(n *Arithmetic) error {
+	c.count++
+	return nil
+}
+
+func (c *arithmeticCounter) VisitPushPop(n *PushPop) error {
+	if n.Pop && n.Segment == "temp" {
+		return errors.New("no temps")
+	}
+	return nil
+}
+
+func TestWalk(t *testing.T) {
+	// setup
+	source := "push constant 1\npush static 2 // two\nadd\n//#asm\n@5\n//#endasm\npop temp 0\n"
+	nodes, err := ParseNodes(strings.NewReader(source), "Foo", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Node{
+		&PushPop{NodePos{"Foo", 1, "push constant 1"}, false, "constant", 1},
+		&PushPop{NodePos{"Foo", 2, "push static 2 // two"}, false, "static", 2},
+		&Arithmetic{NodePos{"Foo", 3, "add"}, "add"},
+		&InlineAsm{NodePos{"Foo", 4, "//#asm"}, []string{"@5"}},
+		&PushPop{NodePos{"Foo", 7, "pop temp 0"}, true, "temp", 0},
+	}
+	if !reflect.DeepEqual(nodes, want) {
+		t.Fatalf("Wanted %v, got %v", want, nodes)
+	}
+	counter := &arithmeticCounter{}
+
+	// test
+	err = Walk(nodes, counter)
+
+	// assert
+	var srcErr *SourceError
+	if !errors.As(err, &srcErr) || srcErr.Line != 7 {
+		t.Fatalf("Wanted the visitor's error at line 7, got %v", err)
+	}
+	if counter.count != 1 {
+		t.Fatalf("Wanted 1 arithmetic command visited, got %v", counter.count)
+	}
+}
+
+func TestBuildIR(t *testing.T) {
+	// setup
+	sources := []sourceFile{
+		{"A.vm", "push constant 1\n//#asm\n@5\n//#endasm\npush constant 2\nadd\n"},
+		{"B.vm", "push constant 3\npop static 0\n"},
+	}
+	// test
+	prog, err := BuildIR(sources, Options{})
+	// assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	var shape [][]int
+	for _, fn := range prog.Functions {
+		var sizes []int
+		for _, block := range fn.Blocks {
+			sizes = append(sizes, len(block.Nodes))
+		}
+		shape = append(shape, sizes)
+	}
+	if want := [][]int{{1, 1, 2}, {2}}; !reflect.DeepEqual(shape, want) {
+		t.Fatalf("Wanted blocks of %v commands, got %v", want, shape)
+	}
+	if !strings.Contains(prog.String(), "function B (B.vm)\n  block 0\n    push constant 3") {
+		t.Fatalf("Wanted each function listed with its blocks, got %q", prog.String())
+	}
+
+	// test
+	_, err = BuildIR([]sourceFile{{"C.vm", "pop constant 1\n"}}, Options{})
+	// assert
+	var srcErr *SourceError
+	if !errors.As(err, &srcErr) || srcErr.File != "C.vm" {
+		t.Fatalf("Wanted an error located in C.vm, got %v", err)
+	}
+}
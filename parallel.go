@@ -0,0 +1,70 @@
+//go:build !js
+
+package main
+
+import (
+	"path/filepath"
+	"sync"
+)
+
+// The instructions of a .vm file translated ahead of writing the output, or
+// the error translating it
+type translatedFile struct {
+	instrs []Instruction
+	err    error
+}
+
+// Pass the instructions to emit in order, then return the translation error
+// if there was one, as translating the file while writing would
+func (f *translatedFile) replay(_ string, _ cliConfig, emit func(*Instruction) error) error {
+	for i := range f.instrs {
+		if err := emit(&f.instrs[i]); err != nil {
+			return err
+		}
+	}
+	return f.err
+}
+
+// Translate the .vm files of filenames with up to jobs at a time, keeping
+// each file's instructions until the output is written in order. Files are
+// independent, as each is a function of the IR, so only their order matters.
+// The result has an entry for each filename, nil for those that aren't .vm
+// files.
+func translateConcurrently(filenames []string, cfg cliConfig, jobs int) []*translatedFile {
+	results := make([]*translatedFile, len(filenames))
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				results[i] = translateAhead(filenames[i], cfg)
+			}
+		}()
+	}
+	for i, filename := range filenames {
+		if filepath.Ext(filename) != ".asm" {
+			work <- i
+		}
+	}
+	close(work)
+	wg.Wait()
+	return results
+}
+
+// Translate a .vm file, keeping its instructions
+func translateAhead(filename string, cfg cliConfig) *translatedFile {
+	translate := translateFile
+	if cfg.cache != nil {
+		translate = cfg.cache.translateFile
+	}
+	var f translatedFile
+	f.err = translate(filename, cfg, func(instr *Instruction) error {
+		kept := *instr
+		kept.translatedLines = append([]string(nil), instr.translatedLines...)
+		f.instrs = append(f.instrs, kept)
+		return nil
+	})
+	return &f
+}
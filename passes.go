@@ -0,0 +1,452 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/schallis/vm-translator/codegen"
+)
+
+// An optimisation pass rewriting the Hack assembly of one instruction. Run
+// is given the instruction's translated lines and returns the rewritten lines,
+// which may reuse the same backing array.
+//
+// A pass may instead set Fuse to rewrite the boundary between two commands
+// that follow each other, once Run has been over both. It replaces the
+// translated lines of either as it likes. Or it may set Schedule to report
+// whether the first of three commands in a row can move after the other two,
+// which happens before they are fused.
+type Pass struct {
+	Name        string
+	Level       int // Lowest optimisation level the pass runs at
+	Description string
+	Run         func(asm []string) []string
+	Fuse        func(prev, next *Instruction)
+	Schedule    func(a, b, c *Instruction) bool
+}
+
+// Registered passes, in the order they run
+var passes []Pass
+
+// Register a pass to run after the passes already registered
+func RegisterPass(p Pass) {
+	passes = append(passes, p)
+}
+
+func init() {
+	RegisterPass(Pass{
+		Name:        "fold-address",
+		Level:       1,
+		Description: "compute an address straight into A rather than through D",
+		Run: func(asm []string) []string {
+			return peephole(asm, []string{"D=D+A", "A=D", "D=M"}, "A=D+A", "D=M")
+		},
+	})
+	RegisterPass(Pass{
+		Name:        "fold-decrement",
+		Level:       1,
+		Description: "merge a load or store with the decrement following it",
+		Run: func(asm []string) []string {
+			asm = peephole(asm, []string{"A=M", "A=A-1"}, "A=M-1")
+			return peephole(asm, []string{"M=M-1", "A=M"}, "AM=M-1")
+		},
+	})
+	RegisterPass(Pass{
+		Name:        "push-d",
+		Level:       2,
+		Description: "increment SP before storing D, saving a reload of SP",
+		Run: func(asm []string) []string {
+			return peephole(asm, []string{"@SP", "A=M", "M=D", "@SP", "M=M+1"}, "@SP", "M=M+1", "A=M-1", "M=D")
+		},
+	})
+	RegisterPass(Pass{
+		Name:        "schedule",
+		Level:       2,
+		Description: "push a value after the push and pop that follow it, so each push is popped straight away",
+		Schedule:    canSinkPush,
+	})
+	RegisterPass(Pass{
+		Name:        "direct-move",
+		Level:       2,
+		Description: "move the value of a push straight into the segment of the pop after it",
+		Fuse: func(prev, next *Instruction) {
+			if prev.operation == "push" && next.operation == "pop" {
+				prev.translatedLines, next.translatedLines = directMove(prev.translatedLines, next.translatedLines)
+			}
+		},
+	})
+	RegisterPass(Pass{
+		Name:        "fuse-sp",
+		Level:       2,
+		Description: "drop a push's increment of SP and the decrement popping it straight after",
+		Fuse: func(prev, next *Instruction) {
+			prev.translatedLines, next.translatedLines = fuseSP(prev.translatedLines, next.translatedLines)
+		},
+	})
+}
+
+// Ends of a push, leaving the value pushed in D
+var pushTails = [][]string{
+	{"@SP", "A=M", "M=D", "@SP", "M=M+1"},
+	{"@SP", "M=M+1", "A=M-1", "M=D"},
+}
+
+// Starts of a pop into D, leaving A pointing at the value popped
+var popHeads = [][]string{
+	{"@SP", "AM=M-1", "D=M"},
+	{"@SP", "M=M-1", "A=M", "D=M"},
+}
+
+// Store a pushed value without moving SP when the next command pops it
+// straight back into D. Both leave D holding the value, A pointing at it and
+// SP where it started, so the next command carries on as before.
+func fuseSP(prev, next []string) ([]string, []string) {
+	tail := pushTail(prev)
+	if tail == 0 {
+		return prev, next
+	}
+	for _, head := range popHeads {
+		if matchLines(next, head) {
+			prev = append(prev[:len(prev)-tail], "@SP", "A=M", "M=D")
+			return prev, next[len(head):]
+		}
+	}
+	return prev, next
+}
+
+// Whether push a; push b; pop c can become push b; pop c; push a, leaving the
+// same values on the stack. It can as long as c doesn't write anything a
+// reads, which is judged conservatively: segments addressed through a base
+// pointer may point anywhere, so only differing indexes from the same base
+// are known not to overlap. Nothing is known about segments added with
+// codegen.RegisterSegment, so they may overlap anything.
+func canSinkPush(a, b, c *Instruction) bool {
+	if a.operation != "push" || b.operation != "push" || c.operation != "pop" {
+		return false
+	}
+	aHandler, _ := codegen.LookupSegment(a.segment)
+	cHandler, _ := codegen.LookupSegment(c.segment)
+	if _, ok := aHandler.(constantSegment); ok {
+		return true
+	}
+	if !builtinSegment(aHandler) || !builtinSegment(cHandler) {
+		return false
+	}
+	_, aBase := aHandler.(baseSegment)
+	_, cBase := cHandler.(baseSegment)
+	switch {
+	case c.segment == "pointer":
+		// Moving THIS or THAT moves everything addressed from them
+		return !aBase && a.segment != "pointer"
+	case aBase || cBase:
+		return a.segment == c.segment && a.value != c.value
+	}
+	return a.segment != c.segment || a.value != c.value
+}
+
+// Largest index of a base segment that direct-move counts up to rather than
+// keeping the address in the scratch register
+const maxDirectOffset = 8
+
+// Skip the stack when a pop takes the value just pushed, storing it straight
+// from D. A pop to a fixed address just loses the decrement of SP. A pop to a
+// base segment, which would need D for the address, instead counts A up from
+// the base.
+func directMove(prev, next []string) ([]string, []string) {
+	tail := pushTail(prev)
+	if tail == 0 {
+		return prev, next
+	}
+	load := prev[:len(prev)-tail]
+
+	// e.g. pop temp 0: @SP, AM=M-1, D=M, @5, M=D
+	for _, head := range popHeads {
+		if matchLines(next, head) && len(next) > len(head) && strings.HasPrefix(next[len(head)], "@") {
+			return load, next[len(head):]
+		}
+	}
+
+	// e.g. pop local 2: @2, D=A, @LCL, D=D+M, @R13, M=D, then the pop into
+	// *R13
+	if len(next) < 6 || !matchLines(next[1:6], []string{"D=A", next[2], "D=D+M", scratchRegister, "M=D"}) {
+		return prev, next
+	}
+	index, err := strconv.Atoi(strings.TrimPrefix(next[0], "@"))
+	if err != nil || index > maxDirectOffset || !isBasePointer(next[2]) {
+		return prev, next
+	}
+	for _, head := range popHeads {
+		rest := next[6:]
+		if !matchLines(rest, head) || !matchLines(rest[len(head):], []string{scratchRegister, "A=M", "M=D"}) || len(rest) != len(head)+3 {
+			continue
+		}
+		move := []string{next[2], "A=M"}
+		if index > 0 {
+			move[1] = "A=M+1"
+		}
+		for i := 1; i < index; i++ {
+			move = append(move, "A=A+1")
+		}
+		return load, append(next[:0], append(move, "M=D")...)
+	}
+	return prev, next
+}
+
+// Whether handler is one of the segments built into the translator, whose
+// addresses canSinkPush knows
+func builtinSegment(handler codegen.SegmentHandler) bool {
+	switch handler.(type) {
+	case baseSegment, constantSegment, tempSegment, staticSegment, pointerSegment:
+		return true
+	}
+	return false
+}
+
+// Whether line loads one of the pointers base segments are addressed from
+func isBasePointer(line string) bool {
+	for _, s := range codegen.Segments() {
+		if b, ok := s.(baseSegment); ok && b.base == line {
+			return true
+		}
+	}
+	return false
+}
+
+// Length of the push tail asm ends with, or 0 if it doesn't end with one
+func pushTail(asm []string) int {
+	for _, tail := range pushTails {
+		if len(asm) >= len(tail) && matchLines(asm[len(asm)-len(tail):], tail) {
+			return len(tail)
+		}
+	}
+	return 0
+}
+
+// Replace every run of lines matching pattern by replacement, in place. The
+// replacement must be no longer than the pattern.
+func peephole(asm []string, pattern []string, replacement ...string) []string {
+	out := asm[:0]
+	for i := 0; i < len(asm); {
+		if matchLines(asm[i:], pattern) {
+			out = append(out, replacement...)
+			i += len(pattern)
+		} else {
+			out = append(out, asm[i])
+			i++
+		}
+	}
+	return out
+}
+
+// Whether asm starts with the lines of pattern
+func matchLines(asm, pattern []string) bool {
+	if len(asm) < len(pattern) {
+		return false
+	}
+	for i, line := range pattern {
+		if asm[i] != line {
+			return false
+		}
+	}
+	return true
+}
+
+// Runs the passes selected for a translation. A nil PassManager runs nothing.
+type PassManager struct {
+	passes []Pass
+}
+
+// Select the registered passes for an optimisation level. overrides enables
+// or disables passes by name regardless of the level.
+func newPassManager(level int, overrides map[string]bool) (*PassManager, error) {
+	for name := range overrides {
+		if !passRegistered(name) {
+			return nil, fmt.Errorf("unknown pass %v", name)
+		}
+	}
+
+	pm := &PassManager{}
+	for _, p := range passes {
+		enabled, ok := overrides[p.Name]
+		if !ok {
+			enabled = p.Level <= level
+		}
+		if enabled {
+			pm.passes = append(pm.passes, p)
+		}
+	}
+	return pm, nil
+}
+
+func passRegistered(name string) bool {
+	for _, p := range passes {
+		if p.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Run every selected pass over an instruction's assembly
+func (pm *PassManager) run(instr *Instruction) {
+	if pm == nil {
+		return
+	}
+	for _, p := range pm.passes {
+		if p.Run != nil {
+			instr.translatedLines = p.Run(instr.translatedLines)
+		}
+	}
+}
+
+// Whether any selected pass reorders commands
+func (pm *PassManager) scheduling() bool {
+	if pm == nil {
+		return false
+	}
+	for _, p := range pm.passes {
+		if p.Schedule != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether a selected pass moves a after the two commands following it
+func (pm *PassManager) schedule(a, b, c *Instruction) bool {
+	for _, p := range pm.passes {
+		if p.Schedule != nil && p.Schedule(a, b, c) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether any selected pass fuses commands, so each must be held back until
+// the next is translated
+func (pm *PassManager) fusing() bool {
+	if pm == nil {
+		return false
+	}
+	for _, p := range pm.passes {
+		if p.Fuse != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Run every selected fusing pass over the boundary between two commands
+func (pm *PassManager) fuse(prev, next *Instruction) {
+	for _, p := range pm.passes {
+		if p.Fuse != nil {
+			p.Fuse(prev, next)
+		}
+	}
+}
+
+// Passes commands on to emit, holding a few back when passes reorder or fuse
+// them so each is only emitted once it can't change. Anything else emitted,
+// such as inline assembly, must flush the held commands first.
+type fuser struct {
+	pm    *PassManager
+	emit  func(*Instruction) error
+	held  []Instruction
+	spare [][]string // Line buffers of commands already emitted
+}
+
+// Commands held back: the last three may still be reordered, and the one
+// before them fused with what follows
+const heldCommands = 3
+
+func (f *fuser) add(instr *Instruction) error {
+	if !f.pm.fusing() && !f.pm.scheduling() {
+		return f.emit(instr)
+	}
+	var lines []string
+	if n := len(f.spare); n > 0 {
+		lines, f.spare = f.spare[n-1][:0], f.spare[:n-1]
+	}
+	kept := *instr
+	kept.translatedLines = append(lines, instr.translatedLines...)
+	f.held = append(f.held, kept)
+
+	if n := len(f.held); n >= 3 && f.pm.schedule(&f.held[n-3], &f.held[n-2], &f.held[n-1]) {
+		f.held[n-3], f.held[n-2], f.held[n-1] = f.held[n-2], f.held[n-1], f.held[n-3]
+	}
+	for len(f.held) > heldCommands {
+		if err := f.emitFirst(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Fuse the first held command with the one after it and emit it
+func (f *fuser) emitFirst() error {
+	if len(f.held) > 1 {
+		f.pm.fuse(&f.held[0], &f.held[1])
+	}
+	err := f.emit(&f.held[0])
+	f.spare = append(f.spare, f.held[0].translatedLines)
+	f.held = append(f.held[:0], f.held[1:]...)
+	return err
+}
+
+// Emit the held commands, if any
+func (f *fuser) flush() error {
+	for len(f.held) > 0 {
+		if err := f.emitFirst(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Describe the selected passes, one per line, in the order they run
+func (pm *PassManager) String() string {
+	var b strings.Builder
+	if pm != nil {
+		for _, p := range pm.passes {
+			fmt.Fprintf(&b, "%v (-O%d): %v\n", p.Name, p.Level, p.Description)
+		}
+	}
+	return b.String()
+}
+
+// A flag such as -O2 setting the optimisation level to n
+type optLevelFlag struct {
+	level *int
+	n     int
+}
+
+func (f optLevelFlag) String() string {
+	return ""
+}
+
+func (f optLevelFlag) Set(string) error {
+	*f.level = f.n
+	return nil
+}
+
+func (f optLevelFlag) IsBoolFlag() bool {
+	return true
+}
+
+// Enables or disables the passes named by a repeatable flag
+type passFlags struct {
+	overrides map[string]bool
+	enable    bool
+}
+
+func (f passFlags) String() string {
+	return ""
+}
+
+func (f passFlags) Set(names string) error {
+	for _, name := range strings.Split(names, ",") {
+		f.overrides[name] = f.enable
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/schallis/vm-translator/codegen"
+)
+
+func TestPeephole(t *testing.T) {
+	// setup
+	asm := []string{"@SP", "M=M-1", "A=M", "D=M", "@SP", "M=M-1", "A=M"}
+	// test
+	got := peephole(asm, []string{"M=M-1", "A=M"}, "AM=M-1")
+	// assert
+	want := []string{"@SP", "AM=M-1", "D=M", "@SP", "AM=M-1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Wanted %q, got %q", want, got)
+	}
+}
+
+func TestFuseSP(t *testing.T) {
+	type testCase struct {
+		prev, next         []string
+		wantPrev, wantNext []string
+	}
+	cases := []testCase{
+		{
+			[]string{"@7", "D=A", "@SP", "M=M+1", "A=M-1", "M=D"},
+			[]string{"@SP", "AM=M-1", "D=M", "A=A-1", "M=D+M"},
+			[]string{"@7", "D=A", "@SP", "A=M", "M=D"},
+			[]string{"A=A-1", "M=D+M"},
+		},
+		{
+			[]string{"@7", "D=A", "@SP", "A=M", "M=D", "@SP", "M=M+1"},
+			[]string{"@SP", "M=M-1", "A=M", "D=M", "@5", "M=D"},
+			[]string{"@7", "D=A", "@SP", "A=M", "M=D"},
+			[]string{"@5", "M=D"},
+		},
+		{
+			[]string{"@SP", "AM=M-1", "D=M", "@5", "M=D"},
+			[]string{"@SP", "AM=M-1", "D=M", "@6", "M=D"},
+			[]string{"@SP", "AM=M-1", "D=M", "@5", "M=D"},
+			[]string{"@SP", "AM=M-1", "D=M", "@6", "M=D"},
+		},
+	}
+	for _, c := range cases {
+		// test
+		prev, next := fuseSP(c.prev, c.next)
+		// assert
+		if !reflect.DeepEqual(prev, c.wantPrev) || !reflect.DeepEqual(next, c.wantNext) {
+			t.Fatalf("Wanted %q then %q, got %q then %q", c.wantPrev, c.wantNext, prev, next)
+		}
+	}
+}
+
+func TestDirectMove(t *testing.T) {
+	// setup
+	pm, _ := newPassManager(2, nil)
+	type testCase struct {
+		source string
+		want   string // Assembly wanted after the push's comment
+	}
+	cases := []testCase{
+		{"push constant 7\npop temp 1", "@7\nD=A\n\n// pop temp 1\n@6\nM=D"},
+		{"push constant 7\npop local 2", "@7\nD=A\n\n// pop local 2\n@LCL\nA=M+1\nA=A+1\nM=D"},
+		{"push temp 0\npop that 0", "@5\nD=M\n\n// pop that 0\n@THAT\nA=M\nM=D"},
+	}
+	for _, c := range cases {
+		// test
+		asm, err := translateString(c.source, Options{Passes: pm})
+		check(err)
+		// assert
+		_, got, _ := strings.Cut(asm, "\n")
+		if got != c.want {
+			t.Fatalf("Wanted %q for %q, got %q", c.want, c.source, got)
+		}
+	}
+
+	// setup
+	source := "push constant 7\npop local 9"
+	// test
+	asm, _ := translateString(source, Options{Passes: pm})
+	// assert
+	if !strings.Contains(asm, "@R13") {
+		t.Fatalf("Expected pop beyond %v to keep its address in R13, got:\n%v", maxDirectOffset, asm)
+	}
+}
+
+func TestCanSinkPush(t *testing.T) {
+	type testCase struct {
+		source string
+		want   bool
+	}
+	cases := []testCase{
+		{"push constant 1\npush local 0\npop local 0", true},
+		{"push local 1\npush local 0\npop local 0", true},
+		{"push local 0\npush local 1\npop local 0", false},
+		{"push argument 0\npush constant 1\npop local 0", false},
+		{"push temp 0\npush constant 1\npop temp 1", true},
+		{"push static 2\npush constant 1\npop static 2", false},
+		{"push this 0\npush constant 3000\npop pointer 0", false},
+		{"push temp 0\npush constant 3000\npop pointer 0", true},
+		{"push temp 0\npush constant 1\nadd", false},
+		// fixedSegment{5} is another name for temp
+		{"push temp 0\npush constant 1\npop alias 0", false},
+		{"push alias 1\npush constant 1\npop temp 0", false},
+		{"push constant 1\npush constant 2\npop alias 0", true},
+	}
+	codegen.RegisterSegment("alias", fixedSegment{5})
+	defer codegen.RegisterSegment("alias", nil)
+	for _, c := range cases {
+		// setup
+		instrs, err := translateInstructions(strings.NewReader(c.source), Options{})
+		check(err)
+		// test
+		got := canSinkPush(instrs[0], instrs[1], instrs[2])
+		// assert
+		if got != c.want {
+			t.Fatalf("Wanted %v for %q, got %v", c.want, c.source, got)
+		}
+	}
+
+	// setup
+	pm, _ := newPassManager(2, nil)
+	// test
+	asm, err := translateString("push constant 7\npush temp 0\npop local 1\npop local 2", Options{Passes: pm})
+	check(err)
+	// assert
+	if strings.Contains(asm, "@SP") {
+		t.Fatalf("Expected both values moved without the stack, got:\n%v", asm)
+	}
+}
+
+func TestNewPassManager(t *testing.T) {
+	type testCase struct {
+		level     int
+		overrides map[string]bool
+		want      []string
+	}
+	cases := []testCase{
+		{0, nil, nil},
+		{1, nil, []string{"fold-address", "fold-decrement"}},
+		{2, nil, []string{"fold-address", "fold-decrement", "push-d", "schedule", "direct-move", "fuse-sp"}},
+		{2, map[string]bool{"fold-address": false, "schedule": false, "direct-move": false, "fuse-sp": false}, []string{"fold-decrement", "push-d"}},
+		{0, map[string]bool{"push-d": true}, []string{"push-d"}},
+	}
+	for _, c := range cases {
+		// test
+		pm, err := newPassManager(c.level, c.overrides)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// assert
+		var got []string
+		for _, p := range pm.passes {
+			got = append(got, p.Name)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Fatalf("Wanted passes %v at -O%d with %v, got %v", c.want, c.level, c.overrides, got)
+		}
+	}
+
+	if _, err := newPassManager(1, map[string]bool{"inline": true}); err == nil {
+		t.Fatalf("Expected unknown pass produce err")
+	}
+}
+
+func TestPassesShrinkOutput(t *testing.T) {
+	// setup
+	source := syntheticProgram(100)
+	pm, _ := newPassManager(2, nil)
+	// test
+	plain, err := translateString(source, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	optimised, err := translateString(source, Options{Passes: pm})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// assert
+	if len(optimised) >= len(plain) {
+		t.Fatalf("Expected -O2 to shrink output, got %v bytes from %v", len(optimised), len(plain))
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+/*
+The preprocessor expands directives in VM source before it is parsed. A
+directive is a line starting with `%`:
+
+	%include "file.vm"	Insert the contents of file.vm, which is found
+						relative to the including file
+	%ifdef NAME			Keep the following lines only if NAME is defined
+	%ifndef NAME		Keep the following lines only if NAME isn't defined
+	%else				Keep the following lines only if the condition of
+						the enclosing %ifdef or %ifndef didn't hold
+	%endif				End the enclosing %ifdef or %ifndef
+	%define NAME VALUE	Define NAME, replacing it with VALUE wherever it
+						appears as a token in the lines that follow, e.g.
+						`push constant SCREEN` after `%define SCREEN 16384`
+
+Names can also be defined on the command line with -D NAME or -D NAME=VALUE.
+*/
+
+// Where a line of preprocessed output came from
+type lineOrigin struct {
+	file string
+	line int
+}
+
+// An open %ifdef or %ifndef block
+type conditional struct {
+	keep    bool // Whether lines in the current branch are kept
+	sawElse bool
+}
+
+type preprocessor struct {
+	defines map[string]string
+	out     strings.Builder
+	origins []lineOrigin   // Origin of each output line
+	stack   []string       // Files being expanded, outermost first
+	conds   []*conditional // Open conditional blocks, innermost last
+}
+
+// Expand the directives in a VM file, returning the resulting source along
+// with the origin of each of its lines
+func preprocessFile(filename string, defines map[string]string) (string, []lineOrigin, error) {
+	// Copy the defines so a %define doesn't leak into the next file
+	p := preprocessor{defines: map[string]string{}}
+	for name, value := range defines {
+		p.defines[name] = value
+	}
+	if err := p.file(filename); err != nil {
+		return "", nil, err
+	}
+	return p.out.String(), p.origins, nil
+}
+
+// Expand the directives in VM source held in memory, such as an editor's
+// unsaved document, as preprocessFile would if it were the file named
+func preprocessString(filename, text string, defines map[string]string) (string, []lineOrigin, error) {
+	p := preprocessor{defines: map[string]string{}}
+	for name, value := range defines {
+		p.defines[name] = value
+	}
+	if err := p.source(filename, strings.NewReader(text)); err != nil {
+		return "", nil, err
+	}
+	return p.out.String(), p.origins, nil
+}
+
+func (p *preprocessor) file(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return p.source(filename, file)
+}
+
+// Expand the lines read from r, which are the contents of filename
+func (p *preprocessor) source(filename string, r io.Reader) error {
+	for _, open := range p.stack {
+		if open == filename {
+			return fmt.Errorf("include cycle: %v", strings.Join(append(p.stack, filename), " -> "))
+		}
+	}
+	p.stack = append(p.stack, filename)
+	defer func() { p.stack = p.stack[:len(p.stack)-1] }()
+
+	// Conditionals must be closed in the file that opened them
+	outerConds := len(p.conds)
+
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		text := scanner.Text()
+		if err := p.line(filename, lineNum, text); err != nil {
+			var srcErr *SourceError
+			if errors.As(err, &srcErr) {
+				return err // already located in an included file
+			}
+			return &SourceError{File: filename, Line: lineNum, Err: err}
+		}
+	}
+	if len(p.conds) > outerConds {
+		return &SourceError{File: filename, Line: lineNum, Err: errors.New("missing %endif")}
+	}
+	return scanner.Err()
+}
+
+// Whether lines are currently being kept, which needs every enclosing
+// conditional to hold
+func (p *preprocessor) keeping() bool {
+	for _, cond := range p.conds {
+		if !cond.keep {
+			return false
+		}
+	}
+	return true
+}
+
+// Expand a single line, copying it through unchanged unless it's a directive
+func (p *preprocessor) line(filename string, lineNum int, text string) error {
+	before, _, _ := strings.Cut(text, "//")
+	directive, arg := cutSpace(strings.TrimSpace(before))
+
+	// Conditionals are tracked even in skipped blocks so nesting is kept
+	switch directive {
+	case "%ifdef", "%ifndef":
+		if arg == "" {
+			return fmt.Errorf("%v needs a name", directive)
+		}
+		_, defined := p.defines[arg]
+		p.conds = append(p.conds, &conditional{keep: defined == (directive == "%ifdef")})
+		return nil
+	case "%else":
+		if len(p.conds) == 0 {
+			return errors.New("%else without %ifdef")
+		}
+		cond := p.conds[len(p.conds)-1]
+		if cond.sawElse {
+			return errors.New("%else repeated")
+		}
+		cond.keep, cond.sawElse = !cond.keep, true
+		return nil
+	case "%endif":
+		if len(p.conds) == 0 {
+			return errors.New("%endif without %ifdef")
+		}
+		p.conds = p.conds[:len(p.conds)-1]
+		return nil
+	}
+	if !p.keeping() {
+		return nil
+	}
+
+	if !strings.HasPrefix(directive, "%") {
+		p.out.WriteString(p.substitute(text))
+		p.out.WriteString("\n")
+		p.origins = append(p.origins, lineOrigin{filename, lineNum})
+		return nil
+	}
+
+	switch directive {
+	case "%include":
+		name, err := strconv.Unquote(arg)
+		if err != nil {
+			return fmt.Errorf("%%include needs a quoted file name, got %v", arg)
+		}
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(filepath.Dir(filename), name)
+		}
+		return p.file(name)
+	case "%define":
+		name, value := cutSpace(arg)
+		if name == "" || value == "" {
+			return errors.New("%define needs a name and a value")
+		}
+		if name[0] >= '0' && name[0] <= '9' {
+			return fmt.Errorf("invalid name %v, names can't start with a digit", name)
+		}
+		p.defines[name] = value
+		return nil
+	}
+	return fmt.Errorf("unknown directive %v", directive)
+}
+
+// Split s at its first run of spaces or tabs, trimming what follows
+func cutSpace(s string) (before, after string) {
+	i := strings.IndexFunc(s, unicode.IsSpace)
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], strings.TrimSpace(s[i:])
+}
+
+// Replace each token of the line's code that names a defined value. Lines
+// without any are returned as they are.
+func (p *preprocessor) substitute(text string) string {
+	code, comment, hasComment := strings.Cut(text, "//")
+	tokens := strings.Fields(code)
+	replaced := false
+	for i, token := range tokens {
+		if value := p.defines[token]; value != "" {
+			tokens[i] = value
+			replaced = true
+		}
+	}
+	if !replaced {
+		return text
+	}
+
+	text = strings.Join(tokens, " ")
+	if hasComment {
+		text += " //" + comment
+	}
+	return text
+}
+
+// Names defined with repeated -D flags. NAME=VALUE gives the name a value.
+type defineFlags map[string]string
+
+func (d defineFlags) String() string {
+	var defs []string
+	for name, value := range d {
+		if value != "" {
+			name += "=" + value
+		}
+		defs = append(defs, name)
+	}
+	return strings.Join(defs, ",")
+}
+
+func (d defineFlags) Set(def string) error {
+	name, value, _ := strings.Cut(def, "=")
+	if name == "" {
+		return errors.New("empty name")
+	}
+	d[name] = value
+	return nil
+}
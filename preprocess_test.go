@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Write files into a temporary directory, returning its path
+func writeTestFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, text := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0o755)
+		if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestPreprocessInclude(t *testing.T) {
+	// setup
+	dir := writeTestFiles(t, map[string]string{
+		"Main.vm":    "push constant 1\n%include \"lib/Lib.vm\" // shared code\nadd\n",
+		"lib/Lib.vm": "push constant 2\n",
+	})
+	// test
+	source, origins, err := preprocessFile(filepath.Join(dir, "Main.vm"), nil)
+	// assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source != "push constant 1\npush constant 2\nadd\n" {
+		t.Fatalf("Unexpected expansion %q", source)
+	}
+	if origins[1] != (lineOrigin{filepath.Join(dir, "lib/Lib.vm"), 1}) {
+		t.Fatalf("Wrong origin for included line, got %+v", origins[1])
+	}
+}
+
+func TestPreprocessFail(t *testing.T) {
+	// setup
+	dir := writeTestFiles(t, map[string]string{
+		"A.vm":        "%include \"B.vm\"\n",
+		"B.vm":        "%include \"A.vm\"\n",
+		"Unquoted.vm": "%include B.vm\n",
+		"Unknown.vm":  "%bogus\n",
+		"Missing.vm":  "%include \"Nope.vm\"\n",
+	})
+
+	for _, name := range []string{"A.vm", "Unquoted.vm", "Unknown.vm", "Missing.vm"} {
+		// test
+		_, _, err := preprocessFile(filepath.Join(dir, name), nil)
+		// assert
+		if err == nil {
+			t.Fatalf(`Expected "%v" produce err`, name)
+		}
+	}
+}
+
+func TestPreprocessConditionals(t *testing.T) {
+	// setup
+	dir := writeTestFiles(t, map[string]string{
+		"Main.vm": `push constant 1
+%ifdef DEBUG
+push constant 2
+%ifndef VERBOSE
+push constant 3
+%else
+%include "Missing.vm"
+%endif
+%else
+push constant 4
+%endif
+`,
+	})
+	var tests = []struct {
+		defines  map[string]string
+		expected string
+	}{
+		{nil, "push constant 1\npush constant 4\n"},
+		{map[string]string{"DEBUG": ""}, "push constant 1\npush constant 2\npush constant 3\n"},
+	}
+
+	for _, test := range tests {
+		// test
+		source, _, err := preprocessFile(filepath.Join(dir, "Main.vm"), test.defines)
+		// assert
+		if err != nil {
+			t.Fatal(err)
+		}
+		if source != test.expected {
+			t.Fatalf("With %v wanted %q, got %q", test.defines, test.expected, source)
+		}
+	}
+}
+
+func TestPreprocessConditionalsFail(t *testing.T) {
+	// setup
+	dir := writeTestFiles(t, map[string]string{
+		"Unclosed.vm":  "%ifdef DEBUG\n",
+		"Unopened.vm":  "%endif\n",
+		"TwoElses.vm":  "%ifdef A\n%else\n%else\n%endif\n",
+		"Nameless.vm":  "%ifdef\n%endif\n",
+		"Included.vm":  "%ifdef A\n%include \"Unclosed.vm\"\n%endif\n",
+		"Includer.vm":  "%include \"Included.vm\"\n",
+		"SplitOpen.vm": "%include \"Unclosed.vm\"\n%endif\n",
+	})
+
+	for _, name := range []string{"Unclosed.vm", "Unopened.vm", "TwoElses.vm", "Nameless.vm", "SplitOpen.vm"} {
+		// test
+		_, _, err := preprocessFile(filepath.Join(dir, name), nil)
+		// assert
+		if err == nil {
+			t.Fatalf(`Expected "%v" produce err`, name)
+		}
+	}
+
+	// test: errors in included files are located in that file
+	_, _, err := preprocessFile(filepath.Join(dir, "Includer.vm"), map[string]string{"A": ""})
+	// assert
+	var srcErr *SourceError
+	if !errors.As(err, &srcErr) || !strings.HasSuffix(srcErr.File, "Unclosed.vm") {
+		t.Fatalf("Wanted error in Unclosed.vm, got %v", err)
+	}
+}
+
+func TestDefineFlags(t *testing.T) {
+	// setup
+	defines := defineFlags{}
+	// test
+	check(defines.Set("DEBUG"))
+	check(defines.Set("SCREEN=16384"))
+	// assert
+	if _, ok := defines["DEBUG"]; !ok || defines["SCREEN"] != "16384" {
+		t.Fatalf("Unexpected defines %v", defines)
+	}
+	if defines.Set("=1") == nil {
+		t.Fatalf("Expected empty name produce err")
+	}
+}
+
+func TestPreprocessDefine(t *testing.T) {
+	// setup
+	dir := writeTestFiles(t, map[string]string{
+		"Main.vm": `push constant SCREEN
+%define SCREEN 16384 // base of the screen
+push  constant SCREEN // SCREEN stays in comments
+pop pointer SLOT
+push constant DEBUG
+%define	N	 3
+push constant N
+`,
+		"Bad.vm":      "%define 1ST 1\n",
+		"Nameless.vm": "%define SCREEN\n",
+	})
+	defines := map[string]string{"SLOT": "1", "DEBUG": ""}
+	// test
+	source, _, err := preprocessFile(filepath.Join(dir, "Main.vm"), defines)
+	// assert
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "push constant SCREEN\npush constant 16384 // SCREEN stays in comments\npop pointer 1\npush constant DEBUG\npush constant 3\n"
+	if source != expected {
+		t.Fatalf("Wanted %q, got %q", expected, source)
+	}
+
+	for _, name := range []string{"Bad.vm", "Nameless.vm"} {
+		// test
+		_, _, err := preprocessFile(filepath.Join(dir, name), nil)
+		// assert
+		if err == nil {
+			t.Fatalf(`Expected "%v" produce err`, name)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// How often one VM command ran in a profiled program
+type profileEntry struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Command string `json:"command"`
+	Count   int    `json:"count"`  // Times the command was run
+	Cycles  int    `json:"cycles"` // Instructions executed on its behalf
+	words   int    // ROM words of its code
+}
+
+// Collects the code of a program command by command, then runs it on the
+// emulator counting how often each command runs
+type profiler struct {
+	entries []profileEntry
+	asm     []string
+	owner   []int // Entry each ROM word belongs to
+	start   []bool
+}
+
+// Add the code of an instruction from the named file to the program
+func (p *profiler) add(file string, instr *Instruction) {
+	p.entries = append(p.entries, profileEntry{
+		File:    file,
+		Line:    instr.lineNum,
+		Command: strings.TrimSpace(instr.stripped),
+	})
+	first := true
+	for _, line := range instr.translatedLines {
+		p.asm = append(p.asm, line)
+		if asmCost(line) > 0 {
+			p.entries[len(p.entries)-1].words++
+			p.owner = append(p.owner, len(p.entries)-1)
+			p.start = append(p.start, first)
+			first = false
+		}
+	}
+}
+
+// Assemble the program, ready to run from the course's usual starting state
+func (p *profiler) machine() (*Machine, error) {
+	rom, err := assemble(strings.Join(p.asm, "\n"))
+	if err != nil {
+		return nil, err
+	}
+	m := NewMachine(rom)
+	copy(m.RAM[:], courseRAM)
+	return m, nil
+}
+
+// Count the instruction at pc as run
+func (p *profiler) count(pc int) {
+	entry := &p.entries[p.owner[pc]]
+	if p.start[pc] {
+		entry.Count++
+	}
+	entry.Cycles++
+}
+
+// Where the instruction at pc came from: the VM command, or the assembly
+// file and address for code not translated from one
+func (p *profiler) location(pc int) string {
+	entry := p.entries[p.owner[pc]]
+	if entry.Line == 0 {
+		return fmt.Sprintf("%v, pc %d", entry.File, pc)
+	}
+	return fmt.Sprintf("%v:%d: %v", entry.File, entry.Line, entry.Command)
+}
+
+// The fault err of the instruction at pc, located at the VM command it came
+// from if there is one, as the VM has no call frames to give a backtrace of
+func (p *profiler) fault(pc int, err error) error {
+	entry := p.entries[p.owner[pc]]
+	if entry.Line == 0 {
+		return err
+	}
+	return &SourceError{File: entry.File, Line: entry.Line, Source: entry.Command, Err: err}
+}
+
+// Run the program, failing if it takes more than maxCycles. Returns the
+// commands that ran, in program order.
+func (p *profiler) run(maxCycles int) ([]profileEntry, error) {
+	m, err := p.machine()
+	if err != nil {
+		return nil, err
+	}
+	for !m.Halted() {
+		if m.Cycles >= maxCycles {
+			return nil, fmt.Errorf("program still running after %d cycles", maxCycles)
+		}
+		p.count(m.PC)
+		if err := m.Step(); err != nil {
+			return nil, p.fault(m.PC, err)
+		}
+	}
+	return p.ran(), nil
+}
+
+// The commands that have run so far, in program order
+func (p *profiler) ran() []profileEntry {
+	var ran []profileEntry
+	for _, entry := range p.entries {
+		if entry.Cycles > 0 {
+			ran = append(ran, entry)
+		}
+	}
+	return ran
+}
+
+// Commands of VM source with code to run, which coverage is counted over.
+// Hand-written .asm files aren't VM source and have no lines to cover.
+func (p *profiler) coverable() []profileEntry {
+	var lines []profileEntry
+	for _, entry := range p.entries {
+		if entry.Line > 0 && entry.words > 0 {
+			lines = append(lines, entry)
+		}
+	}
+	return lines
+}
+
+// Write a summary of how many VM lines ran in each file
+func (p *profiler) writeCoverage(w io.Writer) error {
+	var b strings.Builder
+	for _, row := range p.coverageTable().rows {
+		fmt.Fprintf(&b, "%v: %d of %d lines run (%.1f%%)\n", row[0], row[2], row[1], row[3])
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// How many VM lines ran in each file, as a table
+func (p *profiler) coverageTable() reportTable {
+	var files []string
+	found, hit := map[string]int{}, map[string]int{}
+	for _, entry := range p.coverable() {
+		if _, ok := found[entry.File]; !ok {
+			files = append(files, entry.File)
+		}
+		found[entry.File]++
+		if entry.Count > 0 {
+			hit[entry.File]++
+		}
+	}
+	t := reportTable{
+		name:     "coverage",
+		headings: []string{"file", "lines", "run", "% run"},
+		keys:     []string{"file", "lines", "run", "percent_run"},
+	}
+	for _, file := range files {
+		t.rows = append(t.rows, []any{file, found[file], hit[file], 100 * float64(hit[file]) / float64(found[file])})
+	}
+	return t
+}
+
+// Write the coverage in lcov's tracefile format, a record for each file
+// giving the number of times each of its lines ran
+func (p *profiler) writeLcov(w io.Writer) error {
+	var b strings.Builder
+	lines := p.coverable()
+	for i := 0; i < len(lines); {
+		file := lines[i].File
+		found, hit := 0, 0
+		fmt.Fprintf(&b, "TN:\nSF:%v\n", file)
+		for ; i < len(lines) && lines[i].File == file; i++ {
+			fmt.Fprintf(&b, "DA:%d,%d\n", lines[i].Line, lines[i].Count)
+			found++
+			if lines[i].Count > 0 {
+				hit++
+			}
+		}
+		fmt.Fprintf(&b, "LF:%d\nLH:%d\nend_of_record\n", found, hit)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Write a profile as JSON
+func writeProfile(w io.Writer, entries []profileEntry) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(entries)
+}
+
+// Read a profile written by writeProfile
+func readProfile(r io.Reader) ([]profileEntry, error) {
+	var entries []profileEntry
+	if err := json.NewDecoder(r).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("reading profile: %w", err)
+	}
+	return entries, nil
+}
+
+// Note how often each listed command ran, matching commands by unit and
+// line, and mark the hot commands that took the most cycles
+func annotateListing(entries []listingEntry, profile []profileEntry, hot int) {
+	type key struct {
+		unit string
+		line int
+	}
+	byLine := map[key]profileEntry{}
+	for _, p := range profile {
+		byLine[key{unitName(p.File), p.Line}] = p
+	}
+
+	var ran []int
+	for i := range entries {
+		p, ok := byLine[key{entries[i].Unit, entries[i].LineNum}]
+		if !ok {
+			continue
+		}
+		entries[i].Count = p.Count
+		ran = append(ran, i)
+	}
+	cycles := func(i int) int {
+		return byLine[key{entries[i].Unit, entries[i].LineNum}].Cycles
+	}
+	sort.SliceStable(ran, func(a, b int) bool { return cycles(ran[a]) > cycles(ran[b]) })
+	for _, i := range ran[:min(hot, len(ran))] {
+		entries[i].Hot = true
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// The formats reports are written in with -format: table for people to read,
+// json and csv for dashboards and spreadsheets
+var reportFormats = []string{"table", "json", "csv"}
+
+// A table of a report. Values are ints, float64s, written to a decimal place
+// in a table, or strings.
+type reportTable struct {
+	name     string   // Key of the table in JSON
+	headings []string // Of the columns in a table
+	keys     []string // Of the columns in JSON and CSV
+	rows     [][]any
+}
+
+// Write the tables in format. JSON is an object of each table's rows, keyed
+// by its name, and CSV each table with a header of its keys, separated by
+// blank lines.
+func writeReport(w io.Writer, format string, tables []reportTable) error {
+	switch format {
+	case "json":
+		doc := map[string][]map[string]any{}
+		for _, t := range tables {
+			rows := []map[string]any{}
+			for _, row := range t.rows {
+				obj := map[string]any{}
+				for i, v := range row {
+					obj[t.keys[i]] = v
+				}
+				rows = append(rows, obj)
+			}
+			doc[t.name] = rows
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(doc)
+	case "csv":
+		var b strings.Builder
+		cw := csv.NewWriter(&b)
+		for i, t := range tables {
+			if i > 0 {
+				cw.Flush()
+				b.WriteString("\n")
+			}
+			cw.Write(t.keys)
+			for _, row := range t.rows {
+				record := make([]string, len(row))
+				for j, v := range row {
+					record[j] = fmt.Sprint(v)
+				}
+				cw.Write(record)
+			}
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return err
+		}
+		_, err := io.WriteString(w, b.String())
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for i, t := range tables {
+		if i > 0 {
+			fmt.Fprintln(tw)
+		}
+		fmt.Fprintln(tw, strings.Join(t.headings, "\t"))
+		for _, row := range t.rows {
+			cells := make([]string, len(row))
+			for j, v := range row {
+				if f, ok := v.(float64); ok {
+					cells[j] = fmt.Sprintf("%.1f", f)
+				} else {
+					cells[j] = fmt.Sprint(v)
+				}
+			}
+			fmt.Fprintln(tw, strings.Join(cells, "\t"))
+		}
+	}
+	return tw.Flush()
+}
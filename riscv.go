@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+Generates RV32I assembly (GNU as) so the same VM program can be compared
+across instruction sets. Build the output with a RISC-V toolchain, e.g.
+
+	riscv64-unknown-elf-gcc -march=rv32i -mabi=ilp32 -o Foo Foo.s
+
+Memory is laid out as on the x86-64 target: the VM stack is the native stack,
+one 32-bit word per value, and every other segment lives in vm_ram, an array
+of 16-bit words laid out like Hack RAM. Values are kept sign-extended from 16
+bits so arithmetic wraps as it does on Hack. The registers each role uses are
+given by riscvRegs.
+
+The program is emitted as main, which returns the value on top of the stack,
+or 0 if the stack is empty.
+*/
+type riscvBackend struct{}
+
+// Register conventions of the RISC-V target. The callee-saved registers are
+// preserved across main, the temporaries are free to clobber.
+var riscvRegs = struct {
+	RAM, Frame string // Address of vm_ram, main's frame pointer
+	X, Y       string // Scratch registers for operands
+	Offset     string // Scratch register for offsets too large for an immediate
+}{
+	RAM:    "s1",
+	Frame:  "s0",
+	X:      "t0",
+	Y:      "t1",
+	Offset: "t2",
+}
+
+// riscvFrame is the size of main's saved registers, below which the VM stack
+// starts
+const riscvFrame = 16
+
+// Output instructions leaving the address of RAM[index] relative to base in
+// reg. Offsets beyond the 12 bit immediate range are loaded into the Offset
+// register and added separately, so base may be reg.
+func riscvAddress(instr *Instruction, reg, base string, index int) string {
+	offset := 2 * index
+	if offset < 2048 {
+		return fmt.Sprintf("%d(%v)", offset, base)
+	}
+	instr.outputLines(
+		fmt.Sprintf("\tli %v, %d", riscvRegs.Offset, offset),
+		fmt.Sprintf("\tadd %v, %v, %v", reg, base, riscvRegs.Offset),
+	)
+	return fmt.Sprintf("0(%v)", reg)
+}
+
+// Output instructions leaving the address of segment[index] in the X register,
+// returning the memory operand to use
+func riscvSegment(instr *Instruction) (string, error) {
+	r := riscvRegs
+	switch instr.segment {
+	case "local", "argument", "this", "that":
+		instr.outputLines(
+			fmt.Sprintf("\tlhu %v, %d(%v)", r.X, 2*x86SegmentPointers[instr.segment], r.RAM),
+			fmt.Sprintf("\tslli %v, %v, 1", r.X, r.X),
+			fmt.Sprintf("\tadd %v, %v, %v", r.X, r.RAM, r.X),
+		)
+		return riscvAddress(instr, r.X, r.X, instr.value), nil
+	case "temp":
+		return riscvAddress(instr, r.X, r.RAM, 5+instr.value), nil
+	case "pointer":
+		return riscvAddress(instr, r.X, r.RAM, 3+instr.value), nil
+	}
+	return "", unsupportedSegment(instr, "riscv32")
+}
+
+func (riscvBackend) Extension() string {
+	return ".s"
+}
+
+func (riscvBackend) Prologue() []string {
+	r := riscvRegs
+	return []string{
+		"\t.text",
+		"\t.globl main",
+		"main:",
+		fmt.Sprintf("\taddi sp, sp, -%d", riscvFrame),
+		"\tsw ra, 12(sp)",
+		fmt.Sprintf("\tsw %v, 8(sp)", r.Frame),
+		fmt.Sprintf("\tsw %v, 4(sp)", r.RAM),
+		fmt.Sprintf("\taddi %v, sp, %d", r.Frame, riscvFrame),
+		fmt.Sprintf("\tla %v, vm_ram", r.RAM),
+	}
+}
+
+func (riscvBackend) Epilogue() []string {
+	r := riscvRegs
+	return []string{
+		"# return the top of the VM stack, or 0 if it is empty",
+		"\tli a0, 0",
+		fmt.Sprintf("\taddi %v, %v, -%d", r.X, r.Frame, riscvFrame),
+		fmt.Sprintf("\tbeq sp, %v, 1f", r.X),
+		"\tlw a0, 0(sp)",
+		"1:",
+		fmt.Sprintf("\taddi sp, %v, -%d", r.Frame, riscvFrame),
+		"\tlw ra, 12(sp)",
+		fmt.Sprintf("\tlw %v, 8(sp)", r.Frame),
+		fmt.Sprintf("\tlw %v, 4(sp)", r.RAM),
+		fmt.Sprintf("\taddi sp, sp, %d", riscvFrame),
+		"\tret",
+		"",
+		"\t.comm vm_ram, 65536, 2",
+		"\t.section .note.GNU-stack, \"\", @progbits",
+		"", // as wants a newline at the end
+	}
+}
+
+func (riscvBackend) CommentPrefix() string {
+	return "# "
+}
+
+func (riscvBackend) Translate(instr *Instruction) error {
+	r := riscvRegs
+	switch instr.operation {
+	case "push":
+		if instr.segment == "constant" {
+			instr.outputLines(fmt.Sprintf("\tli %v, %d", r.Y, instr.value))
+		} else {
+			operand, err := riscvSegment(instr)
+			if err != nil {
+				return err
+			}
+			instr.outputLines(fmt.Sprintf("\tlh %v, %v", r.Y, operand))
+		}
+		instr.outputLines("\taddi sp, sp, -4", fmt.Sprintf("\tsw %v, 0(sp)", r.Y))
+	case "pop":
+		if instr.segment == "constant" {
+			return errors.New("`pop constant` not implemented, doesn't make sense")
+		}
+		operand, err := riscvSegment(instr)
+		if err != nil {
+			return err
+		}
+		instr.outputLines(
+			fmt.Sprintf("\tlw %v, 0(sp)", r.Y),
+			"\taddi sp, sp, 4",
+			fmt.Sprintf("\tsh %v, %v", r.Y, operand),
+		)
+	case "add", "sub":
+		instr.outputLines(
+			fmt.Sprintf("\tlw %v, 0(sp)", r.Y),
+			fmt.Sprintf("\tlw %v, 4(sp)", r.X),
+			"\taddi sp, sp, 4",
+			fmt.Sprintf("\t%v %v, %v, %v", instr.operation, r.X, r.X, r.Y),
+			// wrap to 16 bits
+			fmt.Sprintf("\tslli %v, %v, 16", r.X, r.X),
+			fmt.Sprintf("\tsrai %v, %v, 16", r.X, r.X),
+			fmt.Sprintf("\tsw %v, 0(sp)", r.X),
+		)
+	case "shiftleft", "shiftright":
+		op := map[string]string{"shiftleft": "slli", "shiftright": "srai"}[instr.operation]
+		instr.outputLines(
+			fmt.Sprintf("\tlw %v, 0(sp)", r.X),
+			fmt.Sprintf("\t%v %v, %v, 1", op, r.X, r.X),
+			// wrap to 16 bits
+			fmt.Sprintf("\tslli %v, %v, 16", r.X, r.X),
+			fmt.Sprintf("\tsrai %v, %v, 16", r.X, r.X),
+			fmt.Sprintf("\tsw %v, 0(sp)", r.X),
+		)
+	case "mul", "div", "mod":
+		return fmt.Errorf("%v is not supported by the riscv32 target, as RV32I has no multiply or divide", instr.operation)
+	}
+	return nil
+}
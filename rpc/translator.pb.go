@@ -0,0 +1,412 @@
+// gRPC interface to the translator, for build farms and graders that
+// translate many programs remotely. Regenerate the Go code with
+//
+//	protoc --go_out=. --go_opt=paths=source_relative \
+//		--go-grpc_out=. --go-grpc_opt=paths=source_relative \
+//		rpc/translator.proto
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        (unknown)
+// source: rpc/translator.proto
+
+package rpc
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type SourceChunk struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Source        string                 `protobuf:"bytes,1,opt,name=source,proto3" json:"source,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SourceChunk) Reset() {
+	*x = SourceChunk{}
+	mi := &file_rpc_translator_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SourceChunk) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SourceChunk) ProtoMessage() {}
+
+func (x *SourceChunk) ProtoReflect() protoreflect.Message {
+	mi := &file_rpc_translator_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SourceChunk.ProtoReflect.Descriptor instead.
+func (*SourceChunk) Descriptor() ([]byte, []int) {
+	return file_rpc_translator_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *SourceChunk) GetSource() string {
+	if x != nil {
+		return x.Source
+	}
+	return ""
+}
+
+type AsmChunk struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Asm           string                 `protobuf:"bytes,1,opt,name=asm,proto3" json:"asm,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AsmChunk) Reset() {
+	*x = AsmChunk{}
+	mi := &file_rpc_translator_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AsmChunk) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AsmChunk) ProtoMessage() {}
+
+func (x *AsmChunk) ProtoReflect() protoreflect.Message {
+	mi := &file_rpc_translator_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AsmChunk.ProtoReflect.Descriptor instead.
+func (*AsmChunk) Descriptor() ([]byte, []int) {
+	return file_rpc_translator_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *AsmChunk) GetAsm() string {
+	if x != nil {
+		return x.Asm
+	}
+	return ""
+}
+
+type SourceFile struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Source        string                 `protobuf:"bytes,2,opt,name=source,proto3" json:"source,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SourceFile) Reset() {
+	*x = SourceFile{}
+	mi := &file_rpc_translator_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SourceFile) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SourceFile) ProtoMessage() {}
+
+func (x *SourceFile) ProtoReflect() protoreflect.Message {
+	mi := &file_rpc_translator_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SourceFile.ProtoReflect.Descriptor instead.
+func (*SourceFile) Descriptor() ([]byte, []int) {
+	return file_rpc_translator_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *SourceFile) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *SourceFile) GetSource() string {
+	if x != nil {
+		return x.Source
+	}
+	return ""
+}
+
+type Project struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Files         []*SourceFile          `protobuf:"bytes,1,rep,name=files,proto3" json:"files,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Project) Reset() {
+	*x = Project{}
+	mi := &file_rpc_translator_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Project) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Project) ProtoMessage() {}
+
+func (x *Project) ProtoReflect() protoreflect.Message {
+	mi := &file_rpc_translator_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Project.ProtoReflect.Descriptor instead.
+func (*Project) Descriptor() ([]byte, []int) {
+	return file_rpc_translator_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *Project) GetFiles() []*SourceFile {
+	if x != nil {
+		return x.Files
+	}
+	return nil
+}
+
+type Diagnostic struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	File          string                 `protobuf:"bytes,1,opt,name=file,proto3" json:"file,omitempty"`
+	Line          int32                  `protobuf:"varint,2,opt,name=line,proto3" json:"line,omitempty"`
+	Message       string                 `protobuf:"bytes,3,opt,name=message,proto3" json:"message,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Diagnostic) Reset() {
+	*x = Diagnostic{}
+	mi := &file_rpc_translator_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Diagnostic) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Diagnostic) ProtoMessage() {}
+
+func (x *Diagnostic) ProtoReflect() protoreflect.Message {
+	mi := &file_rpc_translator_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Diagnostic.ProtoReflect.Descriptor instead.
+func (*Diagnostic) Descriptor() ([]byte, []int) {
+	return file_rpc_translator_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *Diagnostic) GetFile() string {
+	if x != nil {
+		return x.File
+	}
+	return ""
+}
+
+func (x *Diagnostic) GetLine() int32 {
+	if x != nil {
+		return x.Line
+	}
+	return 0
+}
+
+func (x *Diagnostic) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
+type ProjectResult struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Asm           string                 `protobuf:"bytes,1,opt,name=asm,proto3" json:"asm,omitempty"`
+	Diagnostics   []*Diagnostic          `protobuf:"bytes,2,rep,name=diagnostics,proto3" json:"diagnostics,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ProjectResult) Reset() {
+	*x = ProjectResult{}
+	mi := &file_rpc_translator_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ProjectResult) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ProjectResult) ProtoMessage() {}
+
+func (x *ProjectResult) ProtoReflect() protoreflect.Message {
+	mi := &file_rpc_translator_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ProjectResult.ProtoReflect.Descriptor instead.
+func (*ProjectResult) Descriptor() ([]byte, []int) {
+	return file_rpc_translator_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *ProjectResult) GetAsm() string {
+	if x != nil {
+		return x.Asm
+	}
+	return ""
+}
+
+func (x *ProjectResult) GetDiagnostics() []*Diagnostic {
+	if x != nil {
+		return x.Diagnostics
+	}
+	return nil
+}
+
+var File_rpc_translator_proto protoreflect.FileDescriptor
+
+const file_rpc_translator_proto_rawDesc = "" +
+	"\n" +
+	"\x14rpc/translator.proto\x12\fvmtranslator\"%\n" +
+	"\vSourceChunk\x12\x16\n" +
+	"\x06source\x18\x01 \x01(\tR\x06source\"\x1c\n" +
+	"\bAsmChunk\x12\x10\n" +
+	"\x03asm\x18\x01 \x01(\tR\x03asm\"8\n" +
+	"\n" +
+	"SourceFile\x12\x12\n" +
+	"\x04name\x18\x01 \x01(\tR\x04name\x12\x16\n" +
+	"\x06source\x18\x02 \x01(\tR\x06source\"9\n" +
+	"\aProject\x12.\n" +
+	"\x05files\x18\x01 \x03(\v2\x18.vmtranslator.SourceFileR\x05files\"N\n" +
+	"\n" +
+	"Diagnostic\x12\x12\n" +
+	"\x04file\x18\x01 \x01(\tR\x04file\x12\x12\n" +
+	"\x04line\x18\x02 \x01(\x05R\x04line\x12\x18\n" +
+	"\amessage\x18\x03 \x01(\tR\amessage\"]\n" +
+	"\rProjectResult\x12\x10\n" +
+	"\x03asm\x18\x01 \x01(\tR\x03asm\x12:\n" +
+	"\vdiagnostics\x18\x02 \x03(\v2\x18.vmtranslator.DiagnosticR\vdiagnostics2\x9e\x01\n" +
+	"\n" +
+	"Translator\x12H\n" +
+	"\x0fTranslateStream\x12\x19.vmtranslator.SourceChunk\x1a\x16.vmtranslator.AsmChunk(\x010\x01\x12F\n" +
+	"\x10TranslateProject\x12\x15.vmtranslator.Project\x1a\x1b.vmtranslator.ProjectResultB'Z%github.com/schallis/vm-translator/rpcb\x06proto3"
+
+var (
+	file_rpc_translator_proto_rawDescOnce sync.Once
+	file_rpc_translator_proto_rawDescData []byte
+)
+
+func file_rpc_translator_proto_rawDescGZIP() []byte {
+	file_rpc_translator_proto_rawDescOnce.Do(func() {
+		file_rpc_translator_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_rpc_translator_proto_rawDesc), len(file_rpc_translator_proto_rawDesc)))
+	})
+	return file_rpc_translator_proto_rawDescData
+}
+
+var file_rpc_translator_proto_msgTypes = make([]protoimpl.MessageInfo, 6)
+var file_rpc_translator_proto_goTypes = []any{
+	(*SourceChunk)(nil),   // 0: vmtranslator.SourceChunk
+	(*AsmChunk)(nil),      // 1: vmtranslator.AsmChunk
+	(*SourceFile)(nil),    // 2: vmtranslator.SourceFile
+	(*Project)(nil),       // 3: vmtranslator.Project
+	(*Diagnostic)(nil),    // 4: vmtranslator.Diagnostic
+	(*ProjectResult)(nil), // 5: vmtranslator.ProjectResult
+}
+var file_rpc_translator_proto_depIdxs = []int32{
+	2, // 0: vmtranslator.Project.files:type_name -> vmtranslator.SourceFile
+	4, // 1: vmtranslator.ProjectResult.diagnostics:type_name -> vmtranslator.Diagnostic
+	0, // 2: vmtranslator.Translator.TranslateStream:input_type -> vmtranslator.SourceChunk
+	3, // 3: vmtranslator.Translator.TranslateProject:input_type -> vmtranslator.Project
+	1, // 4: vmtranslator.Translator.TranslateStream:output_type -> vmtranslator.AsmChunk
+	5, // 5: vmtranslator.Translator.TranslateProject:output_type -> vmtranslator.ProjectResult
+	4, // [4:6] is the sub-list for method output_type
+	2, // [2:4] is the sub-list for method input_type
+	2, // [2:2] is the sub-list for extension type_name
+	2, // [2:2] is the sub-list for extension extendee
+	0, // [0:2] is the sub-list for field type_name
+}
+
+func init() { file_rpc_translator_proto_init() }
+func file_rpc_translator_proto_init() {
+	if File_rpc_translator_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_rpc_translator_proto_rawDesc), len(file_rpc_translator_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   6,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_rpc_translator_proto_goTypes,
+		DependencyIndexes: file_rpc_translator_proto_depIdxs,
+		MessageInfos:      file_rpc_translator_proto_msgTypes,
+	}.Build()
+	File_rpc_translator_proto = out.File
+	file_rpc_translator_proto_goTypes = nil
+	file_rpc_translator_proto_depIdxs = nil
+}
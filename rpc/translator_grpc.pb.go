@@ -0,0 +1,171 @@
+// gRPC interface to the translator, for build farms and graders that
+// translate many programs remotely. Regenerate the Go code with
+//
+//	protoc --go_out=. --go_opt=paths=source_relative \
+//		--go-grpc_out=. --go-grpc_opt=paths=source_relative \
+//		rpc/translator.proto
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.6.2
+// - protoc             (unknown)
+// source: rpc/translator.proto
+
+package rpc
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Translator_TranslateStream_FullMethodName  = "/vmtranslator.Translator/TranslateStream"
+	Translator_TranslateProject_FullMethodName = "/vmtranslator.Translator/TranslateProject"
+)
+
+// TranslatorClient is the client API for Translator service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type TranslatorClient interface {
+	// Translate one VM program sent in chunks of any size. Assembly is streamed
+	// back as commands are translated. A parse error ends the call with
+	// INVALID_ARGUMENT. The client's deadline is honoured between commands.
+	TranslateStream(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[SourceChunk, AsmChunk], error)
+	// Translate every file of a project in order, reporting diagnostics for all
+	// files rather than stopping at the first bad one
+	TranslateProject(ctx context.Context, in *Project, opts ...grpc.CallOption) (*ProjectResult, error)
+}
+
+type translatorClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewTranslatorClient(cc grpc.ClientConnInterface) TranslatorClient {
+	return &translatorClient{cc}
+}
+
+func (c *translatorClient) TranslateStream(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[SourceChunk, AsmChunk], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Translator_ServiceDesc.Streams[0], Translator_TranslateStream_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[SourceChunk, AsmChunk]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Translator_TranslateStreamClient = grpc.BidiStreamingClient[SourceChunk, AsmChunk]
+
+func (c *translatorClient) TranslateProject(ctx context.Context, in *Project, opts ...grpc.CallOption) (*ProjectResult, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ProjectResult)
+	err := c.cc.Invoke(ctx, Translator_TranslateProject_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// TranslatorServer is the server API for Translator service.
+// All implementations must embed UnimplementedTranslatorServer
+// for forward compatibility.
+type TranslatorServer interface {
+	// Translate one VM program sent in chunks of any size. Assembly is streamed
+	// back as commands are translated. A parse error ends the call with
+	// INVALID_ARGUMENT. The client's deadline is honoured between commands.
+	TranslateStream(grpc.BidiStreamingServer[SourceChunk, AsmChunk]) error
+	// Translate every file of a project in order, reporting diagnostics for all
+	// files rather than stopping at the first bad one
+	TranslateProject(context.Context, *Project) (*ProjectResult, error)
+	mustEmbedUnimplementedTranslatorServer()
+}
+
+// UnimplementedTranslatorServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedTranslatorServer struct{}
+
+func (UnimplementedTranslatorServer) TranslateStream(grpc.BidiStreamingServer[SourceChunk, AsmChunk]) error {
+	return status.Error(codes.Unimplemented, "method TranslateStream not implemented")
+}
+func (UnimplementedTranslatorServer) TranslateProject(context.Context, *Project) (*ProjectResult, error) {
+	return nil, status.Error(codes.Unimplemented, "method TranslateProject not implemented")
+}
+func (UnimplementedTranslatorServer) mustEmbedUnimplementedTranslatorServer() {}
+func (UnimplementedTranslatorServer) testEmbeddedByValue()                    {}
+
+// UnsafeTranslatorServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to TranslatorServer will
+// result in compilation errors.
+type UnsafeTranslatorServer interface {
+	mustEmbedUnimplementedTranslatorServer()
+}
+
+func RegisterTranslatorServer(s grpc.ServiceRegistrar, srv TranslatorServer) {
+	// If the following call panics, it indicates UnimplementedTranslatorServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Translator_ServiceDesc, srv)
+}
+
+func _Translator_TranslateStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(TranslatorServer).TranslateStream(&grpc.GenericServerStream[SourceChunk, AsmChunk]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Translator_TranslateStreamServer = grpc.BidiStreamingServer[SourceChunk, AsmChunk]
+
+func _Translator_TranslateProject_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Project)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TranslatorServer).TranslateProject(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Translator_TranslateProject_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TranslatorServer).TranslateProject(ctx, req.(*Project))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Translator_ServiceDesc is the grpc.ServiceDesc for Translator service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Translator_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "vmtranslator.Translator",
+	HandlerType: (*TranslatorServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "TranslateProject",
+			Handler:    _Translator_TranslateProject_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "TranslateStream",
+			Handler:       _Translator_TranslateStream_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "rpc/translator.proto",
+}
@@ -0,0 +1,325 @@
+//go:build !js
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Instructions run by default before giving up on a program that doesn't
+// halt, as interactive programs never do
+const runCycles = 10000000
+
+// Frames shown each second when running paced
+const framesPerSecond = 60
+
+// Run .vm and .asm files on the emulator, optionally rendering the screen
+func runMain(args []string) {
+	fs := newFlagSet("run")
+	screen := fs.String("screen", "none", "render the screen when the program stops: `format` none, term or png")
+	scale := fs.Int("scale", 2, "pixels to each dot of a term rendering, along each side")
+	output := fs.String("o", "screen.png", "write the png rendering to `file`")
+	every := fs.Int("snapshot-every", 0, "also write a numbered png every `n` cycles, e.g. screen-0001.png")
+	keys := fs.String("keys", "", "press keys at cycle counts, e.g. `ArrowUp:100,Space:300,None:400`")
+	keysFile := fs.String("keys-file", "", "read key events, one or more a line, from `file`")
+	maxCycles := fs.Int("max-cycles", runCycles, "stop the program after `n` instructions")
+	save := fs.String("save", "", "write the state of the machine to the snapshot `file` when the program stops")
+	resume := fs.String("resume", "", "carry on from the state in the snapshot `file` written by -save")
+	heap := fs.Bool("heap", false, "report heap usage, fragmentation and reads of memory never written when the program stops")
+	heatCSV := fs.String("heat-csv", "", "write the reads and writes of each RAM address to the CSV `file`")
+	heatPNG := fs.String("heat-png", "", "write a heat map of RAM accesses to the png `file`, 128 addresses to a row")
+	format := fs.String("format", "table", "write the -heap and -coverage reports in `format` table, or json or csv to stdout")
+	coverage := fs.Bool("coverage", false, "report how many VM lines of each file ran when the program stops")
+	lcov := fs.String("lcov", "", "write the VM lines run, and how often, to the lcov tracefile `file`")
+	direct := fs.Bool("direct", false, "interpret the VM commands on the machine's memory without generating assembly, then render the screen")
+	differential := fs.Bool("differential", false, "instead of running normally, check the translation at each -O level against interpreting the VM code")
+	debugAddr := fs.String("debug-addr", "", "stop before running and serve the remote debug protocol on the TCP `address`, e.g. localhost:2331, to one client")
+	var watched watchFlags
+	fs.Var(&watched, "watch", "stop when the program changes the RAM `address`, a number, symbol such as THIS or segment such as local, printing the VM line responsible; may be repeated")
+	perFrame := fs.Int("cycles-per-frame", 0, "run `n` instructions each 60th of a second rather than flat out, redrawing a term screen each frame")
+	var lang Options
+	addLanguageFlags(fs, &lang)
+	parseFlags(fs, args)
+	if fs.NArg() < 1 {
+		log.Fatal("usage: vm-translator run [flags] file.vm|file.asm...")
+	}
+	switch {
+	case *screen != "none" && *screen != "term" && *screen != "png":
+		log.Fatalf("unknown -screen %v, want none, term or png", *screen)
+	case *scale < 1:
+		log.Fatal("-scale must be at least 1")
+	case *every < 0 || *perFrame < 0:
+		log.Fatal("-snapshot-every and -cycles-per-frame can't be negative")
+	case !slices.Contains(reportFormats, *format):
+		log.Fatalf("unknown -format %v, want table, json or csv", *format)
+	}
+
+	if *direct {
+		emulated := *heap || *heatCSV != "" || *heatPNG != "" || *coverage || *lcov != "" || *debugAddr != "" || len(watched) > 0
+		if emulated || *keys != "" || *keysFile != "" || *save != "" || *resume != "" || *every > 0 || *perFrame > 0 {
+			log.Fatal("-direct only renders the screen, as the other flags need the emulator")
+		}
+		sources, err := readSources(fs.Args())
+		check(err)
+		m, err := runDirect(sources, lang)
+		if err != nil {
+			fatal(err)
+		}
+		if *screen != "none" {
+			check(writeScreen(*screen, *output, *scale, m, false))
+		}
+		return
+	}
+
+	if *differential {
+		sources, err := readSources(fs.Args())
+		check(err)
+		if err := differentialTest(sources, lang, *maxCycles); err != nil {
+			fatal(err)
+		}
+		fmt.Fprintln(os.Stderr, "translation matches the interpreter at every -O level")
+		return
+	}
+
+	spec := *keys
+	if *keysFile != "" {
+		text, err := os.ReadFile(*keysFile)
+		check(err)
+		spec += "\n" + string(text)
+	}
+	events, err := parseKeys(spec)
+	if err != nil {
+		log.Fatal(err)
+	}
+	script := keyScript{events}
+
+	p, err := loadProgram(fs.Args(), lang)
+	if err != nil {
+		fatal(err)
+	}
+	m, err := p.machine()
+	if err != nil {
+		fatal(err)
+	}
+	if *resume != "" {
+		f, err := os.Open(*resume)
+		check(err)
+		err = m.loadSnapshot(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("%v: %v", *resume, err)
+		}
+	}
+	var watchers []func(addr int, write bool)
+	var tracker heapTracker
+	if *heap {
+		watchers = append(watchers, tracker.watch)
+	}
+	var heat heatMap
+	if *heatCSV != "" || *heatPNG != "" {
+		watchers = append(watchers, heat.watch)
+	}
+	var watches *watchpoints
+	if len(watched) > 0 {
+		watches = newWatchpoints(m, watched)
+		watchers = append(watchers, watches.watch)
+	}
+	if len(watchers) > 0 {
+		m.Watch = func(addr int, write bool) {
+			for _, watch := range watchers {
+				watch(addr, write)
+			}
+		}
+	}
+	if *debugAddr != "" {
+		killed, err := debugMachine(*debugAddr, m)
+		check(err)
+		if killed {
+			fmt.Fprintf(os.Stderr, "killed by the debugger after %d cycles\n", m.Cycles)
+			return
+		}
+	}
+	paced := *perFrame > 0 && *screen == "term"
+	if paced {
+		os.Stdout.WriteString("\x1b[2J")
+	}
+	snapshots := 0
+	frame := time.Now()
+	counting := *coverage || *lcov != ""
+	var hit *watchHit
+	for !m.Halted() && m.Cycles < *maxCycles {
+		script.apply(m)
+		if counting {
+			p.count(m.PC)
+		}
+		pc := m.PC
+		if err := m.Step(); err != nil {
+			fatal(p.fault(pc, err))
+		}
+		if watches != nil {
+			if hit = watches.take(); hit != nil {
+				fmt.Fprintln(os.Stderr, hit.describe(p, pc))
+				break
+			}
+		}
+		if *every > 0 && m.Cycles%*every == 0 {
+			snapshots++
+			check(writeScreenFile(fmt.Sprintf("%v-%04d.png", strings.TrimSuffix(*output, ".png"), snapshots), m))
+		}
+		if *perFrame > 0 && m.Cycles%*perFrame == 0 {
+			if paced {
+				os.Stdout.WriteString("\x1b[H")
+				check(writeScreenText(os.Stdout, m, *scale))
+			}
+			frame = frame.Add(time.Second / framesPerSecond)
+			time.Sleep(time.Until(frame))
+		}
+	}
+	switch {
+	case hit != nil:
+		fmt.Fprintf(os.Stderr, "stopped by a watchpoint after %d cycles\n", m.Cycles)
+	case m.Halted():
+		fmt.Fprintf(os.Stderr, "halted after %d cycles\n", m.Cycles)
+	default:
+		fmt.Fprintf(os.Stderr, "stopped after %d cycles, the -max-cycles limit, at %v\n", m.Cycles, p.location(m.PC))
+	}
+
+	if *format == "table" {
+		if *heap {
+			check(tracker.report(os.Stderr))
+		}
+		if *coverage {
+			check(p.writeCoverage(os.Stderr))
+		}
+	} else if *heap || *coverage {
+		// The reports of the run, together so they can be read as one
+		var tables []reportTable
+		if *heap {
+			tables = append(tables, tracker.table())
+		}
+		if *coverage {
+			tables = append(tables, p.coverageTable())
+		}
+		check(writeReport(os.Stdout, *format, tables))
+	}
+	if *lcov != "" {
+		check(writeFile(*lcov, p.writeLcov))
+	}
+	if *heatCSV != "" {
+		check(writeFile(*heatCSV, heat.writeCSV))
+	}
+	if *heatPNG != "" {
+		check(writeFile(*heatPNG, heat.writePNG))
+	}
+	if *save != "" {
+		f, err := os.Create(*save)
+		check(err)
+		check(m.saveSnapshot(f))
+		check(f.Close())
+		log.Println("Snapshot written to", *save)
+	}
+
+	check(writeScreen(*screen, *output, *scale, m, paced))
+}
+
+// Render the screen of m in format, term or png, to stdout or the file
+// output. A paced term screen is drawn over the last frame.
+func writeScreen(format, output string, scale int, m *Machine, paced bool) error {
+	switch format {
+	case "term":
+		if paced {
+			os.Stdout.WriteString("\x1b[H")
+		}
+		return writeScreenText(os.Stdout, m, scale)
+	case "png":
+		if err := writeScreenFile(output, m); err != nil {
+			return err
+		}
+		log.Println("Screen written to", output)
+	}
+	return nil
+}
+
+// Interpret the sources' VM commands on a machine's memory, without
+// assembling them, so the program's logic can be checked independently of
+// code generation. The machine returned has the memory they leave and no
+// ROM.
+func runDirect(sources []sourceFile, opts Options) (*Machine, error) {
+	prog, err := BuildIR(sources, opts)
+	if err != nil {
+		return nil, err
+	}
+	v := newVMInterpreter()
+	compiled := v.compile(prog)
+	if err := compiled.run(v); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(os.Stderr, "interpreted %d commands\n", len(compiled.ops))
+	m := NewMachine(nil)
+	m.RAM = v.RAM
+	return m, nil
+}
+
+// Write the screen to the png file at path
+func writeScreenFile(path string, m *Machine) error {
+	return writeFile(path, func(w io.Writer) error { return writeScreenPNG(w, m) })
+}
+
+// Create the file at path and fill it with write
+func writeFile(path string, write func(io.Writer) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Translate .vm files with opts and read .asm files into one program, in
+// the order given, ready to run
+func loadProgram(filenames []string, opts Options) (*profiler, error) {
+	var p profiler
+	for _, filename := range filenames {
+		if filepath.Ext(filename) == ".asm" {
+			text, err := os.ReadFile(filename)
+			if err != nil {
+				return nil, err
+			}
+			source := strings.TrimRight(strings.ReplaceAll(string(text), "\r\n", "\n"), "\n")
+			lines := strings.Split(source, "\n")
+			// Debug information beside the file says which VM lines it's from
+			dbgName := strings.TrimSuffix(filename, ".asm") + ".dbg"
+			if f, err := os.Open(dbgName); err == nil {
+				info, err := readDebugInfo(f)
+				f.Close()
+				if err == nil {
+					err = p.addDebugged(filename, lines, info)
+				}
+				if err != nil {
+					return nil, fmt.Errorf("%v: %w", dbgName, err)
+				}
+				continue
+			}
+			p.add(filename, &Instruction{stripped: filepath.Base(filename), translatedLines: lines})
+			continue
+		}
+		err := translateFile(filename, cliConfig{opts: opts}, func(instr *Instruction) error {
+			p.add(filename, instr)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &p, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"strings"
+)
+
+// The Hack screen, memory mapped from RAM[16384] with 32 words to each row
+// of 512 pixels, the least significant bit of each word leftmost
+const (
+	screenBase   = 16384
+	screenWidth  = 512
+	screenHeight = 256
+)
+
+// Whether the pixel at x, y is black
+func (m *Machine) Pixel(x, y int) bool {
+	word := uint16(m.RAM[screenBase+y*screenWidth/16+x/16])
+	return word>>(x%16)&1 != 0
+}
+
+// A picture of the screen, black on white as the course's emulator shows it
+func screenImage(m *Machine) *image.Paletted {
+	img := image.NewPaletted(image.Rect(0, 0, screenWidth, screenHeight), color.Palette{color.White, color.Black})
+	for y := 0; y < screenHeight; y++ {
+		for x := 0; x < screenWidth; x++ {
+			if m.Pixel(x, y) {
+				img.SetColorIndex(x, y, 1)
+			}
+		}
+	}
+	return img
+}
+
+// Write the screen as a PNG image
+func writeScreenPNG(w io.Writer, m *Machine) error {
+	return png.Encode(w, screenImage(m))
+}
+
+// Bits of a braille character for its dots, by column then row
+var brailleDots = [2][4]rune{
+	{0x01, 0x02, 0x04, 0x40},
+	{0x08, 0x10, 0x20, 0x80},
+}
+
+// Write the screen as braille characters, each showing 2×4 dots. A dot
+// covers scale×scale pixels and is raised if any of them are black, so a
+// scale of 2 fits the screen in 128 columns.
+func writeScreenText(w io.Writer, m *Machine, scale int) error {
+	var b strings.Builder
+	cellW, cellH := 2*scale, 4*scale
+	for top := 0; top < screenHeight; top += cellH {
+		for left := 0; left < screenWidth; left += cellW {
+			r := rune(0x2800)
+			for dx := 0; dx < 2; dx++ {
+				for dy := 0; dy < 4; dy++ {
+					if m.anyPixel(left+dx*scale, top+dy*scale, scale) {
+						r |= brailleDots[dx][dy]
+					}
+				}
+			}
+			b.WriteRune(r)
+		}
+		b.WriteByte('\n')
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Whether any pixel of the size×size square from x, y is black
+func (m *Machine) anyPixel(x, y, size int) bool {
+	for j := y; j < y+size && j < screenHeight; j++ {
+		for i := x; i < x+size && i < screenWidth; i++ {
+			if m.Pixel(i, j) {
+				return true
+			}
+		}
+	}
+	return false
+}
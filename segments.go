@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/schallis/vm-translator/codegen"
+)
+
+/*
+	RAM[0]		SP points to next topmost location in stack
+	RAM[1]		LCL points to base of `local` segment
+	RAM[2]		ARG points to base of `argument` segment
+	RAM[3]		THIS points to base of `this` segment
+	RAM[4]		THAT points to base of `that` segment
+	RAM[5-12] 	Holds contents of `temp` segment, 8 values
+	RAM[13-15]	Can be used by VM as general purpose
+	RAM[256]	Start of global stack
+*/
+
+// The general purpose register generated code keeps temporary values in, so
+// they don't need symbols of their own which the assembler would allocate
+// alongside the statics
+var scratchRegister = "@R13"
+
+// Choose which of R13-R15 generated code uses as its scratch register
+func SetScratchRegister(name string) error {
+	switch name {
+	case "R13", "R14", "R15":
+		scratchRegister = "@" + name
+		return nil
+	}
+	return fmt.Errorf("scratch register must be R13, R14 or R15, got %v", name)
+}
+
+// Implemented by handlers generating their assembly from a snippet of
+// templates/hack.tmpl, naming the snippet they render for op, push or pop,
+// so -comments=teach can describe it
+type snippetSegment interface {
+	snippet(op string, index int) string
+}
+
+// The built-in segments. Others can be added with codegen.RegisterSegment.
+func init() {
+	codegen.RegisterSegment("local", baseSegment{"@LCL"})
+	codegen.RegisterSegment("argument", baseSegment{"@ARG"})
+	codegen.RegisterSegment("this", baseSegment{"@THIS"})
+	codegen.RegisterSegment("that", baseSegment{"@THAT"})
+	codegen.RegisterSegment("constant", constantSegment{})
+	codegen.RegisterSegment("temp", tempSegment{})
+	codegen.RegisterSegment("static", staticSegment{})
+	codegen.RegisterSegment("pointer", pointerSegment{})
+}
+
+// A segment addressed relative to a base pointer, e.g. `local` from LCL
+type baseSegment struct {
+	base string // A-instruction loading the base pointer
+}
+
+// The base pointer's symbol, e.g. LCL
+func (s baseSegment) name() string {
+	return strings.TrimPrefix(s.base, "@")
+}
+
+func (baseSegment) snippet(op string, index int) string {
+	return op + "-base"
+}
+
+func (s baseSegment) Push(asm []string, index int) ([]string, error) {
+	// e.g. push local 2 -> *SP=*(LCL+2), SP++
+	return renderSnippet(asm, s.snippet("push", index), snippetData{Index: index, Base: s.name()})
+}
+
+func (s baseSegment) Pop(asm []string, index int) ([]string, error) {
+	// e.g. pop local 2 -> addr=LCL+2, SP--, *addr=*SP
+	return renderSnippet(asm, s.snippet("pop", index), snippetData{Index: index, Base: s.name()})
+}
+
+// The virtual `constant` segment, where constant[i] is i
+type constantSegment struct{}
+
+// Computations storing the constants that don't need loading through D
+var constantComp = map[int]string{0: "M=0", 1: "M=1", -1: "M=-1"}
+
+func (constantSegment) snippet(op string, index int) string {
+	if op == "pop" {
+		return ""
+	}
+	if _, ok := constantComp[index]; ok {
+		return "push-constant-comp"
+	}
+	if index < 0 {
+		return "push-constant-neg"
+	}
+	return "push-constant"
+}
+
+func (s constantSegment) Push(asm []string, index int) ([]string, error) {
+	// e.g. push constant 1, or push constant 17 -> *SP=17, SP++
+	data := snippetData{Index: index, Comp: constantComp[index]}
+	if index < 0 {
+		// e.g. push constant -5 -> *SP=!4, SP++, which loads even -32768
+		data.Index = ^index
+	}
+	return renderSnippet(asm, s.snippet("push", index), data)
+}
+
+func (constantSegment) Pop(asm []string, index int) ([]string, error) {
+	return asm, errors.New("`pop constant` not implemented, doesn't make sense")
+}
+
+// The `temp` segment, fixed at RAM[5-12]
+type tempSegment struct{}
+
+func (tempSegment) snippet(op string, index int) string {
+	return op + "-temp"
+}
+
+func (s tempSegment) Push(asm []string, index int) ([]string, error) {
+	// addr=5+i, *SP=*addr, SP++
+	return renderSnippet(asm, s.snippet("push", index), snippetData{Index: index, Address: index + 5})
+}
+
+func (s tempSegment) Pop(asm []string, index int) ([]string, error) {
+	// addr=5+i, SP--, *addr=*SP
+	return renderSnippet(asm, s.snippet("pop", index), snippetData{Index: index, Address: index + 5})
+}
+
+// The `static` segment of one file, where static i in Foo.vm is the variable
+// Foo.i, allocated by the assembler
+type staticSegment struct {
+	unit string
+}
+
+func (staticSegment) ForFile(unit string) codegen.SegmentHandler {
+	if unit == "" {
+		unit = defaultUnit
+	}
+	return staticSegment{unit}
+}
+
+// Symbol of static i
+func (s staticSegment) symbol(index int) string {
+	return s.unit + "." + strconv.Itoa(index)
+}
+
+func (staticSegment) snippet(op string, index int) string {
+	return op + "-static"
+}
+
+func (s staticSegment) Push(asm []string, index int) ([]string, error) {
+	// e.g. push static 3 in Foo.vm -> *SP=Foo.3, SP++
+	return renderSnippet(asm, s.snippet("push", index), snippetData{Index: index, Symbol: s.symbol(index)})
+}
+
+func (s staticSegment) Pop(asm []string, index int) ([]string, error) {
+	// e.g. pop static 3 in Foo.vm -> SP--, Foo.3=*SP
+	return renderSnippet(asm, s.snippet("pop", index), snippetData{Index: index, Symbol: s.symbol(index)})
+}
+
+// The `pointer` segment, where pointer 0 is THIS and pointer 1 is THAT
+type pointerSegment struct{}
+
+// THIS or THAT, for pointer[index]
+func thisThat(index int) string {
+	if index == 1 {
+		return "THAT"
+	}
+	return "THIS"
+}
+
+func (pointerSegment) snippet(op string, index int) string {
+	return op + "-pointer"
+}
+
+func (s pointerSegment) Push(asm []string, index int) ([]string, error) {
+	// pointer 0/1 -> *SP=THIS/THAT, SP++
+	return renderSnippet(asm, s.snippet("push", index), snippetData{Index: index, Symbol: thisThat(index)})
+}
+
+func (s pointerSegment) Pop(asm []string, index int) ([]string, error) {
+	// pointer 0/1 -> SP--, THIS/THAT=*SP
+	return renderSnippet(asm, s.snippet("pop", index), snippetData{Index: index, Symbol: thisThat(index)})
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Largest request body the server will read, in bytes
+const maxRequestSize = 10 << 20
+
+// Most bytes of .vm files read from one archive once decompressed, so a
+// small archive can't expand to fill memory
+const maxUnzippedSize = 64 << 20
+
+// Returned by readZipSources for an archive whose .vm files are larger
+// than maxUnzippedSize
+var errZipTooLarge = fmt.Errorf("archive holds more than %d MiB of .vm files", maxUnzippedSize>>20)
+
+// A named piece of VM source, e.g. one file of a project
+type sourceFile struct {
+	name string
+	text string
+}
+
+// Read every .vm file in a zip archive, sorted by path so translation order
+// doesn't depend on how the archive was built. Fails with errZipTooLarge
+// once more than maxUnzippedSize bytes have been read, and for two files of
+// the same name in different directories, as units are named after their
+// file and the two would share statics.
+func readZipSources(data []byte) ([]sourceFile, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	var sources []sourceFile
+	budget := int64(maxUnzippedSize)
+	seen := map[string]string{} // Path of each file name read so far
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() || path.Ext(f.Name) != ".vm" {
+			continue
+		}
+		if other, ok := seen[path.Base(f.Name)]; ok {
+			return nil, fmt.Errorf("%v and %v would both be unit %v", other, f.Name, unitName(f.Name))
+		}
+		seen[path.Base(f.Name)] = f.Name
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		text, err := io.ReadAll(io.LimitReader(rc, budget+1))
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		if budget -= int64(len(text)); budget < 0 {
+			return nil, errZipTooLarge
+		}
+		sources = append(sources, sourceFile{name: f.Name, text: string(text)})
+	}
+	if len(sources) == 0 {
+		return nil, errors.New("archive contains no .vm files")
+	}
+
+	sort.Slice(sources, func(i, j int) bool { return sources[i].name < sources[j].name })
+	return sources, nil
+}
+
+// A problem found while translating, as reported by the API
+type diagnostic struct {
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Message string `json:"message"`
+}
+
+type translateResponse struct {
+	Asm         string       `json:"asm"`
+	Hack        string       `json:"hack,omitempty"` // Machine code assembled from Asm, for the hack target
+	Diagnostics []diagnostic `json:"diagnostics"`
+}
+
+func newDiagnostic(file string, err error) diagnostic {
+	d := diagnostic{File: file, Message: err.Error()}
+	var srcErr *SourceError
+	if errors.As(err, &srcErr) {
+		d.Line = srcErr.Line
+		d.Message = srcErr.Err.Error()
+	}
+	return d
+}
+
+// Translate each source file in order, collecting diagnostics for all files
+// rather than stopping at the first one that fails. Stops early with ctx's
+// error if it is cancelled or its deadline passes.
+func translateSources(ctx context.Context, sources []sourceFile, opts Options) (translateResponse, error) {
+	resp := translateResponse{Diagnostics: []diagnostic{}}
+	var parts []string
+	for _, src := range sources {
+		if err := ctx.Err(); err != nil {
+			return resp, err
+		}
+		opts.Unit = unitName(src.name)
+		asm, err := translateString(src.text, opts)
+		if err != nil {
+			resp.Diagnostics = append(resp.Diagnostics, newDiagnostic(src.name, err))
+			continue
+		}
+		parts = append(parts, asm)
+	}
+	if len(resp.Diagnostics) == 0 {
+		resp.Asm = strings.Join(parts, "\n\n")
+	}
+	return resp, nil
+}
+
+// Fill in resp.Hack by assembling resp.Asm
+func assembleResponse(resp *translateResponse) error {
+	rom, err := assemble(resp.Asm)
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	if err := writeHack(&b, rom); err != nil {
+		return err
+	}
+	resp.Hack = b.String()
+	return nil
+}
+
+// HTTP API for translating VM code remotely:
+//
+//	POST /translate
+//
+// The body is either VM source or a zip of .vm files sent with
+// Content-Type: application/zip. The response is JSON of the form
+// {"asm": "...", "hack": "...", "diagnostics": [...]}, with status 422 if
+// there were any diagnostics, or status 413 for a body, or .vm files in an
+// archive, too large to read. hack is the assembly assembled into .hack
+// machine code, given when translating to Hack. Sources are translated with
+// opts.
+func newServer(opts Options) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/translate", func(w http.ResponseWriter, r *http.Request) {
+		handleTranslate(w, r, opts)
+	})
+	return mux
+}
+
+func handleTranslate(w http.ResponseWriter, r *http.Request, opts Options) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	sources := []sourceFile{{name: "", text: string(body)}}
+	if r.Header.Get("Content-Type") == "application/zip" {
+		sources, err = readZipSources(body)
+		if errors.Is(err, errZipTooLarge) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, "invalid zip: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	resp, err := translateSources(r.Context(), sources, opts)
+	if err != nil {
+		// The client has gone away, so there's nobody to reply to
+		return
+	}
+	if _, hack := opts.backend().(hackBackend); hack && len(resp.Diagnostics) == 0 {
+		if err := assembleResponse(&resp); err != nil {
+			resp.Diagnostics = append(resp.Diagnostics, diagnostic{Message: "assembling: " + err.Error()})
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if len(resp.Diagnostics) > 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func postTranslate(t *testing.T, contentType string, body []byte) (int, translateResponse) {
+	req := httptest.NewRequest(http.MethodPost, "/translate", bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	rec := httptest.NewRecorder()
+	newServer(Options{}).ServeHTTP(rec, req)
+
+	var resp translateResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response %q: %v", rec.Body.String(), err)
+	}
+	return rec.Code, resp
+}
+
+func TestServeTranslate(t *testing.T) {
+	// test
+	code, resp := postTranslate(t, "text/plain", []byte("push constant 7\nadd\n"))
+	// assert
+	if code != http.StatusOK || !strings.HasPrefix(resp.Asm, "// push constant 7") {
+		t.Fatalf("Wanted assembly, got %v %+v", code, resp)
+	}
+	rom, err := assemble(resp.Asm)
+	check(err)
+	var want strings.Builder
+	check(writeHack(&want, rom))
+	if resp.Hack == "" || resp.Hack != want.String() {
+		t.Fatalf("Wanted the assembly as machine code\n%v\ngot\n%v", want.String(), resp.Hack)
+	}
+
+	// test
+	code, resp = postTranslate(t, "text/plain", []byte("push constant 7\nbogus\n"))
+	// assert
+	if code != http.StatusUnprocessableEntity || len(resp.Diagnostics) != 1 || resp.Diagnostics[0].Line != 2 {
+		t.Fatalf("Wanted a diagnostic on line 2, got %v %+v", code, resp)
+	}
+}
+
+func TestServeTranslateZipTooLarge(t *testing.T) {
+	// setup
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	f, _ := zw.Create("Big.vm")
+	f.Write(make([]byte, maxUnzippedSize+1))
+	zw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/translate", &buf)
+	req.Header.Set("Content-Type", "application/zip")
+	rec := httptest.NewRecorder()
+	// test
+	newServer(Options{}).ServeHTTP(rec, req)
+	// assert
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Wanted 413 for an archive expanding past the limit, got %v %v", rec.Code, rec.Body.String())
+	}
+}
+
+func TestServeTranslateZip(t *testing.T) {
+	// setup
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, text := range map[string]string{
+		"proj/B.vm":     "push constant 2",
+		"proj/A.vm":     "push constant 1",
+		"proj/notes.md": "not translated",
+	} {
+		f, _ := zw.Create(name)
+		f.Write([]byte(text))
+	}
+	zw.Close()
+	// test
+	code, resp := postTranslate(t, "application/zip", buf.Bytes())
+	// assert
+	if code != http.StatusOK || !strings.HasPrefix(resp.Asm, "// push constant 1") || !strings.Contains(resp.Asm, "@2") {
+		t.Fatalf("Wanted A.vm then B.vm, got %v %+v", code, resp)
+	}
+
+	// setup
+	buf.Reset()
+	zw = zip.NewWriter(&buf)
+	for _, name := range []string{"a/Main.vm", "b/Main.vm"} {
+		f, _ := zw.Create(name)
+		f.Write([]byte("push constant 1"))
+	}
+	zw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/translate", &buf)
+	req.Header.Set("Content-Type", "application/zip")
+	rec := httptest.NewRecorder()
+	// test
+	newServer(Options{}).ServeHTTP(rec, req)
+	// assert
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "would both be unit Main") {
+		t.Fatalf("Wanted 400 for two Main.vm files, got %v %v", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+/*
+A saved state of the emulator, so a long run can be checkpointed and resumed
+later or a state shared in a bug report. Integers are varints as written by
+encoding/binary, except the checksum and RAM.
+
+	magic    "HSNP"
+	version  1 byte
+	rom      uvarint number of ROM words, then the CRC-32 of the words as 4
+	         little endian bytes. A snapshot can only be resumed on the same
+	         program.
+	pc       uvarint
+	cycles   uvarint
+	a, d     varint each
+	ram      every RAM word as 2 little endian bytes
+*/
+const (
+	snapshotMagic   = "HSNP"
+	snapshotVersion = 1
+)
+
+// Checksum of a program, to recognise it when resuming
+func romChecksum(rom []uint16) uint32 {
+	b := make([]byte, 0, 2*len(rom))
+	for _, word := range rom {
+		b = binary.LittleEndian.AppendUint16(b, word)
+	}
+	return crc32.ChecksumIEEE(b)
+}
+
+// Write the registers and RAM of the machine to w
+func (m *Machine) saveSnapshot(w io.Writer) error {
+	out := append([]byte(snapshotMagic), snapshotVersion)
+	out = binary.AppendUvarint(out, uint64(len(m.ROM)))
+	out = binary.LittleEndian.AppendUint32(out, romChecksum(m.ROM))
+	out = binary.AppendUvarint(out, uint64(m.PC))
+	out = binary.AppendUvarint(out, uint64(m.Cycles))
+	out = binary.AppendVarint(out, int64(m.A))
+	out = binary.AppendVarint(out, int64(m.D))
+	for _, word := range m.RAM {
+		out = binary.LittleEndian.AppendUint16(out, uint16(word))
+	}
+	_, err := w.Write(out)
+	return err
+}
+
+// Restore registers and RAM saved by saveSnapshot. Fails, leaving the machine
+// as it was, if the snapshot was taken running a different program.
+func (m *Machine) loadSnapshot(r io.Reader) error {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(snapshotMagic)+1)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return fmt.Errorf("reading snapshot: %w", err)
+	}
+	if string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return errors.New("not an emulator snapshot")
+	}
+	if header[len(snapshotMagic)] != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", header[len(snapshotMagic)])
+	}
+
+	romLen, err := binary.ReadUvarint(br)
+	if err != nil {
+		return fmt.Errorf("reading snapshot: %w", err)
+	}
+	var sum [4]byte
+	if _, err := io.ReadFull(br, sum[:]); err != nil {
+		return fmt.Errorf("reading snapshot: %w", err)
+	}
+	if romLen != uint64(len(m.ROM)) || binary.LittleEndian.Uint32(sum[:]) != romChecksum(m.ROM) {
+		return errors.New("snapshot was taken running a different program")
+	}
+
+	var regs [4]int64
+	for i := range regs {
+		var v uint64
+		if i < 2 {
+			v, err = binary.ReadUvarint(br)
+			regs[i] = int64(v)
+		} else {
+			regs[i], err = binary.ReadVarint(br)
+		}
+		if err != nil {
+			return fmt.Errorf("reading snapshot: %w", err)
+		}
+	}
+	ram := make([]byte, 2*hackRAMSize)
+	if _, err := io.ReadFull(br, ram); err != nil {
+		return fmt.Errorf("reading snapshot: %w", err)
+	}
+
+	m.PC, m.Cycles = int(regs[0]), int(regs[1])
+	m.A, m.D = int16(regs[2]), int16(regs[3])
+	for i := range m.RAM {
+		m.RAM[i] = int16(binary.LittleEndian.Uint16(ram[2*i:]))
+	}
+	return nil
+}
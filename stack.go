@@ -0,0 +1,63 @@
+package main
+
+import "fmt"
+
+// Number of values the global stack has room for, from RAM[256] up to the
+// heap at RAM[2048]
+const stackCapacity = 2048 - 256
+
+// The number of values an instruction takes off the stack and puts back on
+func stackEffect(instr *Instruction) (pops, pushes int) {
+	switch instr.operation {
+	case "push":
+		return 0, 1
+	case "pop":
+		return 1, 0
+	case "add", "sub", "mul", "div", "mod":
+		return 2, 1
+	case "shiftleft", "shiftright":
+		return 1, 1
+	}
+	return 0, 0
+}
+
+// Tracks the depth of the VM stack through a program, so instructions that
+// would underflow or overflow it are caught when translating rather than
+// when the program runs. The commands supported so far have no branches, so
+// the depth at each instruction is known exactly.
+type stackDepth int
+
+// A command popping more values than the stack holds
+type StackUnderflowError struct {
+	Op    string // The command, e.g. add
+	Pops  int    // Values it takes
+	Depth int    // Values the stack holds
+}
+
+func (e *StackUnderflowError) Error() string {
+	return fmt.Sprintf("stack underflow, %v takes %d but the stack holds %d", e.Op, e.Pops, e.Depth)
+}
+
+// A command pushing a value the stack has no room for
+type StackOverflowError struct {
+	Capacity int
+}
+
+func (e *StackOverflowError) Error() string {
+	return fmt.Sprintf("stack overflow, more than %d values pushed", e.Capacity)
+}
+
+// Apply the stack effect of instr, failing with a *StackUnderflowError if the
+// stack doesn't hold enough values for it or a *StackOverflowError if it
+// would grow past its capacity
+func (d *stackDepth) apply(instr *Instruction) error {
+	pops, pushes := stackEffect(instr)
+	if int(*d) < pops {
+		return &StackUnderflowError{Op: instr.operation, Pops: pops, Depth: int(*d)}
+	}
+	*d += stackDepth(pushes - pops)
+	if *d > stackCapacity {
+		return &StackOverflowError{Capacity: stackCapacity}
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"io"
+	"sort"
+	"strings"
+)
+
+// Estimated cost in CPU cycles of one line of generated assembly. The Hack
+// CPU executes every A- and C-instruction in a single cycle, while labels and
+// comments do not end up in ROM and so cost nothing.
+func asmCost(line string) int {
+	line = strings.TrimSpace(line)
+	switch {
+	case line == "":
+		return 0
+	case strings.HasPrefix(line, "//"):
+		return 0
+	case strings.HasPrefix(line, "("):
+		return 0
+	}
+	return 1
+}
+
+// Cycle estimates for one unit of VM code
+type unitStats struct {
+	name         string
+	instructions int // ROM words generated
+	worstCycles  int // longest path through the unit, or unboundedCycles
+	callCycles   int // cycles for a call, running each loop the fewest times it can
+
+	commands map[string]commandStats // by kind of command, e.g. push local
+}
+
+// The cycles of code with a loop that has no known bound
+const unboundedCycles = -1
+
+// The fewest and the most times the loops of the extended dialect's
+// snippets run, by operation and label. Dividing by zero halts in a loop at
+// ZERO, which the estimates leave out.
+var snippetLoops = map[string][2]int{
+	"mul LOOP":        {16, 16},
+	"shiftright LOOP": {15, 15},
+	"div OUTER":       {1, 16},
+	"div INNER":       {1, 16},
+	"div ZERO":        {1, 1},
+	"mod OUTER":       {1, 16},
+	"mod INNER":       {1, 16},
+	"mod ZERO":        {1, 1},
+}
+
+// A loop in the assembly of an instruction, from the line of its label to
+// the jump back to it, with the fewest and the most times it runs
+type asmLoop struct {
+	start, end int
+	iterations [2]int
+}
+
+// The loops in the assembly of instr, found from jumps back to its labels.
+// Fails for a loop that isn't one of snippetLoops, such as one in inline
+// assembly, whose iterations can't be known.
+func findLoops(instr *Instruction) ([]asmLoop, bool) {
+	var loops []asmLoop
+	labels := map[string]int{}
+	for i, tLine := range instr.translatedLines {
+		tLine = strings.TrimSpace(tLine)
+		if strings.HasPrefix(tLine, "(") {
+			labels[strings.Trim(tLine, "()")] = i
+			continue
+		}
+		start, ok := labels[strings.TrimPrefix(tLine, "@")]
+		if !strings.HasPrefix(tLine, "@") || !ok {
+			continue
+		}
+		name := strings.TrimPrefix(tLine, "@"+instr.label()+".")
+		iterations, ok := snippetLoops[instr.operation+" "+name]
+		if !ok {
+			return nil, false
+		}
+		// The loop ends with the jump after the address of its label
+		loops = append(loops, asmLoop{start, i + 1, iterations})
+	}
+	return loops, true
+}
+
+// How many times one kind of VM command was used and the ROM words it took
+type commandStats struct {
+	count int
+	words int
+}
+
+// The kind of a VM command for the expansion report: its operation, and the
+// segment for push and pop
+func commandKind(instr *Instruction) string {
+	if instr.operation == "push" || instr.operation == "pop" {
+		return instr.operation + " " + instr.segment
+	}
+	return instr.operation
+}
+
+// Compute cycle estimates for the translated instructions of one unit.
+//
+// Branches within a command only skip code forward, so each instruction is
+// counted once, except in the loops of the extended dialect's snippets,
+// where the worst case counts it the most times its loops run and a call
+// the fewest. Until `function` is supported the whole file is one unit.
+func computeStats(name string, instrs []*Instruction) unitStats {
+	stats := unitStats{name: name}
+	for _, instr := range instrs {
+		stats.add(instr)
+	}
+	return stats
+}
+
+// Add the cost of a translated instruction to the unit
+func (u *unitStats) add(instr *Instruction) {
+	loops, bounded := findLoops(instr)
+	words, worst, call := 0, 0, 0
+	for i, tLine := range instr.translatedLines {
+		cost := asmCost(tLine)
+		if cost > 0 {
+			words++
+		}
+		most, fewest := cost, cost
+		for _, loop := range loops {
+			if loop.start <= i && i <= loop.end {
+				fewest *= loop.iterations[0]
+				most *= loop.iterations[1]
+			}
+		}
+		worst += most
+		call += fewest
+	}
+	u.instructions += words
+	if !bounded || u.worstCycles == unboundedCycles {
+		u.worstCycles = unboundedCycles
+	} else {
+		u.worstCycles += worst
+	}
+	u.callCycles += call
+	if instr.operation == "comment" {
+		return
+	}
+
+	if u.commands == nil {
+		u.commands = map[string]commandStats{}
+	}
+	kind := commandKind(instr)
+	c := u.commands[kind]
+	c.count++
+	c.words += words
+	u.commands[kind] = c
+}
+
+// Write the unit statistics to w in format, followed by the expansion of
+// each kind of command over all units, largest first
+func writeStats(w io.Writer, format string, units ...unitStats) error {
+	return writeReport(w, format, statsTables(units...))
+}
+
+// The unit statistics and the expansion of each kind of command as tables
+func statsTables(units ...unitStats) []reportTable {
+	unitTable := reportTable{
+		name:     "units",
+		headings: []string{"unit", "instructions", "worst cycles", "cycles/call"},
+		keys:     []string{"unit", "instructions", "worst_cycles", "cycles_per_call"},
+	}
+	commands := map[string]commandStats{}
+	for _, u := range units {
+		var worst any = u.worstCycles
+		if u.worstCycles == unboundedCycles {
+			worst = "unbounded"
+		}
+		unitTable.rows = append(unitTable.rows, []any{u.name, u.instructions, worst, u.callCycles})
+		for kind, c := range u.commands {
+			total := commands[kind]
+			total.count += c.count
+			total.words += c.words
+			commands[kind] = total
+		}
+	}
+
+	kinds := make([]string, 0, len(commands))
+	for kind := range commands {
+		kinds = append(kinds, kind)
+	}
+	sort.Slice(kinds, func(i, j int) bool {
+		a, b := commands[kinds[i]], commands[kinds[j]]
+		if a.words != b.words {
+			return a.words > b.words
+		}
+		return kinds[i] < kinds[j]
+	})
+	commandTable := reportTable{
+		name:     "commands",
+		headings: []string{"command", "count", "instructions", "instructions/command"},
+		keys:     []string{"command", "count", "instructions", "instructions_per_command"},
+	}
+	for _, kind := range kinds {
+		c := commands[kind]
+		commandTable.rows = append(commandTable.rows, []any{kind, c.count, c.words, float64(c.words) / float64(c.count)})
+	}
+	return []reportTable{unitTable, commandTable}
+}
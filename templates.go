@@ -0,0 +1,151 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// The Hack assembly generated for each VM command, as text/templates
+//
+//go:embed templates/hack.tmpl
+var builtinTemplates string
+
+// Data a snippet is rendered with, described in templates/hack.tmpl
+type snippetData struct {
+	Index   int
+	Base    string
+	Address int
+	Symbol  string
+	Comp    string
+	Scratch string
+	Label   string
+}
+
+// Most rendered snippets kept before the cache is emptied, bounding the
+// memory a long-running server can use for it
+const maxCachedSnippets = 1 << 14
+
+// The templates in use and the lines each has rendered to for the data seen
+// so far. Rendering a template allocates, so each command is rendered once.
+var snippets = struct {
+	sync.Mutex
+	tmpl  *template.Template
+	cache map[snippetKey][]string
+	docs  map[string]string // The comment opening each snippet, saying what it does
+
+	// Names and text of the files loaded over the built-in snippets
+	overrides string
+}{tmpl: template.Must(template.New("hack").Parse(builtinTemplates)), docs: snippetDocs(builtinTemplates)}
+
+// A {{define}} and the comment opening it
+var definedDoc = regexp.MustCompile(`(?s)\{\{define "([^"]+)"\}\}\s*\{\{/\*\s*(.*?)\s*\*/\}\}`)
+
+// A comment opening a template
+var leadingDoc = regexp.MustCompile(`(?s)^\s*\{\{/\*\s*(.*?)\s*\*/\}\}`)
+
+// The comment opening each snippet defined in text
+func snippetDocs(text string) map[string]string {
+	docs := map[string]string{}
+	for _, m := range definedDoc.FindAllStringSubmatch(text, -1) {
+		docs[m[1]] = m[2]
+	}
+	return docs
+}
+
+// What the snippet named does, from the comment opening its template, or ""
+// if it has none
+func snippetDoc(name string) string {
+	snippets.Lock()
+	defer snippets.Unlock()
+	return snippets.docs[name]
+}
+
+type snippetKey struct {
+	name string
+	data snippetData
+}
+
+// Append the lines of the snippet named, rendered with data, to asm
+func renderSnippet(asm []string, name string, data snippetData) ([]string, error) {
+	data.Scratch = strings.TrimPrefix(scratchRegister, "@")
+	key := snippetKey{name, data}
+	snippets.Lock()
+	defer snippets.Unlock()
+	lines, ok := snippets.cache[key]
+	if !ok {
+		var b strings.Builder
+		if err := snippets.tmpl.ExecuteTemplate(&b, name, data); err != nil {
+			return asm, err
+		}
+		for _, line := range strings.Split(b.String(), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				lines = append(lines, line)
+			}
+		}
+		if len(snippets.cache) >= maxCachedSnippets || snippets.cache == nil {
+			snippets.cache = map[snippetKey][]string{}
+		}
+		snippets.cache[key] = lines
+	}
+	return append(asm, lines...), nil
+}
+
+// Replace built-in snippets with the .tmpl files in dir, each named after the
+// snippet it replaces, e.g. push-temp.tmpl. Snippets without a file are kept.
+func LoadTemplates(dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.tmpl"))
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("no .tmpl files in %v", dir)
+	}
+	snippets.Lock()
+	defer snippets.Unlock()
+	tmpl, err := snippets.tmpl.Clone()
+	if err != nil {
+		return err
+	}
+	overrides := snippets.overrides
+	docs := map[string]string{}
+	for name, doc := range snippets.docs {
+		docs[name] = doc
+	}
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".tmpl")
+		if tmpl.Lookup(name) == nil || name == "hack" {
+			return fmt.Errorf("%v: no snippet named %v", path, name)
+		}
+		text, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if _, err := tmpl.New(name).Parse(string(text)); err != nil {
+			return err
+		}
+		overrides += name + "\x00" + string(text) + "\x00"
+		delete(docs, name)
+		if m := leadingDoc.FindStringSubmatch(string(text)); m != nil {
+			docs[name] = m[1]
+		}
+	}
+	snippets.tmpl = tmpl
+	snippets.docs = docs
+	snippets.overrides = overrides
+	snippets.cache = nil
+	return nil
+}
+
+// The text of every template in use, built-in or loaded, so anything keyed
+// on the generated code can tell when it changes
+func templateSource() string {
+	snippets.Lock()
+	defer snippets.Unlock()
+	return builtinTemplates + snippets.overrides
+}
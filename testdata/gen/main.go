@@ -0,0 +1,72 @@
+// Command gen writes a large synthetic .vm program for benchmarking and
+// profiling the translator, e.g.
+//
+//	go run ./testdata/gen -n 100000 -o testdata/Large.vm
+//	go run . testdata/Large.vm
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+)
+
+var segments = []struct {
+	name string
+	size int
+}{
+	{"local", 10},
+	{"argument", 10},
+	{"this", 10},
+	{"that", 10},
+	{"temp", 8},
+	{"static", 16},
+	{"pointer", 2},
+}
+
+func main() {
+	n := flag.Int("n", 100000, "number of VM commands to generate")
+	seed := flag.Int64("seed", 1, "random seed, the same seed gives the same program")
+	out := flag.String("o", "testdata/Large.vm", "output file")
+	flag.Parse()
+
+	f, err := os.Create(*out)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+
+	// Keep track of the stack depth so the program never pops an empty stack
+	rng := rand.New(rand.NewSource(*seed))
+	depth := 0
+	for i := 0; i < *n; i++ {
+		if i%20 == 0 {
+			fmt.Fprintf(w, "// block %d\n", i/20)
+		}
+
+		switch choice := rng.Intn(10); {
+		case depth >= 2 && choice < 3:
+			fmt.Fprintln(w, []string{"add", "sub"}[rng.Intn(2)])
+			depth--
+		case depth >= 1 && choice < 6:
+			seg := segments[rng.Intn(len(segments))]
+			fmt.Fprintf(w, "pop %v %d\n", seg.name, rng.Intn(seg.size))
+			depth--
+		case rng.Intn(2) == 0:
+			fmt.Fprintf(w, "push constant %d\n", rng.Intn(32768))
+			depth++
+		default:
+			seg := segments[rng.Intn(len(segments))]
+			fmt.Fprintf(w, "push %v %d\n", seg.name, rng.Intn(seg.size))
+			depth++
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		log.Fatal(err)
+	}
+}
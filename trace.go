@@ -0,0 +1,56 @@
+package main
+
+import "fmt"
+
+/*
+Trace instrumentation lets a crashed program be analysed after the fact.
+Before each command we write its VM line number to a ring buffer in RAM, so
+the buffer holds the last traceSize lines of the path taken through the
+program. Once it has wrapped, the oldest entry is the one the cursor points
+at.
+
+RAM[16127]		Trace cursor, the address of the next slot to write
+RAM[16128-16383]	Trace buffer, the top of the heap just below the screen
+
+The region is reserved: heapEnd stops short of it, so heap reports don't
+count it. The buffer's size is a power of two and it ends on a multiple of
+that size, so the cursor wraps by masking rather than a jump.
+*/
+const (
+	traceSize   = 256
+	traceBuffer = screenBase - traceSize
+	traceCursor = traceBuffer - 1
+)
+
+// Output lines that point the trace cursor at the start of the buffer. These
+// must run before the first traced command.
+func tracePreamble() []string {
+	return []string{
+		"// trace: reset cursor",
+		fmt.Sprintf("@%d", traceBuffer),
+		"D=A",
+		fmt.Sprintf("@%d", traceCursor),
+		"M=D",
+	}
+}
+
+// Write the instruction's VM line number to the trace buffer
+func (instr *Instruction) traceLine() {
+	instr.outputLines(
+		// *cursor=line
+		fmt.Sprintf("@%d", instr.lineNum),
+		"D=A",
+		fmt.Sprintf("@%d", traceCursor),
+		"A=M",
+		"M=D",
+		// cursor=buffer|((cursor+1)&(size-1))
+		fmt.Sprintf("@%d", traceCursor),
+		"D=M+1",
+		fmt.Sprintf("@%d", traceSize-1),
+		"D=D&A",
+		fmt.Sprintf("@%d", traceBuffer),
+		"D=D|A",
+		fmt.Sprintf("@%d", traceCursor),
+		"M=D",
+	)
+}
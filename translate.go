@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// Options controlling how a program is translated
+type Options struct {
+	Trace   bool         // Record each executed VM line in the trace buffer
+	Backend Backend      // Target to generate code for, Hack if nil
+	Passes  *PassManager // Optimisation passes run over each instruction
+	Unit    string       // Name of the file being translated, scoping its statics
+	Minify  bool         // Write only code and labels, without comments or blank lines
+	Explain bool         // Describe what each command's assembly does in a comment
+
+	// Comment each command's assembly with its goal, the registers and
+	// symbols it uses and its stack effect, for -comments=teach
+	Teach bool
+
+	// Fail on code that underflows or overflows the stack, assuming the
+	// stack starts empty
+	CheckStack bool
+
+	// Carry VM comments into the output. Trailing comments stay with the
+	// command they follow and full-line comments become comments of their own.
+	KeepComments bool
+
+	// Replace each line that fails to translate with a comment saying so and
+	// carry on, returning every error at the end as an ErrorList
+	KeepGoing bool
+
+	// Accept negative constants, e.g. push constant -5, which the spec
+	// leaves out
+	NegativeConstants bool
+
+	// Accept the commands of the extended dialect, mul, div, mod, shiftleft
+	// and shiftright
+	Extended bool
+}
+
+// Unit name statics are scoped to when the source has no file name
+const defaultUnit = "Main"
+
+// The unit name of a .vm file, e.g. Foo for dir/Foo.vm
+func unitName(filename string) string {
+	if filename == "" {
+		return ""
+	}
+	base := filepath.Base(filename)
+	if trimmed, ok := strings.CutSuffix(base, bytecodeExt); ok {
+		return trimmed
+	}
+	return strings.TrimSuffix(base, ".vm")
+}
+
+// An error in the VM source, located by its 1-based line number and, when
+// known, the file it is in
+type SourceError struct {
+	File   string
+	Line   int
+	Source string // Text of the line, if known
+	Err    error
+}
+
+func (e *SourceError) Error() string {
+	if e.File != "" {
+		return fmt.Sprintf("%v:%d: %v", e.File, e.Line, e.Err)
+	}
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *SourceError) Unwrap() error {
+	return e.Err
+}
+
+// The errors found translating with KeepGoing, in the order of their lines
+type ErrorList []*SourceError
+
+func (l ErrorList) Error() string {
+	msgs := make([]string, len(l))
+	for i, err := range l {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Call fix with each SourceError in err, which may be an ErrorList
+func eachSourceError(err error, fix func(*SourceError)) {
+	var list ErrorList
+	if errors.As(err, &list) {
+		for _, srcErr := range list {
+			fix(srcErr)
+		}
+		return
+	}
+	var srcErr *SourceError
+	if errors.As(err, &srcErr) {
+		fix(srcErr)
+	}
+}
+
+// Lines starting and ending a block of assembly copied into the output as is
+const (
+	asmBlockStart = "//#asm"
+	asmBlockEnd   = "//#endasm"
+)
+
+// Read VM code from r line by line, then parse and translate each instruction,
+// passing it to emit. Empty lines and comments are dropped. The lines of an
+// inline assembly block between //#asm and //#endasm are passed to emit as one
+// instruction, their own translation, after checking they assemble when
+// targeting Hack. With KeepGoing a line that fails is passed to emit as a
+// comment in its place.
+//
+// A single Instruction is reused for every line so memory stays flat however
+// large the input is. emit must not retain the instruction or its
+// translatedLines after it returns.
+func translateStream(r io.Reader, opts Options, emit func(*Instruction) error) error {
+	// Scan through it line by line
+	scanner := bufio.NewScanner(r)
+	scanner.Split(bufio.ScanLines)
+
+	backend := opts.backend()
+	if b, ok := backend.(statefulBackend); ok {
+		backend = b.fresh()
+	}
+	var inLine Instruction
+	var depth stackDepth
+
+	commands := fuser{pm: opts.Passes, emit: emit}
+
+	// Consecutive full-line comments, kept to emit together
+	var comments Instruction
+	flushComments := func() error {
+		if len(comments.translatedLines) == 0 {
+			return nil
+		}
+		if err := commands.flush(); err != nil {
+			return err
+		}
+		err := emit(&comments)
+		comments.translatedLines = comments.translatedLines[:0]
+		return err
+	}
+
+	// Stop at a line's error, or with KeepGoing note it and emit a comment
+	// in place of the line
+	var skipped ErrorList
+	fail := func(srcErr *SourceError) error {
+		if !opts.KeepGoing {
+			return srcErr
+		}
+		skipped = append(skipped, srcErr)
+		if err := flushComments(); err != nil {
+			return err
+		}
+		if err := commands.flush(); err != nil {
+			return err
+		}
+		placeholder := Instruction{lineNum: srcErr.Line, unit: opts.Unit, operation: "comment"}
+		placeholder.outputLines(fmt.Sprintf("%vline %d not translated: %v", backend.CommentPrefix(), srcErr.Line, srcErr.Err))
+		return emit(&placeholder)
+	}
+
+	inAsm := false
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		text := scanner.Text()
+
+		if inAsm {
+			if strings.TrimSpace(text) != asmBlockEnd {
+				inLine.outputLines(text)
+				continue
+			}
+			inAsm = false
+			if err := checkAsmBlock(backend, &inLine); err != nil {
+				var srcErr *SourceError
+				if !errors.As(err, &srcErr) {
+					return err
+				}
+				if err := fail(srcErr); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := commands.flush(); err != nil {
+				return err
+			}
+			if err := emit(&inLine); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Keep the buffer of translated lines from the last instruction
+		lines := inLine.translatedLines[:0]
+		inLine = NewInstruction(text)
+		inLine.lineNum = lineNum
+		inLine.unit = opts.Unit
+		inLine.translatedLines = lines
+		if opts.KeepComments {
+			if comment, ok := strings.CutPrefix(strings.TrimSpace(text), "//"); ok && strings.TrimSpace(text) != asmBlockStart {
+				if len(comments.translatedLines) == 0 {
+					comments = Instruction{lineNum: lineNum, operation: "comment", translatedLines: comments.translatedLines}
+				}
+				comments.outputLines(backend.CommentPrefix() + strings.TrimSpace(comment))
+				continue
+			}
+			if err := flushComments(); err != nil {
+				return err
+			}
+		}
+		if strings.TrimSpace(text) == asmBlockStart {
+			inAsm = true
+			inLine.empty = false
+			inLine.stripped = "inline assembly"
+			inLine.operation = "asm"
+			continue
+		}
+		err := inLine.parse()
+		if err == nil {
+			err = inLine.checkExtensions(opts)
+		}
+		if err != nil {
+			if err := fail(&SourceError{Line: lineNum, Source: text, Err: err}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Only emit line if has valid instruction
+		if !inLine.empty {
+			if opts.KeepComments {
+				inLine.stripped = strings.TrimSpace(text)
+			}
+			if opts.CheckStack {
+				if err := depth.apply(&inLine); err != nil {
+					if err := fail(&SourceError{Line: lineNum, Source: text, Err: err}); err != nil {
+						return err
+					}
+					continue
+				}
+			}
+			if err := backend.Translate(&inLine); err != nil {
+				if err := fail(&SourceError{Line: lineNum, Source: text, Err: err}); err != nil {
+					return err
+				}
+				continue
+			}
+			opts.Passes.run(&inLine)
+			if err := commands.add(&inLine); err != nil {
+				return err
+			}
+		}
+	}
+	if inAsm {
+		if err := fail(&SourceError{Line: inLine.lineNum, Source: asmBlockStart, Err: errors.New("missing " + asmBlockEnd)}); err != nil {
+			return err
+		}
+	}
+	if err := flushComments(); err != nil {
+		return err
+	}
+	if err := commands.flush(); err != nil {
+		return err
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(skipped) > 0 {
+		return skipped
+	}
+	return nil
+}
+
+// Check that the Hack assembly in an inline block assembles, locating any
+// error at its line of the VM source
+func checkAsmBlock(backend Backend, block *Instruction) error {
+	switch backend.(type) {
+	case hackBackend, nullBackend:
+	default:
+		return nil
+	}
+	_, err := assemble(strings.Join(block.translatedLines, "\n"))
+	var srcErr *SourceError
+	if errors.As(err, &srcErr) {
+		srcErr.Line += block.lineNum
+		srcErr.Source = block.translatedLines[srcErr.Line-block.lineNum-1]
+	}
+	return err
+}
+
+// Read and translate all instructions from r, keeping every one in memory.
+// Instructions are stored by value in a single slice to save allocations.
+func translateInstructions(r io.Reader, opts Options) ([]*Instruction, error) {
+	var translated []Instruction
+	err := translateStream(r, opts, func(instr *Instruction) error {
+		kept := *instr
+		kept.translatedLines = append([]string(nil), instr.translatedLines...)
+		translated = append(translated, kept)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	processedInstructions := make([]*Instruction, len(translated))
+	for i := range translated {
+		processedInstructions[i] = &translated[i]
+	}
+	return processedInstructions, nil
+}
+
+// Write the translated lines of each instruction to w
+func writeInstructions(w io.StringWriter, processedInstructions []*Instruction, opts Options) error {
+	aw := newAsmWriter(w, opts)
+	for _, instr := range processedInstructions {
+		aw.writeInstruction(instr)
+	}
+	aw.finish()
+	return aw.err
+}
+
+// Writes translated instructions as they are produced, between the backend's
+// prologue and epilogue. Each instruction is preceded by a comment holding its
+// source and followed by a blank line, with no newline after the final line
+// of output. When minifying, comments and blank lines are dropped and every
+// other line is written one after another. finish must be called after the
+// last instruction.
+type asmWriter struct {
+	errWriter
+	backend  Backend
+	minify   bool
+	explain  bool // Follow each command's header with what its assembly does
+	teach    bool // Follow each command's header with its teachComments
+	started  bool
+	numLines int  // Number of instructions written
+	words    int  // Number of ROM words among the lines written, if they're Hack
+	wrote    bool // Whether any line has been written when minifying
+}
+
+func newAsmWriter(w io.StringWriter, opts Options) *asmWriter {
+	return &asmWriter{errWriter: errWriter{w: w}, backend: opts.backend(), minify: opts.Minify, explain: opts.Explain, teach: opts.Teach}
+}
+
+// Write the lines that aren't comments or blank, each on a line of its own.
+// Hack assembly, which has no string literals for a comment marker to be
+// part of, also loses the comments at the end of lines.
+func (aw *asmWriter) writeMinified(lines []string) {
+	comment := strings.TrimSpace(aw.backend.CommentPrefix())
+	_, hack := aw.backend.(hackBackend)
+	for _, line := range lines {
+		if hack {
+			code, _, _ := strings.Cut(line, comment)
+			line = strings.TrimRight(code, " \t")
+		}
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, comment) {
+			continue
+		}
+		if aw.wrote {
+			aw.writeString("\n")
+		}
+		aw.wrote = true
+		aw.writeString(line)
+	}
+}
+
+// Count the lines that are instructions rather than labels or comments
+func (aw *asmWriter) count(lines []string) {
+	for _, line := range lines {
+		aw.words += asmCost(line)
+	}
+}
+
+func (aw *asmWriter) start() {
+	if !aw.started {
+		aw.started = true
+		aw.count(aw.backend.Prologue())
+		if aw.minify {
+			aw.writeMinified(aw.backend.Prologue())
+			return
+		}
+		for _, tLine := range aw.backend.Prologue() {
+			aw.writeString(tLine)
+			aw.writeString("\n")
+		}
+	}
+}
+
+func (aw *asmWriter) writeInstruction(instr *Instruction) {
+	aw.start()
+	aw.count(instr.translatedLines)
+	if aw.minify {
+		aw.writeMinified(instr.translatedLines)
+		return
+	}
+	if aw.numLines > 0 {
+		aw.writeString("\n\n")
+	}
+	aw.numLines++
+
+	DEBUG := true
+	// Output command with original line num and instruction, unless the
+	// instruction is only comments
+	if DEBUG && instr.operation != "comment" {
+		aw.writeString(aw.backend.CommentPrefix())
+		aw.writeString(instr.stripped)
+		aw.writeString("\n")
+		if explanation := explainInstruction(instr); aw.explain && explanation != "" {
+			aw.writeString(aw.backend.CommentPrefix())
+			aw.writeString(explanation)
+			aw.writeString("\n")
+		}
+		if aw.teach {
+			for _, comment := range teachComments(instr) {
+				aw.writeString(aw.backend.CommentPrefix())
+				aw.writeString(comment)
+				aw.writeString("\n")
+			}
+		}
+	}
+
+	// Output translated lines
+	for tNum, tLine := range instr.translatedLines {
+		if tNum > 0 {
+			aw.writeString("\n")
+		}
+		aw.writeString(tLine)
+	}
+}
+
+// Write the epilogue after the last instruction
+func (aw *asmWriter) finish() {
+	aw.start()
+	aw.count(aw.backend.Epilogue())
+	if aw.minify {
+		aw.writeMinified(aw.backend.Epilogue())
+		return
+	}
+	for _, tLine := range aw.backend.Epilogue() {
+		aw.writeString("\n")
+		aw.writeString(tLine)
+	}
+}
+
+// Wraps a writer to keep the first error, so a long run of writes only has to
+// be checked once at the end
+type errWriter struct {
+	w   io.StringWriter
+	err error
+}
+
+func (ew *errWriter) writeString(s string) {
+	if ew.err == nil {
+		_, ew.err = ew.w.WriteString(s)
+	}
+}
+
+// Translate a whole VM program held in memory, returning the assembly
+func translateString(source string, opts Options) (string, error) {
+	var b strings.Builder
+	aw := newAsmWriter(&b, opts)
+	err := translateStream(strings.NewReader(source), opts, func(instr *Instruction) error {
+		aw.writeInstruction(instr)
+		return aw.err
+	})
+	if err != nil {
+		return "", err
+	}
+	aw.finish()
+	return b.String(), nil
+}
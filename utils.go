@@ -1,8 +1,9 @@
 package main
 
-// Filter empty strings from slice of strings
+// Filter empty strings from slice of strings. The filtered strings reuse the
+// backing array of slice.
 func filterBlanks(slice []string) []string {
-	var filtered = []string{}
+	var filtered = slice[:0]
 	for _, t := range slice {
 		if t != "" {
 			filtered = append(filtered, t)
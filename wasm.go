@@ -0,0 +1,32 @@
+//go:build js && wasm
+
+package main
+
+import "syscall/js"
+
+// Expose the translator to JavaScript as a global function
+//
+//	translate(source) -> {asm: string, errors: string[]}
+//
+// Build with `GOOS=js GOARCH=wasm go build -o vm-translator.wasm` and load it
+// with the wasm_exec.js support file shipped in $(go env GOROOT)/lib/wasm.
+func main() {
+	js.Global().Set("translate", js.FuncOf(jsTranslate))
+
+	// Keep the Go runtime alive so the function stays callable
+	select {}
+}
+
+func jsTranslate(this js.Value, args []js.Value) interface{} {
+	errors := []interface{}{}
+	if len(args) != 1 || args[0].Type() != js.TypeString {
+		errors = append(errors, "translate expects a single string of VM source")
+		return map[string]interface{}{"asm": "", "errors": errors}
+	}
+
+	asm, err := translateString(args[0].String(), Options{})
+	if err != nil {
+		errors = append(errors, err.Error())
+	}
+	return map[string]interface{}{"asm": asm, "errors": errors}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// RAM addresses watched with repeated -watch flags, each a number, a
+// predefined symbol such as THIS or SCREEN, or a segment such as this for
+// its pointer
+type watchFlags []int
+
+func (w *watchFlags) String() string {
+	var addrs []string
+	for _, addr := range *w {
+		addrs = append(addrs, strconv.Itoa(addr))
+	}
+	return strings.Join(addrs, ",")
+}
+
+func (w *watchFlags) Set(name string) error {
+	if pointer, ok := segmentPointers[name]; ok {
+		name = pointer
+	}
+	addr, ok := hackSymbols[name]
+	if !ok {
+		n, err := strconv.Atoi(name)
+		if err != nil || n < 0 || n >= hackRAMSize {
+			return fmt.Errorf("%q isn't a RAM address, symbol or segment", name)
+		}
+		addr = n
+	}
+	*w = append(*w, addr)
+	return nil
+}
+
+// Watches a machine's writes to a set of addresses, noting the first that
+// changes one's value
+type watchpoints struct {
+	m      *Machine
+	values map[int]int16 // Value last seen at each watched address
+	hit    *watchHit
+}
+
+// A change to a watched address
+type watchHit struct {
+	addr     int
+	from, to int16
+}
+
+// Watch addrs of m from the values they have now
+func newWatchpoints(m *Machine, addrs []int) *watchpoints {
+	w := &watchpoints{m: m, values: map[int]int16{}}
+	for _, addr := range addrs {
+		w.values[addr] = m.RAM[addr]
+	}
+	return w
+}
+
+// Record an access by the machine, for use as Machine.Watch
+func (w *watchpoints) watch(addr int, write bool) {
+	old, ok := w.values[addr]
+	if !write || !ok || w.m.RAM[addr] == old {
+		return
+	}
+	w.values[addr] = w.m.RAM[addr]
+	if w.hit == nil {
+		w.hit = &watchHit{addr, old, w.m.RAM[addr]}
+	}
+}
+
+// Take the change since the last call, if there was one
+func (w *watchpoints) take() *watchHit {
+	hit := w.hit
+	w.hit = nil
+	return hit
+}
+
+// Describe the change as made by the instruction at pc of p
+func (h *watchHit) describe(p *profiler, pc int) string {
+	return fmt.Sprintf("RAM[%d] (%v) changed from %d to %d at %v", h.addr, ramRegion(h.addr), h.from, h.to, p.location(pc))
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+Generates x86-64 assembly (GNU as, Intel syntax) for Linux, so programs can be
+run natively and compared against the Hack target. Build the output with
+
+	gcc -o Foo Foo.s
+
+The VM stack is the native stack, one 64-bit slot per value, and every other
+segment lives in vm_ram, an array of 16-bit words laid out like Hack RAM:
+RAM[1-4] hold LCL, ARG, THIS and THAT, and RAM[5-12] hold `temp`. Values are
+kept sign-extended from 16 bits so arithmetic wraps as it does on Hack. rbx
+holds the address of vm_ram throughout.
+
+The program is emitted as main, which returns the value on top of the stack
+as the exit status, or 0 if the stack is empty.
+*/
+type x86Backend struct{}
+
+// RAM index of each segment's base pointer
+var x86SegmentPointers = map[string]int{
+	"local":    1,
+	"argument": 2,
+	"this":     3,
+	"that":     4,
+}
+
+// Memory operand for RAM[addr]
+func x86RAM(addr int) string {
+	return fmt.Sprintf("word ptr [rbx + %d]", 2*addr)
+}
+
+func (x86Backend) Extension() string {
+	return ".s"
+}
+
+func (x86Backend) Prologue() []string {
+	return []string{
+		"\t.intel_syntax noprefix",
+		"\t.text",
+		"\t.globl main",
+		"main:",
+		"\tpush rbp",
+		"\tmov rbp, rsp",
+		"\tpush rbx",
+		"\tlea rbx, [rip + vm_ram]",
+	}
+}
+
+func (x86Backend) Epilogue() []string {
+	return []string{
+		"# return the top of the VM stack, or 0 if it is empty",
+		"\txor eax, eax",
+		"\tlea rcx, [rbp - 8]",
+		"\tcmp rsp, rcx",
+		"\tje 1f",
+		"\tmov rax, [rsp]",
+		"1:",
+		"\tmov rbx, [rbp - 8]",
+		"\tleave",
+		"\tret",
+		"",
+		"\t.comm vm_ram, 65536, 2",
+		"\t.section .note.GNU-stack, \"\", @progbits",
+		"", // as wants a newline at the end
+	}
+}
+
+func (x86Backend) CommentPrefix() string {
+	return "# "
+}
+
+func (x86Backend) Translate(instr *Instruction) error {
+	i := instr.value
+	switch instr.operation {
+	case "push":
+		switch instr.segment {
+		case "constant":
+			instr.outputLines(fmt.Sprintf("\tpush %d", i))
+		case "local", "argument", "this", "that":
+			instr.outputLines(
+				fmt.Sprintf("\tmovzx eax, %v", x86RAM(x86SegmentPointers[instr.segment])),
+				fmt.Sprintf("\tmovsx rax, word ptr [rbx + rax*2 + %d]", 2*i),
+				"\tpush rax",
+			)
+		case "temp":
+			instr.outputLines(fmt.Sprintf("\tmovsx rax, %v", x86RAM(5+i)), "\tpush rax")
+		case "pointer":
+			instr.outputLines(fmt.Sprintf("\tmovsx rax, %v", x86RAM(3+i)), "\tpush rax")
+		default:
+			return unsupportedSegment(instr, "x86-64")
+		}
+	case "pop":
+		switch instr.segment {
+		case "local", "argument", "this", "that":
+			instr.outputLines(
+				fmt.Sprintf("\tmovzx eax, %v", x86RAM(x86SegmentPointers[instr.segment])),
+				"\tpop rcx",
+				fmt.Sprintf("\tmov word ptr [rbx + rax*2 + %d], cx", 2*i),
+			)
+		case "temp":
+			instr.outputLines("\tpop rax", fmt.Sprintf("\tmov %v, ax", x86RAM(5+i)))
+		case "pointer":
+			instr.outputLines("\tpop rax", fmt.Sprintf("\tmov %v, ax", x86RAM(3+i)))
+		case "constant":
+			return errors.New("`pop constant` not implemented, doesn't make sense")
+		default:
+			return unsupportedSegment(instr, "x86-64")
+		}
+	case "add", "sub":
+		instr.outputLines(
+			"\tpop rcx",
+			"\tpop rax",
+			fmt.Sprintf("\t%v eax, ecx", instr.operation),
+			"\tmovsx rax, ax", // wrap to 16 bits
+			"\tpush rax",
+		)
+	case "mul":
+		instr.outputLines(
+			"\tpop rcx",
+			"\tpop rax",
+			"\timul eax, ecx",
+			"\tmovsx rax, ax",
+			"\tpush rax",
+		)
+	case "shiftleft", "shiftright":
+		op := map[string]string{"shiftleft": "shl", "shiftright": "sar"}[instr.operation]
+		instr.outputLines(
+			"\tpop rax",
+			fmt.Sprintf("\t%v rax, 1", op),
+			"\tmovsx rax, ax",
+			"\tpush rax",
+		)
+	case "div", "mod":
+		// idiv leaves the quotient in rax and the remainder in rdx
+		result := map[string]string{"div": "ax", "mod": "dx"}[instr.operation]
+		instr.outputLines(
+			"\tpop rcx",
+			"\tpop rax",
+			"\tcqo",
+			"\tidiv rcx",
+			fmt.Sprintf("\tmovsx rax, %v", result),
+			"\tpush rax",
+		)
+	}
+	return nil
+}